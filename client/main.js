@@ -88,6 +88,7 @@ class Client {
 
 
     this.notifier = null
+    this.onToken = null
 
     this.checkStatus = this.checkStatus.bind(this)
     this.errorDelegate = this.errorDelegate.bind(this)
@@ -100,6 +101,12 @@ class Client {
   }
 
   checkStatus(response) {
+    // The proxy renews tokens as they age.
+    let auth = response.headers.get("Authorization")
+    if (auth && this.onToken) {
+      this.onToken(auth.replace("Bearer ", ""))
+    }
+
     if (response.status >= 200 && response.status < 300) {
       return response
     }
@@ -119,8 +126,17 @@ class Client {
     return request
   }
 
+  // Unsafe requests carrying our cookies echo the CSRF cookie back.
+  __csrf(request) {
+    let match = document.cookie.match(/(?:^|;\s*)csrfToken=([^;]*)/)
+    if (match) {
+      request.headers = Object.assign({}, request.headers, {"X-CSRF-Token": match[1]})
+    }
+    return request
+  }
+
   login(user, pass, success, failure) {
-    let query = { method: "POST", body: JSON.stringify({"email": user, "password": pass})}
+    let query = this.__csrf({ method: "POST", body: JSON.stringify({"email": user, "password": pass})})
     fetch(this.url + "/auth/", query)
       .then(res => this.checkStatus(res))
       .then(res => res.json())
@@ -128,8 +144,38 @@ class Client {
       .catch(err => failure(err))
   }
 
+  // Second factor: answer a login challenge with a code, or enroll
+  // when the account is required to have one.
+  authStep(path, body, success, failure) {
+    let query = this.__csrf({ method: "POST", body: JSON.stringify(body), credentials: "include" })
+    fetch(this.url + "/auth" + path, query)
+      .then(res => this.checkStatus(res))
+      .then(res => res.json())
+      .then(data => success(data))
+      .catch(err => failure(err))
+  }
+
+  // Whether single sign on is available, and where it starts.
+  singleSignOn(success) {
+    fetch(this.url + "/auth/oidc")
+      .then(res => this.checkStatus(res))
+      .then(res => res.json())
+      .then(data => success(data))
+      .catch(err => this.errorDelegate(err))
+  }
+
   validate(token, success, failure) {
-    let query = { method: "POST", body: JSON.stringify({"token": token})}
+    let query = this.__csrf({ method: "POST", body: JSON.stringify({"token": token})})
+    fetch(this.url + "/auth", query)
+      .then(res => this.checkStatus(res))
+      .then(res => res.json())
+      .then(data => success(data))
+      .catch(err => failure(err))
+  }
+
+  refresh(success, failure) {
+    // The refresh token is in a cookie only sent to /auth.
+    let query = this.__csrf({ method: "POST", body: "{}", credentials: "include" })
     fetch(this.url + "/auth", query)
       .then(res => this.checkStatus(res))
       .then(res => res.json())
@@ -137,6 +183,32 @@ class Client {
       .catch(err => failure(err))
   }
 
+  changePassword(current, password, success, failure) {
+    let query = this.__authorize({
+      method: "POST",
+      body: JSON.stringify({"current": current, "password": password})
+    })
+    this.__password("", query, success, failure)
+  }
+
+  forgotPassword(email, success, failure) {
+    let query = { method: "POST", body: JSON.stringify({"email": email}) }
+    this.__password("/forgot", query, success, failure)
+  }
+
+  resetPassword(token, password, success, failure) {
+    let query = { method: "POST", body: JSON.stringify({"token": token, "password": password}) }
+    this.__password("/reset", query, success, failure)
+  }
+
+  // Failures pass on the proxy's reason ("password must be...").
+  __password(path, query, success, failure) {
+    fetch(this.url + "/password" + path, query)
+      .then(res => res.ok ? res.text() : res.json().then(err => { throw new Error(err.detail) }))
+      .then(text => success(text ? JSON.parse(text) : {}))
+      .catch(err => failure(err.message))
+  }
+
   sendCommand(command, success, failure) {
     let query = this.__authorize({
       method: "POST",
@@ -183,7 +255,7 @@ const e = preact.createElement
 const component = preact.Component
 
 // Pre-declare these to assuage eslint.
-var Section, Button, Div, H1, Table, Thead, Tbody, Tr, Td, Th, P, Input
+var Section, Button, Div, H1, Table, Thead, Tbody, Tr, Td, Th, P, Input, A
 
 const getHtmlTagFunctions = () => {
 
@@ -199,7 +271,7 @@ const getHtmlTagFunctions = () => {
 
   const elements = [
     "Section", "Button", "Div", "H1", "Table",
-    "Thead", "Tbody", "Tr", "Td", "Th", "P", "Input"
+    "Thead", "Tbody", "Tr", "Td", "Th", "P", "Input", "A"
   ]
 
   elements.map(name => this[name] = partial(preact.h, name.toLowerCase()))
@@ -207,6 +279,32 @@ const getHtmlTagFunctions = () => {
 
 getHtmlTagFunctions()
 
+// nextPath is where to go after signing in, if it's on this server.
+const nextPath = () => {
+  let next = new URLSearchParams(window.location.search).get("next")
+  if (next && next.startsWith("/") && !next.startsWith("//")) {
+    return next
+  }
+  return null
+}
+
+const ssoLink = (login) => {
+  let next = nextPath()
+  return next ? login + "?next=" + encodeURIComponent(next) : login
+}
+
+// ssoChallenge is a second factor challenge handed back by single
+// sign on, in the fragment so it stays out of logs.
+const ssoChallenge = () => {
+  let params = new URLSearchParams(window.location.hash.slice(1))
+  let challenge = params.get("challenge")
+  return challenge ? {challenge: challenge, enroll: params.get("enroll") === "1"} : null
+}
+
+// resetToken is the token from an emailed password reset link.
+const resetToken = () =>
+  new URLSearchParams(window.location.search).get("reset")
+
 const renderUser = (token) => {
   try {
     let parts = token.split(".")
@@ -235,25 +333,81 @@ class LoginPhase extends component {
   constructor(props) {
     super(props)
 
-    this.state = {user : "", pass: "", error: ""}
+    this.state = {user : "", pass: "", code: "", challenge: null, enroll: null, error: "", sso: null}
 
     this.handleChange = this.handleChange.bind(this)
     this.handleSubmit = this.handleSubmit.bind(this)
     this.handleKeyDown = this.handleKeyDown.bind(this)
+    this.handleForgot = this.handleForgot.bind(this)
+  }
+
+  handleForgot(e) {
+    e.preventDefault()
+    const user = this.state.user.trim()
+    if (user.length === 0) {
+      this.setState({error: "Enter your email, then choose forgot password."})
+      document.getElementById("user").focus()
+      return
+    }
+    const sent = (res) => this.setState({error: res.message})
+    const fail = (reason) => this.setState({error: reason})
+    this.props.client.forgotPassword(user, sent, fail)
+  }
+
+  componentDidMount() {
+    const { client } = this.props
+    client.singleSignOn(sso => {
+      if (sso.enabled) {
+        this.setState({sso: sso.login})
+      }
+    })
+
+    const step = ssoChallenge()
+    if (step) {
+      window.history.replaceState(null, "", window.location.pathname + window.location.search)
+      if (step.enroll) {
+        const enrolled = (e) => this.setState({challenge: step.challenge, enroll: e, code: ""})
+        const fail = () => this.setState({error: "Unable to sign in."})
+        client.authStep("/totp/enroll", {challenge: step.challenge}, enrolled, fail)
+      } else {
+        this.setState({challenge: step.challenge, code: ""})
+      }
+    }
   }
 
   handleSubmit() {
     const { login, client } = this.props
-    let { user, pass } = this.state
+    let { user, pass, code, challenge, enroll } = this.state
     user = user.trim()
 
-    const woot = (result) => login(result.token)
+    const woot = (result) => {
+      if (result.recovery_codes) {
+        window.alert("Keep these recovery codes somewhere safe:\n\n" +
+                     result.recovery_codes.join("\n"))
+      }
+      if (result.mfa_required) {
+        this.setState({challenge: result.challenge, code: ""})
+        return
+      }
+      if (result.mfa_enrollment_required) {
+        const enrolled = (e) => this.setState({challenge: result.challenge, enroll: e, code: ""})
+        client.authStep("/totp/enroll", {challenge: result.challenge}, enrolled, fail)
+        return
+      }
+      login(result.token)
+    }
 
     const fail = () => {
-      this.setState({error: "Unable to sign in."})
+      this.setState({error: "Unable to sign in.", challenge: null, enroll: null, code: ""})
       document.getElementById("user").focus()
     }
 
+    if (challenge) {
+      const path = enroll ? "/totp/confirm" : ""
+      client.authStep(path, {challenge: challenge, code: code.trim()}, woot, fail)
+      return
+    }
+
     client.login(user, pass, woot, fail)
   }
 
@@ -271,15 +425,18 @@ class LoginPhase extends component {
       }
       break
     case 27:
-      this.setState({user: "", pass: ""})
-      document.getElementById("user").focus()
+      this.setState({user: "", pass: "", code: "", challenge: null, enroll: null},
+                    () => document.getElementById("user").focus())
       break
     default:
     }
   }
 
   isSubmittable() {
-    let { user, pass, error } = this.state
+    let { user, pass, code, challenge, error } = this.state
+    if (challenge) {
+      return code.trim().length > 0
+    }
     user = user.trim()
     pass = pass.trim()
     if (error.length > 0) {
@@ -288,7 +445,7 @@ class LoginPhase extends component {
     return (user.length > 0) && (pass.length > 0)
   }
 
-  render(_, { user, pass, error }) {
+  render(_, { user, pass, code, challenge, enroll, error, sso }) {
 
     const submit = this.isSubmittable() ? (
       Button({onClick: this.handleSubmit}, "Sign in")
@@ -296,6 +453,36 @@ class LoginPhase extends component {
       null
     )
 
+    if (challenge) {
+      const help = enroll ? (
+        Div({class: "Enroll"},
+          P({}, "Two-factor authentication is required. Add this key to your authenticator app, then enter the code it shows:"),
+          P({class: "Secret"}, enroll.secret),
+          P({class: "Uri"}, enroll.uri))
+      ) : (
+        P({}, "Enter the code from your authenticator app, or a recovery code.")
+      )
+
+      return (
+        Section({class: "LoginForm"},
+          Section({class: "LoginPanel"},
+            H1({}, "Sign in to the Launchpad"),
+            Div({class: "Error"}, error),
+            help,
+            Div({class: "Control"}, submit),
+            Div({class: "Widgets"},
+              Div({class: "Widget"},
+                Input({id: "code",
+                  type: "text",
+                  name: "code",
+                  value: code,
+                  autoComplete: "one-time-code",
+                  autoFocus: true,
+                  placeholder: "Code",
+                  onKeyDown: this.handleKeyDown,
+                  onChange: this.handleChange}))))))
+    }
+
     return (
       Section({class: "LoginForm"},
         Section({class: "LoginPanel"},
@@ -321,7 +508,80 @@ class LoginPhase extends component {
                 autoFocus: false,
                 placeholder: "Password",
                 onKeyDown: this.handleKeyDown,
-                onChange: this.handleChange}))))))
+                onChange: this.handleChange}))),
+          Div({class: "Sso"}, A({href: "#", onClick: this.handleForgot}, "Forgot password?")),
+          sso ? Div({class: "Sso"}, A({href: ssoLink(sso)}, "Sign in with single sign on")) : null)))
+  }
+}
+
+//-----------------------------------------------------------------------------
+
+class ResetPhase extends component {
+
+  constructor(props) {
+    super(props)
+
+    this.state = {pass: "", again: "", error: "", done: false}
+
+    this.handleChange = this.handleChange.bind(this)
+    this.handleSubmit = this.handleSubmit.bind(this)
+  }
+
+  handleChange(e) {
+    this.setState({[e.target.name]: e.target.value, error: ""})
+  }
+
+  handleSubmit() {
+    const { pass, again } = this.state
+    if (pass !== again) {
+      this.setState({error: "The passwords don't match."})
+      return
+    }
+    const done = () => this.setState({done: true})
+    const fail = (reason) => this.setState({error: reason})
+    this.props.client.resetPassword(resetToken(), pass, done, fail)
+  }
+
+  render(_, { pass, again, error, done }) {
+
+    if (done) {
+      return (
+        Section({class: "LoginForm"},
+          Section({class: "LoginPanel"},
+            H1({}, "Password changed"),
+            P({}, "Your password has been changed, and you've been signed out everywhere."),
+            Div({class: "Sso"}, A({href: "/"}, "Sign in")))))
+    }
+
+    const submit = pass.length > 0 && again.length > 0 ? (
+      Button({onClick: this.handleSubmit}, "Set password")
+    ) : (
+      null
+    )
+
+    return (
+      Section({class: "LoginForm"},
+        Section({class: "LoginPanel"},
+          H1({}, "Choose a new password"),
+          Div({class: "Error"}, error),
+          Div({class: "Control"}, submit),
+          Div({class: "Widgets"},
+            Div({class: "Widget"},
+              Input({type: "password",
+                name: "pass",
+                value: pass,
+                autoComplete: "new-password",
+                autoFocus: true,
+                placeholder: "New password",
+                onChange: this.handleChange})),
+            Div({class: "Widget Pass"},
+              Input({type: "password",
+                name: "again",
+                value: again,
+                autoComplete: "new-password",
+                placeholder: "New password again",
+                onChange: this.handleChange})))))
+    )
   }
 }
 
@@ -358,11 +618,19 @@ class AppIcon extends component {
 
 class Application extends component {
 
-  render({ application, onLaunch }) {
+  render({ application, onLaunch, maintenance }) {
+    const className = maintenance ? "Application Maintenance" : "Application"
+    const badge = maintenance ? (
+      Div({class: "Badge", title: maintenance.message}, "Maintenance")
+    ) : (
+      null
+    )
+
     return (
-      Div({class: "Application"},
+      Div({class: className},
         Div({onClick: () => onLaunch(application.context)},
           e(AppIcon, {icon: application.icon}),
+          badge,
           Div({class: "Title"}, application.name),
           Div({class: "Context"}, application.version))))
   }
@@ -370,12 +638,16 @@ class Application extends component {
 
 class LaunchPad extends component {
 
-  render({ apps, onLaunch }) {
+  render({ apps, maintenance, onLaunch }) {
+    const down = (context) =>
+      maintenance.find(m => m.context === context)
+
     return (
       e(WorkArea, {},
         Section({class: "LaunchPad"},
           apps.map(a => e(Application, {key: a.context,
             application: a,
+            maintenance: down(a.context),
             onLaunch: onLaunch})))))
   }
 }
@@ -427,6 +699,56 @@ class Appstore extends component {
   }
 }
 
+class ChangePassword extends component {
+
+  constructor(props) {
+    super(props)
+
+    this.state = {current: "", pass: "", again: "", message: ""}
+
+    this.handleChange = this.handleChange.bind(this)
+    this.handleSubmit = this.handleSubmit.bind(this)
+  }
+
+  handleChange(e) {
+    this.setState({[e.target.name]: e.target.value, message: ""})
+  }
+
+  handleSubmit() {
+    const { current, pass, again } = this.state
+    if (pass !== again) {
+      this.setState({message: "The new passwords don't match."})
+      return
+    }
+    const done = (res) => {
+      this.props.client.onToken(res.token)
+      this.setState({current: "", pass: "", again: "",
+        message: "Password changed. Your other sessions have been signed out."})
+    }
+    const fail = (reason) => this.setState({message: reason})
+    this.props.client.changePassword(current, pass, done, fail)
+  }
+
+  render(_, { current, pass, again, message }) {
+    const field = (name, value, placeholder, autoComplete) =>
+      Div({class: "Field"},
+        Input({type: "password", name: name, value: value, placeholder: placeholder,
+          autoComplete: autoComplete, onChange: this.handleChange}))
+
+    return (
+      e(WorkArea, {},
+        H1({}, "Change Password"),
+        Div({class: "PasswordForm"},
+          field("current", current, "Current password", "current-password"),
+          field("pass", pass, "New password", "new-password"),
+          field("again", again, "New password again", "new-password"),
+          Button({onClick: this.handleSubmit,
+            disabled: !(current && pass && again)}, "Change password"),
+          P({}, message)))
+    )
+  }
+}
+
 // This nonsense is so we can load SVG direct and style it
 // via an external style sheet. Eh. Wanted to see if it worked.
 const loadSvg = (file, callback) => {
@@ -455,6 +777,7 @@ class Icon extends component {
     const icons = {
       "app-store": "static/icon/appstore.svg",
       "launch-pad": "static/icon/launchpad.svg",
+      "password": "static/icon/password.svg",
       "sign-out": "static/icon/sign-out.svg"
     }
 
@@ -513,6 +836,7 @@ class MainPhase extends component {
     this.menus = [
       {name: "Home", event: "launch-pad"},
       {name: "App Store", event: "app-store"},
+      {name: "Password", event: "password"},
       {name: "Sign out", event: "sign-out"}
     ]
 
@@ -530,11 +854,13 @@ class MainPhase extends component {
     this.setState({mode: event})
   }
 
-  render({onCommand, onLaunch, apps} , {mode}) {
+  render({onCommand, onLaunch, client, apps} , {mode}) {
 
     let view = mode === "launch-pad" ?
-      e(LaunchPad, {apps: apps.applications, onLaunch: onLaunch}) :
-      e(Appstore, {apps: apps.app_store, onClick: onCommand})
+      e(LaunchPad, {apps: apps.applications, maintenance: apps.maintenance, onLaunch: onLaunch}) :
+      mode === "password" ?
+        e(ChangePassword, {client: client}) :
+        e(Appstore, {apps: apps.app_store, onClick: onCommand})
 
     return (
       Section({class: "ApplicationShell"},
@@ -560,7 +886,8 @@ class App extends component {
       loggedIn: LOADING,
       apps: {
         applications: [],
-        app_store: []
+        app_store: [],
+        maintenance: []
       },
     }
 
@@ -574,6 +901,11 @@ class App extends component {
     this.onLaunch = this.onLaunch.bind(this)
     this.onCommand = this.onCommand.bind(this)
     this.doFetch = this.doFetch.bind(this)
+
+    this.client.onToken = (token) => {
+      localStorage.setItem("authToken", token)
+      this.client.setAuthToken(token)
+    }
   }
 
   onLogout() {
@@ -584,15 +916,23 @@ class App extends component {
   }
 
   onLogin(token) {
+    // Signing in on the way somewhere else (such as back to a forward
+    // auth host)?
+    let next = nextPath()
+    if (next) {
+      window.location.href = next
+      return
+    }
+
     console.log("Hello '" + renderUser(token) + "'.")
     this.setState({loggedIn: LOGGED_IN})
     localStorage.setItem("authToken", token)
     this.client.setAuthToken(token)
     this.client.startNotifier({
       "refresh" : () => this.doFetch(),
+      "maintenance" : () => this.doFetch(),
       "ping": () => { /* do nothing */ }
     })
-    document.cookie = "authToken=" + token + "; max-age=259200; path=/;"
     this.doFetch()
   }
 
@@ -634,16 +974,21 @@ class App extends component {
 
     let woot = (res) => this.onLogin(res.token)
     let fail = () => this.setState({loggedIn: LOGGED_OUT})
+    let refresh = () => this.client.refresh(woot, fail)
 
     if (token) {
-      this.client.validate(token, woot, fail)
+      this.client.validate(token, woot, refresh)
       return
     }
-    fail()
+    refresh()
   }
 
   render(_, { loggedIn, apps }) {
 
+    if (resetToken()) {
+      return (e(ResetPhase, {client: this.client}))
+    }
+
     switch (loggedIn) {
 
     case LOADING:
@@ -654,7 +999,7 @@ class App extends component {
 
     case LOGGED_IN:
       return (e(MainPhase, {onLogout: this.onLogout, onCommand: this.onCommand,
-        onLaunch: this.onLaunch, apps: apps}))
+        onLaunch: this.onLaunch, client: this.client, apps: apps}))
 
     default:
       return (e(LoadingPhase))
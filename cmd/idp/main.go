@@ -0,0 +1,270 @@
+//
+// Copyright (C) 2017 Keith Irwin
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU General Public License as published
+// by the Free Software Foundation, either version 3 of the License,
+// or (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU General Public License for more details.
+//
+// You should have received a copy of the GNU General Public License
+// along with this program.  If not, see <http://www.gnu.org/licenses/>.
+
+package main
+
+import (
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"html/template"
+	"log"
+	"math/big"
+	"net/http"
+	"net/url"
+	"strings"
+	"sync"
+	"time"
+
+	jwt "github.com/dgrijalva/jwt-go"
+)
+
+//-----------------------------------------------------------------------------
+// A stand-in OpenID Connect provider for trying out (and testing) the
+// proxy's single sign on. It signs in anyone as whatever email they
+// type, so never use it for anything else.
+//-----------------------------------------------------------------------------
+
+const keyID = "stub-1"
+
+type grant struct {
+	email       string
+	nonce       string
+	challenge   string
+	redirectURI string
+	expires     time.Time
+}
+
+// Provider is the stub identity provider.
+type Provider struct {
+	issuer   string
+	clientID string
+	groups   []string
+	key      *rsa.PrivateKey
+	mutex    sync.Mutex
+	codes    map[string]*grant
+}
+
+var loginPage = template.Must(template.New("login").Parse(`<!doctype html>
+<html>
+  <head><title>Stub identity provider</title></head>
+  <body>
+    <h1>Stub identity provider</h1>
+    <form method="POST" action="/authorize">
+      {{range $k, $v := .Query}}<input type="hidden" name="{{$k}}" value="{{index $v 0}}">
+      {{end}}<input type="email" name="email" value="test@example.com" autofocus>
+      <button type="submit">Sign in</button>
+    </form>
+  </body>
+</html>
+`))
+
+func randomString() string {
+	raw := make([]byte, 24)
+	if _, err := rand.Read(raw); err != nil {
+		log.Fatalf("Unable to read random bytes: %v", err)
+	}
+	return base64.RawURLEncoding.EncodeToString(raw)
+}
+
+func writeJSON(w http.ResponseWriter, status int, data interface{}) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	json.NewEncoder(w).Encode(data)
+}
+
+func tokenError(w http.ResponseWriter, code, description string) {
+	log.Printf("token: %v (%v)", code, description)
+	writeJSON(w, http.StatusBadRequest, map[string]string{"error": code, "error_description": description})
+}
+
+func (p *Provider) discovery(w http.ResponseWriter, r *http.Request) {
+	writeJSON(w, http.StatusOK, map[string]interface{}{
+		"issuer":                                p.issuer,
+		"authorization_endpoint":                p.issuer + "/authorize",
+		"token_endpoint":                        p.issuer + "/token",
+		"jwks_uri":                              p.issuer + "/jwks",
+		"response_types_supported":              []string{"code"},
+		"subject_types_supported":               []string{"public"},
+		"id_token_signing_alg_values_supported": []string{"RS256"},
+		"code_challenge_methods_supported":      []string{"S256"},
+	})
+}
+
+func (p *Provider) jwks(w http.ResponseWriter, r *http.Request) {
+	pub := p.key.PublicKey
+	writeJSON(w, http.StatusOK, map[string]interface{}{
+		"keys": []map[string]string{{
+			"kty": "RSA",
+			"use": "sig",
+			"alg": "RS256",
+			"kid": keyID,
+			"n":   base64.RawURLEncoding.EncodeToString(pub.N.Bytes()),
+			"e":   base64.RawURLEncoding.EncodeToString(big.NewInt(int64(pub.E)).Bytes()),
+		}},
+	})
+}
+
+// authorize shows a sign in form (GET), then sends the browser back to
+// the client with a code (POST).
+func (p *Provider) authorize(w http.ResponseWriter, r *http.Request) {
+	if err := r.ParseForm(); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	q := r.Form
+	if q.Get("client_id") != p.clientID || q.Get("response_type") != "code" || q.Get("redirect_uri") == "" {
+		http.Error(w, "Unknown client or bad request.", http.StatusBadRequest)
+		return
+	}
+	if q.Get("code_challenge") == "" || q.Get("code_challenge_method") != "S256" {
+		http.Error(w, "PKCE (S256) is required.", http.StatusBadRequest)
+		return
+	}
+
+	if r.Method == "GET" {
+		loginPage.Execute(w, map[string]url.Values{"Query": r.URL.Query()})
+		return
+	}
+
+	email := strings.TrimSpace(q.Get("email"))
+	code := randomString()
+
+	p.mutex.Lock()
+	p.codes[code] = &grant{
+		email:       email,
+		nonce:       q.Get("nonce"),
+		challenge:   q.Get("code_challenge"),
+		redirectURI: q.Get("redirect_uri"),
+		expires:     time.Now().Add(time.Minute),
+	}
+	p.mutex.Unlock()
+
+	log.Printf("authorize: %v", email)
+
+	back := url.Values{"code": {code}, "state": {q.Get("state")}}
+	http.Redirect(w, r, q.Get("redirect_uri")+"?"+back.Encode(), http.StatusFound)
+}
+
+// token redeems a code (once) for an ID token.
+func (p *Provider) token(w http.ResponseWriter, r *http.Request) {
+	if r.Method != "POST" {
+		http.Error(w, "POST only.", http.StatusMethodNotAllowed)
+		return
+	}
+	if err := r.ParseForm(); err != nil {
+		tokenError(w, "invalid_request", err.Error())
+		return
+	}
+
+	clientID := r.PostForm.Get("client_id")
+	if id, _, ok := r.BasicAuth(); ok {
+		clientID, _ = url.QueryUnescape(id)
+	}
+
+	p.mutex.Lock()
+	g, ok := p.codes[r.PostForm.Get("code")]
+	delete(p.codes, r.PostForm.Get("code"))
+	p.mutex.Unlock()
+
+	sum := sha256.Sum256([]byte(r.PostForm.Get("code_verifier")))
+	switch {
+	case r.PostForm.Get("grant_type") != "authorization_code":
+		tokenError(w, "unsupported_grant_type", "")
+		return
+	case clientID != p.clientID:
+		tokenError(w, "invalid_client", clientID)
+		return
+	case !ok || time.Now().After(g.expires):
+		tokenError(w, "invalid_grant", "unknown or expired code")
+		return
+	case g.redirectURI != r.PostForm.Get("redirect_uri"):
+		tokenError(w, "invalid_grant", "redirect_uri mismatch")
+		return
+	case base64.RawURLEncoding.EncodeToString(sum[:]) != g.challenge:
+		tokenError(w, "invalid_grant", "PKCE verifier mismatch")
+		return
+	}
+
+	now := time.Now()
+	subject := sha256.Sum256([]byte(strings.ToLower(g.email)))
+	claims := jwt.MapClaims{
+		"iss":            p.issuer,
+		"sub":            fmt.Sprintf("%x", subject[:8]),
+		"aud":            p.clientID,
+		"iat":            now.Unix(),
+		"exp":            now.Add(5 * time.Minute).Unix(),
+		"nonce":          g.nonce,
+		"email":          g.email,
+		"email_verified": true,
+		"groups":         p.groups,
+	}
+
+	token := jwt.NewWithClaims(jwt.SigningMethodRS256, claims)
+	token.Header["kid"] = keyID
+	idToken, err := token.SignedString(p.key)
+	if err != nil {
+		tokenError(w, "server_error", err.Error())
+		return
+	}
+
+	log.Printf("token: issued for %v", g.email)
+	writeJSON(w, http.StatusOK, map[string]interface{}{
+		"access_token": randomString(),
+		"token_type":   "Bearer",
+		"expires_in":   300,
+		"id_token":     idToken,
+	})
+}
+
+func main() {
+
+	port := flag.String("port", "10002", "Port")
+	clientID := flag.String("client-id", "launchpad", "The one client this provider knows.")
+	groups := flag.String("groups", "staff", "Comma separated groups claim for everyone who signs in.")
+
+	flag.Parse()
+
+	key, err := rsa.GenerateKey(rand.Reader, 2048)
+	if err != nil {
+		log.Fatalf("Unable to generate key: %v", err)
+	}
+
+	p := &Provider{
+		issuer:   "http://localhost:" + *port,
+		clientID: *clientID,
+		groups:   strings.Split(*groups, ","),
+		key:      key,
+		codes:    make(map[string]*grant),
+	}
+
+	log.Printf("Stub OpenID Connect provider\n")
+	log.Printf(" issuer: %v\n", p.issuer)
+	log.Printf(" client: %v\n", p.clientID)
+
+	mux := http.NewServeMux()
+	mux.HandleFunc("/.well-known/openid-configuration", p.discovery)
+	mux.HandleFunc("/jwks", p.jwks)
+	mux.HandleFunc("/authorize", p.authorize)
+	mux.HandleFunc("/token", p.token)
+
+	log.Fatal(http.ListenAndServe("127.0.0.1:"+*port, mux))
+}
@@ -0,0 +1,399 @@
+//
+// Copyright (C) 2017 Keith Irwin
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU General Public License as published
+// by the Free Software Foundation, either version 3 of the License,
+// or (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU General Public License for more details.
+//
+// You should have received a copy of the GNU General Public License
+// along with this program.  If not, see <http://www.gnu.org/licenses/>.
+
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"errors"
+	"flag"
+	"io"
+	"log"
+	"math/big"
+	"net"
+	"strings"
+	"time"
+)
+
+//-----------------------------------------------------------------------------
+// A stand-in LDAP directory for trying out (and testing) the proxy's
+// directory logins: simple bind, search with &, |, !, equality and
+// presence filters, and StartTLS with a throwaway certificate. Just
+// enough protocol for that, and no more.
+//-----------------------------------------------------------------------------
+
+// Entry is a directory entry.
+type Entry struct {
+	DN       string
+	Password string
+	Attrs    map[string][]string
+}
+
+var directory = []*Entry{
+	{DN: "cn=reader,dc=example,dc=com", Password: "reader",
+		Attrs: map[string][]string{"objectClass": {"applicationProcess"}, "cn": {"reader"}}},
+	{DN: "uid=alice,ou=people,dc=example,dc=com", Password: "alice1234",
+		Attrs: map[string][]string{"objectClass": {"person", "inetOrgPerson"}, "uid": {"alice"}, "mail": {"alice@example.com"}, "cn": {"Alice"}}},
+	{DN: "uid=bob,ou=people,dc=example,dc=com", Password: "bob12345",
+		Attrs: map[string][]string{"objectClass": {"person", "inetOrgPerson"}, "uid": {"bob"}, "mail": {"bob@example.com"}, "cn": {"Bob"}}},
+	{DN: "cn=admins,ou=groups,dc=example,dc=com",
+		Attrs: map[string][]string{"objectClass": {"groupOfNames"}, "cn": {"admins"}, "member": {"uid=alice,ou=people,dc=example,dc=com"}}},
+	{DN: "cn=staff,ou=groups,dc=example,dc=com",
+		Attrs: map[string][]string{"objectClass": {"groupOfNames"}, "cn": {"staff"},
+			"member": {"uid=alice,ou=people,dc=example,dc=com", "uid=bob,ou=people,dc=example,dc=com"}}},
+}
+
+const startTLSOID = "1.3.6.1.4.1.1466.20037"
+
+const (
+	resultSuccess            = 0
+	resultProtocolError      = 2
+	resultInvalidCredentials = 49
+)
+
+func main() {
+
+	port := flag.String("port", "10389", "Port")
+
+	flag.Parse()
+
+	config, err := selfSignedTLS()
+	if err != nil {
+		log.Fatalf("Unable to make a certificate: %v", err)
+	}
+
+	listener, err := net.Listen("tcp", "127.0.0.1:"+*port)
+	if err != nil {
+		log.Fatal(err)
+	}
+
+	log.Printf("Stub LDAP directory\n")
+	log.Printf(" port: %v\n", *port)
+	for _, e := range directory {
+		log.Printf(" %v\n", e.DN)
+	}
+
+	for {
+		conn, err := listener.Accept()
+		if err != nil {
+			log.Fatal(err)
+		}
+		go serve(conn, config)
+	}
+}
+
+func serve(conn net.Conn, config *tls.Config) {
+	defer conn.Close()
+
+	reader := bufio.NewReader(conn)
+	bound := ""
+
+	for {
+		msg, err := readBER(reader)
+		if err != nil {
+			if err != io.EOF {
+				log.Printf("read: %v", err)
+			}
+			return
+		}
+		if len(msg.children) < 2 {
+			return
+		}
+
+		id := msg.children[0].int()
+		op := msg.children[1]
+		reply := func(op *ber) { conn.Write(sequence(integer(id), op).encode()) }
+
+		switch op.tag {
+		case 0x60: // bind
+			dn, password := string(op.children[1].value), string(op.children[2].value)
+			code := resultInvalidCredentials
+			if dn == "" && password == "" {
+				code = resultSuccess
+			} else if e := find(dn); e != nil && e.Password != "" && password == e.Password {
+				code = resultSuccess
+			}
+			if code == resultSuccess {
+				bound = dn
+			}
+			log.Printf("bind %q: %v", dn, code)
+			reply(result(0x61, code, ""))
+
+		case 0x42: // unbind
+			return
+
+		case 0x63: // search
+			base := string(op.children[0].value)
+			filter := op.children[6]
+			var wanted []string
+			for _, a := range op.children[7].children {
+				wanted = append(wanted, strings.ToLower(string(a.value)))
+			}
+
+			count := 0
+			for _, e := range directory {
+				if !under(e.DN, base) || !matches(filter, e) {
+					continue
+				}
+				count++
+				reply(entry(e, wanted))
+			}
+			log.Printf("search %q as %q: %v entries", base, bound, count)
+			reply(result(0x65, resultSuccess, ""))
+
+		case 0x77: // extended
+			if string(op.children[0].value) != startTLSOID {
+				reply(result(0x78, resultProtocolError, "unsupported extended operation"))
+				continue
+			}
+			reply(result(0x78, resultSuccess, ""))
+			secure := tls.Server(conn, config)
+			if err := secure.Handshake(); err != nil {
+				log.Printf("StartTLS: %v", err)
+				return
+			}
+			log.Printf("StartTLS: ok")
+			conn = secure
+			reader = bufio.NewReader(secure)
+
+		default:
+			reply(result(0x61, resultProtocolError, "unsupported operation"))
+		}
+	}
+}
+
+func find(dn string) *Entry {
+	for _, e := range directory {
+		if strings.EqualFold(e.DN, dn) {
+			return e
+		}
+	}
+	return nil
+}
+
+func under(dn, base string) bool {
+	dn, base = strings.ToLower(dn), strings.ToLower(base)
+	return base == "" || dn == base || strings.HasSuffix(dn, ","+base)
+}
+
+func values(e *Entry, attr string) []string {
+	for name, vs := range e.Attrs {
+		if strings.EqualFold(name, attr) {
+			return vs
+		}
+	}
+	return nil
+}
+
+func matches(f *ber, e *Entry) bool {
+	switch f.tag {
+	case 0xa0: // and
+		for _, c := range f.children {
+			if !matches(c, e) {
+				return false
+			}
+		}
+		return true
+	case 0xa1: // or
+		for _, c := range f.children {
+			if matches(c, e) {
+				return true
+			}
+		}
+		return false
+	case 0xa2: // not
+		return !matches(f.children[0], e)
+	case 0xa3: // equality
+		want := string(f.children[1].value)
+		for _, v := range values(e, string(f.children[0].value)) {
+			if strings.EqualFold(v, want) {
+				return true
+			}
+		}
+		return false
+	case 0x87: // present
+		return len(values(e, string(f.value))) > 0
+	}
+	return false
+}
+
+func entry(e *Entry, wanted []string) *ber {
+	var attrs []*ber
+	for name, vs := range e.Attrs {
+		if len(wanted) > 0 && !contains(wanted, strings.ToLower(name)) {
+			continue
+		}
+		var set []*ber
+		for _, v := range vs {
+			set = append(set, str(v))
+		}
+		attrs = append(attrs, sequence(str(name), constructed(0x31, set...)))
+	}
+	return constructed(0x64, str(e.DN), sequence(attrs...))
+}
+
+func contains(list []string, s string) bool {
+	for _, item := range list {
+		if item == s {
+			return true
+		}
+	}
+	return false
+}
+
+func result(tag byte, code int, message string) *ber {
+	return constructed(tag, primitive(0x0a, []byte{byte(code)}), str(""), str(message))
+}
+
+func selfSignedTLS() (*tls.Config, error) {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		return nil, err
+	}
+
+	template := &x509.Certificate{
+		SerialNumber: big.NewInt(1),
+		Subject:      pkix.Name{CommonName: "localhost"},
+		DNSNames:     []string{"localhost"},
+		IPAddresses:  []net.IP{net.ParseIP("127.0.0.1")},
+		NotBefore:    time.Now().Add(-time.Hour),
+		NotAfter:     time.Now().Add(24 * time.Hour),
+		KeyUsage:     x509.KeyUsageDigitalSignature,
+		ExtKeyUsage:  []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth},
+	}
+
+	der, err := x509.CreateCertificate(rand.Reader, template, template, &key.PublicKey, key)
+	if err != nil {
+		return nil, err
+	}
+
+	cert := tls.Certificate{Certificate: [][]byte{der}, PrivateKey: key}
+	return &tls.Config{Certificates: []tls.Certificate{cert}}, nil
+}
+
+//-----------------------------------------------------------------------------
+// BER
+//-----------------------------------------------------------------------------
+
+type ber struct {
+	tag      byte
+	value    []byte
+	children []*ber
+}
+
+func primitive(tag byte, value []byte) *ber {
+	return &ber{tag: tag, value: value}
+}
+
+func constructed(tag byte, children ...*ber) *ber {
+	return &ber{tag: tag | 0x20, children: children}
+}
+
+func sequence(children ...*ber) *ber {
+	return constructed(0x30, children...)
+}
+
+func str(s string) *ber {
+	return primitive(0x04, []byte(s))
+}
+
+func integer(n int64) *ber {
+	b := []byte{byte(n)}
+	for (n > 0x7f || n < -0x80) && len(b) < 8 {
+		n >>= 8
+		b = append([]byte{byte(n)}, b...)
+	}
+	return primitive(0x02, b)
+}
+
+func (e *ber) int() int64 {
+	var n int64
+	for _, b := range e.value {
+		n = n<<8 | int64(b)
+	}
+	return n
+}
+
+func (e *ber) encode() []byte {
+	contents := e.value
+	if e.tag&0x20 != 0 {
+		contents = nil
+		for _, child := range e.children {
+			contents = append(contents, child.encode()...)
+		}
+	}
+
+	out := []byte{e.tag}
+	if n := len(contents); n < 0x80 {
+		out = append(out, byte(n))
+	} else {
+		var length []byte
+		for ; n > 0; n >>= 8 {
+			length = append([]byte{byte(n)}, length...)
+		}
+		out = append(out, 0x80|byte(len(length)))
+		out = append(out, length...)
+	}
+	return append(out, contents...)
+}
+
+func readBER(r io.Reader) (*ber, error) {
+	header := make([]byte, 2)
+	if _, err := io.ReadFull(r, header); err != nil {
+		return nil, err
+	}
+
+	length := int(header[1])
+	if length&0x80 != 0 {
+		size := length & 0x7f
+		if size == 0 || size > 3 {
+			return nil, errors.New("unsupported BER length")
+		}
+		buf := make([]byte, size)
+		if _, err := io.ReadFull(r, buf); err != nil {
+			return nil, err
+		}
+		length = 0
+		for _, b := range buf {
+			length = length<<8 | int(b)
+		}
+	}
+
+	contents := make([]byte, length)
+	if _, err := io.ReadFull(r, contents); err != nil {
+		return nil, err
+	}
+
+	e := &ber{tag: header[0], value: contents}
+	if e.tag&0x20 != 0 {
+		r := bytes.NewReader(contents)
+		for r.Len() > 0 {
+			child, err := readBER(r)
+			if err != nil {
+				return nil, err
+			}
+			e.children = append(e.children, child)
+		}
+	}
+	return e, nil
+}
@@ -0,0 +1,195 @@
+//
+// Copyright (C) 2017 Keith Irwin
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU General Public License as published
+// by the Free Software Foundation, either version 3 of the License,
+// or (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU General Public License for more details.
+//
+// You should have received a copy of the GNU General Public License
+// along with this program.  If not, see <http://www.gnu.org/licenses/>.
+
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/base64"
+	"flag"
+	"fmt"
+	"io/ioutil"
+	"log"
+	"net"
+	"path/filepath"
+	"strings"
+	"time"
+)
+
+//-----------------------------------------------------------------------------
+// A stand-in SMTP relay for trying out (and testing) password reset
+// mail. It takes any message, prints it, and with -dir saves it as a
+// .eml file. It offers AUTH PLAIN (checking -user and -password if
+// given), but not STARTTLS.
+//-----------------------------------------------------------------------------
+
+type session struct {
+	from string
+	to   []string
+}
+
+func main() {
+
+	port := flag.String("port", "10025", "Port")
+	dir := flag.String("dir", "", "Directory to save messages in (default just print them).")
+	user := flag.String("user", "", "Username AUTH must present (default accept anyone).")
+	password := flag.String("password", "", "Password AUTH must present.")
+
+	flag.Parse()
+
+	listener, err := net.Listen("tcp", "127.0.0.1:"+*port)
+	if err != nil {
+		log.Fatal(err)
+	}
+
+	log.Printf("Stub SMTP relay\n")
+	log.Printf(" port: %v\n", *port)
+	if *dir != "" {
+		log.Printf(" dir:  %v\n", *dir)
+	}
+
+	for {
+		conn, err := listener.Accept()
+		if err != nil {
+			log.Fatal(err)
+		}
+		go serve(conn, *dir, *user, *password)
+	}
+}
+
+func serve(conn net.Conn, dir, user, password string) {
+	defer conn.Close()
+
+	reader := bufio.NewReader(conn)
+	reply := func(format string, args ...interface{}) {
+		fmt.Fprintf(conn, format+"\r\n", args...)
+	}
+
+	reply("220 localhost stub SMTP relay")
+	s := &session{}
+
+	for {
+		line, err := reader.ReadString('\n')
+		if err != nil {
+			return
+		}
+		line = strings.TrimRight(line, "\r\n")
+		verb := strings.ToUpper(strings.SplitN(line, " ", 2)[0])
+
+		switch verb {
+		case "HELO":
+			reply("250 localhost")
+		case "EHLO":
+			reply("250-localhost")
+			reply("250-8BITMIME")
+			reply("250 AUTH PLAIN")
+		case "AUTH":
+			if !checkAuth(line, user, password) {
+				reply("535 authentication failed")
+				continue
+			}
+			reply("235 authenticated")
+		case "MAIL":
+			s = &session{from: address(line)}
+			reply("250 ok")
+		case "RCPT":
+			s.to = append(s.to, address(line))
+			reply("250 ok")
+		case "DATA":
+			if s.from == "" || len(s.to) == 0 {
+				reply("503 need MAIL and RCPT first")
+				continue
+			}
+			reply("354 end with <CRLF>.<CRLF>")
+			data, err := readData(reader)
+			if err != nil {
+				return
+			}
+			deliver(s, data, dir)
+			reply("250 ok, queued")
+			s = &session{}
+		case "RSET":
+			s = &session{}
+			reply("250 ok")
+		case "NOOP":
+			reply("250 ok")
+		case "QUIT":
+			reply("221 bye")
+			return
+		default:
+			reply("502 command not implemented")
+		}
+	}
+}
+
+// checkAuth handles "AUTH PLAIN <base64>", the only kind offered.
+func checkAuth(line, user, password string) bool {
+	fields := strings.Fields(line)
+	if len(fields) != 3 || strings.ToUpper(fields[1]) != "PLAIN" {
+		return false
+	}
+	raw, err := base64.StdEncoding.DecodeString(fields[2])
+	if err != nil {
+		return false
+	}
+	parts := strings.Split(string(raw), "\x00")
+	if len(parts) != 3 {
+		return false
+	}
+	log.Printf("- AUTH as '%v'", parts[1])
+	return user == "" || (parts[1] == user && parts[2] == password)
+}
+
+// address pulls the <address> out of MAIL FROM:<..> or RCPT TO:<..>.
+func address(line string) string {
+	start, end := strings.Index(line, "<"), strings.LastIndex(line, ">")
+	if start == -1 || end < start {
+		return ""
+	}
+	return line[start+1 : end]
+}
+
+func readData(reader *bufio.Reader) ([]byte, error) {
+	var buf bytes.Buffer
+	for {
+		line, err := reader.ReadString('\n')
+		if err != nil {
+			return nil, err
+		}
+		if line == ".\r\n" || line == ".\n" {
+			return buf.Bytes(), nil
+		}
+		// Undo dot stuffing.
+		if strings.HasPrefix(line, "..") {
+			line = line[1:]
+		}
+		buf.WriteString(line)
+	}
+}
+
+func deliver(s *session, data []byte, dir string) {
+	log.Printf("- message from '%v' to %v\n%s", s.from, s.to, data)
+	if dir == "" {
+		return
+	}
+	name := filepath.Join(dir, fmt.Sprintf("%v.eml", time.Now().UnixNano()))
+	if err := ioutil.WriteFile(name, data, 0644); err != nil {
+		log.Printf("ERROR: %v", err)
+		return
+	}
+	log.Printf("- saved as '%v'", name)
+}
@@ -0,0 +1,337 @@
+//
+// Copyright (C) 2017 Keith Irwin
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU General Public License as published
+// by the Free Software Foundation, either version 3 of the License,
+// or (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU General Public License for more details.
+//
+// You should have received a copy of the GNU General Public License
+// along with this program.  If not, see <http://www.gnu.org/licenses/>.
+
+package internal
+
+import (
+	"bufio"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"net"
+	"net/http"
+	"os"
+	"regexp"
+	"sync"
+	"time"
+)
+
+//-----------------------------------------------------------------------------
+// One access record is written per request, either as a JSON line or
+// in Combined Log Format, to stdout or a rotating file.
+//-----------------------------------------------------------------------------
+
+const (
+	// AccessLogJSON writes one JSON object per line.
+	AccessLogJSON = "json"
+	// AccessLogCombined writes Apache/nginx Combined Log Format.
+	AccessLogCombined = "combined"
+)
+
+type accessRecord struct {
+	Time            time.Time `json:"time"`
+	RequestID       string    `json:"request_id"`
+	TraceID         string    `json:"trace_id,omitempty"`
+	RemoteAddr      string    `json:"remote_addr"`
+	Method          string    `json:"method"`
+	Path            string    `json:"path"`
+	Proto           string    `json:"proto"`
+	User            string    `json:"user,omitempty"`
+	Route           string    `json:"route"`
+	Upstream        string    `json:"upstream,omitempty"`
+	Status          int       `json:"status"`
+	Bytes           int64     `json:"bytes"`
+	Latency         float64   `json:"latency_ms"`
+	UpstreamLatency float64   `json:"upstream_latency_ms,omitempty"`
+	Referer         string    `json:"referer,omitempty"`
+	UserAgent       string    `json:"user_agent,omitempty"`
+	upstreamName    string
+}
+
+type accessKey struct{}
+
+func newAccessRecord(r *http.Request, client net.IP) *accessRecord {
+	return &accessRecord{
+		Time:       time.Now(),
+		RequestID:  requestID(r),
+		RemoteAddr: client.String(),
+		Method:     r.Method,
+		Path:       r.URL.RequestURI(),
+		Proto:      r.Proto,
+		Route:      getPathContext(r),
+		Referer:    r.Referer(),
+		UserAgent:  r.UserAgent(),
+	}
+}
+
+func withAccessRecord(r *http.Request, rec *accessRecord) *http.Request {
+	return r.WithContext(context.WithValue(r.Context(), accessKey{}, rec))
+}
+
+// accessRecordFrom returns the request's access record so handlers can
+// fill in what they learn (the user, the upstream). Never nil.
+func accessRecordFrom(ctx context.Context) *accessRecord {
+	if rec, ok := ctx.Value(accessKey{}).(*accessRecord); ok {
+		return rec
+	}
+	return &accessRecord{}
+}
+
+// finish fills in what's known only once the response is written.
+func (rec *accessRecord) finish() {
+	rec.Latency = millis(time.Since(rec.Time))
+	if rec.Status == 0 {
+		rec.Status = http.StatusOK
+	}
+}
+
+func (rec *accessRecord) combined() string {
+	user := rec.User
+	if user == "" {
+		user = "-"
+	}
+	return fmt.Sprintf("%s - %s [%s] \"%s %s %s\" %d %d %q %q\n",
+		rec.RemoteAddr, user, rec.Time.Format("02/Jan/2006:15:04:05 -0700"),
+		rec.Method, rec.Path, rec.Proto, rec.Status, rec.Bytes,
+		rec.Referer, rec.UserAgent)
+}
+
+//-----------------------------------------------------------------------------
+
+// recordingWriter captures the status and size of a response.
+type recordingWriter struct {
+	http.ResponseWriter
+	rec *accessRecord
+}
+
+func (w *recordingWriter) WriteHeader(status int) {
+	if w.rec.Status == 0 {
+		w.rec.Status = status
+	}
+	w.ResponseWriter.WriteHeader(status)
+}
+
+func (w *recordingWriter) Write(b []byte) (int, error) {
+	if w.rec.Status == 0 {
+		w.rec.Status = http.StatusOK
+	}
+	n, err := w.ResponseWriter.Write(b)
+	w.rec.Bytes += int64(n)
+	return n, err
+}
+
+func (w *recordingWriter) Flush() {
+	if f, ok := w.ResponseWriter.(http.Flusher); ok {
+		f.Flush()
+	}
+}
+
+// Hijack is required for websocket upgrades.
+func (w *recordingWriter) Hijack() (net.Conn, *bufio.ReadWriter, error) {
+	h, ok := w.ResponseWriter.(http.Hijacker)
+	if !ok {
+		return nil, nil, errors.New("hijack not supported")
+	}
+	w.rec.Status = http.StatusSwitchingProtocols
+	return h.Hijack()
+}
+
+// timedTransport records how long the upstream took to respond, and
+// traces the round trip.
+type timedTransport struct {
+	http.RoundTripper
+}
+
+func (t timedTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	ctx, span := startSpan(req.Context(), "upstream "+req.URL.Host, spanKindClient)
+	if span != nil {
+		req = req.Clone(ctx)
+		span.inject(req.Header)
+		span.set("http.url", req.URL.String())
+	}
+	defer span.finish()
+
+	start := time.Now()
+	res, err := t.RoundTripper.RoundTrip(req)
+	accessRecordFrom(req.Context()).UpstreamLatency = millis(time.Since(start))
+
+	if err != nil {
+		span.fail(err.Error())
+	} else {
+		span.set("http.status_code", res.StatusCode)
+	}
+	return res, err
+}
+
+func millis(d time.Duration) float64 {
+	return float64(d) / float64(time.Millisecond)
+}
+
+//-----------------------------------------------------------------------------
+
+// AccessLog writes access records.
+type AccessLog struct {
+	format string
+	out    io.Writer
+	file   *rotatingFile
+	mutex  sync.Mutex
+}
+
+// NewAccessLog returns an access log in the given format. If path is
+// empty, records go to stdout, otherwise to a file rotated when it
+// exceeds maxSize bytes or maxAge (zero disables either).
+func NewAccessLog(format, path string, maxSize int64, maxAge time.Duration) (*AccessLog, error) {
+	if format != AccessLogJSON && format != AccessLogCombined {
+		return nil, fmt.Errorf("unknown access log format '%v'", format)
+	}
+
+	accessLog := &AccessLog{format: format, out: os.Stdout}
+	if path != "" {
+		file, err := openRotatingFile(path, maxSize, maxAge)
+		if err != nil {
+			return nil, err
+		}
+		accessLog.file = file
+		accessLog.out = file
+	}
+	return accessLog, nil
+}
+
+// Start the access log.
+func (a *AccessLog) Start() {
+	log.Printf("Starting access log (%v).", a.format)
+}
+
+// Stop the access log, closing its file if any.
+func (a *AccessLog) Stop() {
+	log.Println("Stopping access log.")
+	a.mutex.Lock()
+	defer a.mutex.Unlock()
+	if a.file != nil {
+		a.file.Close()
+	}
+}
+
+func (a *AccessLog) write(rec *accessRecord) {
+	if a == nil {
+		return
+	}
+
+	var line []byte
+	switch a.format {
+	case AccessLogCombined:
+		line = []byte(rec.combined())
+	default:
+		data, err := json.Marshal(rec)
+		if err != nil {
+			log.Printf("ERROR: access log: %v", err)
+			return
+		}
+		line = append(data, '\n')
+	}
+
+	a.mutex.Lock()
+	defer a.mutex.Unlock()
+	if _, err := a.out.Write(line); err != nil {
+		log.Printf("ERROR: access log: %v", err)
+	}
+}
+
+//-----------------------------------------------------------------------------
+
+// rotatingFile is a log file that is renamed aside (with a timestamp
+// suffix) and reopened when it gets too big or too old.
+type rotatingFile struct {
+	path    string
+	maxSize int64
+	maxAge  time.Duration
+	file    *os.File
+	size    int64
+	opened  time.Time
+}
+
+func openRotatingFile(path string, maxSize int64, maxAge time.Duration) (*rotatingFile, error) {
+	f := &rotatingFile{path: path, maxSize: maxSize, maxAge: maxAge}
+	if err := f.open(); err != nil {
+		return nil, err
+	}
+	return f, nil
+}
+
+func (f *rotatingFile) open() error {
+	file, err := os.OpenFile(f.path, os.O_WRONLY|os.O_CREATE|os.O_APPEND, 0640)
+	if err != nil {
+		return err
+	}
+	info, err := file.Stat()
+	if err != nil {
+		file.Close()
+		return err
+	}
+	f.file = file
+	f.size = info.Size()
+	f.opened = time.Now()
+	return nil
+}
+
+func (f *rotatingFile) rotate() error {
+	f.file.Close()
+	aside := f.path + "." + time.Now().Format("20060102-150405")
+	if err := os.Rename(f.path, aside); err != nil {
+		log.Printf("WARNING: unable to rotate '%v': %v", f.path, err)
+	}
+	return f.open()
+}
+
+func (f *rotatingFile) Write(b []byte) (int, error) {
+	tooBig := f.maxSize > 0 && f.size+int64(len(b)) > f.maxSize && f.size > 0
+	tooOld := f.maxAge > 0 && time.Since(f.opened) > f.maxAge
+	if tooBig || tooOld {
+		if err := f.rotate(); err != nil {
+			return 0, err
+		}
+	}
+	n, err := f.file.Write(b)
+	f.size += int64(n)
+	return n, err
+}
+
+func (f *rotatingFile) Close() error {
+	return f.file.Close()
+}
+
+//-----------------------------------------------------------------------------
+
+var requestIDPattern = regexp.MustCompile(`^[A-Za-z0-9._:-]{1,128}$`)
+
+// assignRequestID tags the request (and response) with an ID so that
+// proxy, backend and error reports can be correlated. An incoming ID
+// is kept only if it comes from a trusted proxy.
+func (proxy ProxyServer) assignRequestID(w http.ResponseWriter, r *http.Request) {
+	id := r.Header.Get("X-Request-ID")
+	if id == "" || !proxy.isTrustedPeer(r) || !requestIDPattern.MatchString(id) {
+		id = mkUUID()
+	}
+	r.Header.Set("X-Request-ID", id)
+	w.Header().Set("X-Request-ID", id)
+}
+
+func requestID(r *http.Request) string {
+	return r.Header.Get("X-Request-ID")
+}
@@ -0,0 +1,290 @@
+//
+// Copyright (C) 2017 Keith Irwin
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU General Public License as published
+// by the Free Software Foundation, either version 3 of the License,
+// or (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU General Public License for more details.
+//
+// You should have received a copy of the GNU General Public License
+// along with this program.  If not, see <http://www.gnu.org/licenses/>.
+
+package internal
+
+import (
+	"encoding/json"
+	"fmt"
+	"log"
+	"net/http"
+	"strings"
+)
+
+//-----------------------------------------------------------------------------
+// Administrative endpoints for adjusting the proxy at runtime.
+//
+//   GET /admin/routes                   -- list routes and upstreams
+//   PUT /admin/routes/:context/weights  -- {"stable": 95, "canary": 5}
+//   PUT /admin/routes/:context/cors     -- CORSPolicy, or null to remove
+//   PUT /admin/routes/:context/public   -- {"public": true} or {"paths": ["/hooks"]}
+//   PUT /admin/routes/:context/csrf     -- {"exempt": true}
+//   PUT /admin/routes/:context/pinning  -- {"allow": true}
+//   GET /admin/ip-policies              -- list IP allow/deny lists
+//   PUT /admin/ip-policies[/:context]   -- {"allow": [..], "deny": [..]}
+//   GET /admin/policy                   -- the access control policy
+//   PUT /admin/policy                   -- replace it
+//   /admin/users/...                    -- user accounts (see useradmin.go)
+//   GET /admin/lockouts                 -- login failures and lockouts
+//   DELETE /admin/lockouts/:key         -- unlock "account:<email>" or "ip:<addr>"
+//   GET /admin/audit[/verify]           -- audit entries (see audit.go)
+//   GET /admin/sessions[?user=:id]      -- list sessions
+//   DELETE /admin/sessions?user=:id     -- end all of a user's sessions
+//   DELETE /admin/sessions/:id          -- end a session
+//   GET /admin/maintenance              -- list maintenance windows
+//   PUT /admin/maintenance/:context     -- {"message": "..", "start": .., "end": ..}
+//   DELETE /admin/maintenance/:context  -- end maintenance now
+//-----------------------------------------------------------------------------
+
+func (proxy ProxyServer) handleAdmin(w http.ResponseWriter, r *http.Request) {
+
+	token, err := proxy.checkAuth(w, r)
+	if err != nil {
+		proxy.writeError(w, r, http.StatusUnauthorized, err.Error())
+		return
+	}
+
+	if !proxy.permit(w, r, token, policyRoute, "admin") {
+		return
+	}
+
+	path := strings.Split(strings.Trim(removePathContext(r), "/"), "/")
+
+	proxy.setAuth(w, token)
+
+	switch path[0] {
+	case "routes":
+		proxy.handleAdminRoutes(w, r, path[1:])
+	case "maintenance":
+		proxy.handleAdminMaintenance(w, r, path[1:])
+	case "ip-policies":
+		proxy.handleAdminIPPolicies(w, r, path[1:])
+	case "policy":
+		proxy.handleAdminPolicy(w, r, token, path[1:])
+	case "sessions":
+		proxy.handleAdminSessions(w, r, path[1:])
+	case "users":
+		proxy.handleAdminUsers(w, r, path[1:])
+	case "lockouts":
+		proxy.handleAdminLockouts(w, r, path[1:])
+	case "audit":
+		proxy.handleAdminAudit(w, r, path[1:])
+	default:
+		proxy.writeError(w, r, http.StatusNotFound, "Unknown admin resource.")
+	}
+}
+
+func (proxy ProxyServer) handleAdminRoutes(w http.ResponseWriter, r *http.Request, path []string) {
+
+	switch {
+
+	case len(path) == 0 && (r.Method == "GET" || r.Method == "HEAD"):
+		writeJSON(w, http.StatusOK, proxy.Routes.list())
+
+	case len(path) == 2 && path[1] == "weights" && r.Method == "PUT":
+		var weights map[string]int
+		if err := json.NewDecoder(r.Body).Decode(&weights); err != nil {
+			proxy.writeError(w, r, http.StatusBadRequest, "Can't deserialize weights.")
+			return
+		}
+
+		if err := proxy.Routes.SetWeights(path[0], weights); err != nil {
+			proxy.writeError(w, r, http.StatusBadRequest, err.Error())
+			return
+		}
+
+		log.Printf("- route '%v' weights set to %v", path[0], weights)
+		proxy.audit(r, "route.weights", path[0], "success", fmt.Sprintf("%v", weights))
+		writeJSON(w, http.StatusOK, proxy.Routes.find(path[0]))
+
+	case len(path) == 2 && path[1] == "cors" && r.Method == "PUT":
+		var policy *CORSPolicy
+		if err := json.NewDecoder(r.Body).Decode(&policy); err != nil {
+			proxy.writeError(w, r, http.StatusBadRequest, "Can't deserialize CORS policy.")
+			return
+		}
+
+		if err := proxy.Routes.SetCORS(path[0], policy); err != nil {
+			proxy.writeError(w, r, http.StatusBadRequest, err.Error())
+			return
+		}
+
+		log.Printf("- route '%v' CORS policy set to %+v", path[0], policy)
+		proxy.audit(r, "route.cors", path[0], "success", "")
+		writeJSON(w, http.StatusOK, proxy.Routes.find(path[0]))
+
+	case len(path) == 2 && path[1] == "public" && r.Method == "PUT":
+		var public struct {
+			Public bool     `json:"public"`
+			Paths  []string `json:"paths"`
+		}
+		if err := json.NewDecoder(r.Body).Decode(&public); err != nil {
+			proxy.writeError(w, r, http.StatusBadRequest, "Can't deserialize public settings.")
+			return
+		}
+
+		if err := proxy.Routes.SetPublic(path[0], public.Public, public.Paths); err != nil {
+			proxy.writeError(w, r, http.StatusBadRequest, err.Error())
+			return
+		}
+
+		log.Printf("- route '%v' public: %v, paths %v", path[0], public.Public, public.Paths)
+		proxy.audit(r, "route.public", path[0], "success", "")
+		writeJSON(w, http.StatusOK, proxy.Routes.find(path[0]))
+
+	case len(path) == 2 && path[1] == "csrf" && r.Method == "PUT":
+		var csrf struct {
+			Exempt bool `json:"exempt"`
+		}
+		if err := json.NewDecoder(r.Body).Decode(&csrf); err != nil {
+			proxy.writeError(w, r, http.StatusBadRequest, "Can't deserialize CSRF settings.")
+			return
+		}
+
+		if err := proxy.Routes.SetCSRFExempt(path[0], csrf.Exempt); err != nil {
+			proxy.writeError(w, r, http.StatusBadRequest, err.Error())
+			return
+		}
+
+		log.Printf("- route '%v' CSRF exempt: %v", path[0], csrf.Exempt)
+		proxy.audit(r, "route.csrf", path[0], "success", "")
+		writeJSON(w, http.StatusOK, proxy.Routes.find(path[0]))
+
+	case len(path) == 2 && path[1] == "pinning" && r.Method == "PUT":
+		var pinning struct {
+			Allow bool `json:"allow"`
+		}
+		if err := json.NewDecoder(r.Body).Decode(&pinning); err != nil {
+			proxy.writeError(w, r, http.StatusBadRequest, "Can't deserialize pinning settings.")
+			return
+		}
+
+		if err := proxy.AllowPinning(path[0], pinning.Allow); err != nil {
+			proxy.writeError(w, r, http.StatusBadRequest, err.Error())
+			return
+		}
+
+		log.Printf("- route '%v' upstream pinning allowed: %v", path[0], pinning.Allow)
+		proxy.audit(r, "route.pinning", path[0], "success", fmt.Sprintf("allow %v", pinning.Allow))
+		writeJSON(w, http.StatusOK, proxy.Routes.find(path[0]))
+
+	default:
+		proxy.writeError(w, r, http.StatusNotFound, "Unknown route resource.")
+	}
+}
+
+func (proxy ProxyServer) handleAdminMaintenance(w http.ResponseWriter, r *http.Request, path []string) {
+
+	switch {
+
+	case len(path) == 0 && (r.Method == "GET" || r.Method == "HEAD"):
+		writeJSON(w, http.StatusOK, proxy.maintenance.list())
+
+	case len(path) == 1 && r.Method == "PUT":
+		var window maintenanceWindow
+		if err := json.NewDecoder(r.Body).Decode(&window); err != nil {
+			proxy.writeError(w, r, http.StatusBadRequest, "Can't deserialize maintenance window.")
+			return
+		}
+
+		if window.Start != nil && window.End != nil && !window.End.After(*window.Start) {
+			proxy.writeError(w, r, http.StatusBadRequest, "Maintenance must end after it starts.")
+			return
+		}
+
+		window.Context = path[0]
+		proxy.maintenance.set(&window)
+
+		log.Printf("- maintenance scheduled for '%v'", window.Context)
+		proxy.audit(r, "maintenance.set", window.Context, "success", window.Message)
+		writeJSON(w, http.StatusOK, window)
+
+	case len(path) == 1 && r.Method == "DELETE":
+		if !proxy.maintenance.clear(path[0]) {
+			proxy.writeError(w, r, http.StatusNotFound, "No maintenance scheduled for context.")
+			return
+		}
+
+		log.Printf("- maintenance cleared for '%v'", path[0])
+		proxy.audit(r, "maintenance.clear", path[0], "success", "")
+		w.WriteHeader(http.StatusNoContent)
+
+	default:
+		proxy.writeError(w, r, http.StatusNotFound, "Unknown maintenance resource.")
+	}
+}
+
+func (proxy ProxyServer) handleAdminIPPolicies(w http.ResponseWriter, r *http.Request, path []string) {
+
+	switch {
+
+	case len(path) == 0 && (r.Method == "GET" || r.Method == "HEAD"):
+		writeJSON(w, http.StatusOK, proxy.ipRules.list())
+
+	case len(path) <= 1 && r.Method == "PUT":
+		var policy ipPolicy
+		if err := json.NewDecoder(r.Body).Decode(&policy); err != nil {
+			proxy.writeError(w, r, http.StatusBadRequest, "Can't deserialize IP policy.")
+			return
+		}
+
+		context := ""
+		if len(path) == 1 {
+			context = path[0]
+		}
+
+		if err := proxy.SetIPPolicy(context, policy.Allow, policy.Deny); err != nil {
+			proxy.writeError(w, r, http.StatusBadRequest, err.Error())
+			return
+		}
+
+		log.Printf("- ip policy for '%v' set to allow %v, deny %v", context, policy.Allow, policy.Deny)
+		proxy.audit(r, "ip-policy.update", context, "success", fmt.Sprintf("allow %v, deny %v", policy.Allow, policy.Deny))
+		writeJSON(w, http.StatusOK, proxy.ipRules.list())
+
+	default:
+		proxy.writeError(w, r, http.StatusNotFound, "Unknown IP policy resource.")
+	}
+}
+
+func (proxy ProxyServer) handleAdminPolicy(w http.ResponseWriter, r *http.Request, token string, path []string) {
+
+	switch {
+
+	case len(path) == 0 && (r.Method == "GET" || r.Method == "HEAD"):
+		writeJSON(w, http.StatusOK, proxy.policy.get())
+
+	case len(path) == 0 && r.Method == "PUT":
+		var policy Policy
+		if err := json.NewDecoder(r.Body).Decode(&policy); err != nil {
+			proxy.writeError(w, r, http.StatusBadRequest, "Can't deserialize policy.")
+			return
+		}
+
+		if !policy.withDefaults().allows(policyRoute, "admin", proxy.viewerRoles(token)) {
+			proxy.writeError(w, r, http.StatusBadRequest, "That policy would lock you out of the admin endpoints.")
+			return
+		}
+
+		proxy.SetPolicy(policy)
+		log.Printf("- access control policy replaced")
+		proxy.audit(r, "policy.update", "", "success", "")
+		writeJSON(w, http.StatusOK, proxy.policy.get())
+
+	default:
+		proxy.writeError(w, r, http.StatusNotFound, "Unknown policy resource.")
+	}
+}
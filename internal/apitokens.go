@@ -0,0 +1,468 @@
+//
+// Copyright (C) 2017 Keith Irwin
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU General Public License as published
+// by the Free Software Foundation, either version 3 of the License,
+// or (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU General Public License for more details.
+//
+// You should have received a copy of the GNU General Public License
+// along with this program.  If not, see <http://www.gnu.org/licenses/>.
+
+package internal
+
+import (
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+
+	jwt "github.com/dgrijalva/jwt-go"
+)
+
+//-----------------------------------------------------------------------------
+// Personal access tokens, for scripts and CI jobs. A user mints one
+// with a name and scopes, sees it once, and presents it as a Bearer
+// token. Only a hash is stored. Each request with one gets a short
+// lived access token for the user (marked with the token's ID) so
+// roles and policy apply as usual; scopes narrow that further:
+//
+//   query          -- GET /query
+//   route:<ctx>    -- a backend route or installed app context
+//   route:*        -- every backend route and installed app
+//
+// Nothing else (admin, commands, sessions, tokens) is reachable with a
+// personal access token.
+//-----------------------------------------------------------------------------
+
+const apiTokenPrefix = "lpt_"
+const apiTokenTTL = time.Minute
+const apiTokenUseInterval = time.Minute
+
+const scopeQuery = "query"
+const scopeRoute = "route:"
+
+// APIToken is a personal access token, as stored with its user.
+type APIToken struct {
+	ID       string     `json:"id"`
+	Name     string     `json:"name"`
+	Hash     string     `json:"hash"`
+	Prefix   string     `json:"prefix"`
+	Scopes   []string   `json:"scopes"`
+	Created  time.Time  `json:"created"`
+	Expires  *time.Time `json:"expires,omitempty"`
+	LastUsed *time.Time `json:"last_used,omitempty"`
+	LastIP   string     `json:"last_ip,omitempty"`
+}
+
+type apiTokenView struct {
+	ID       string     `json:"id"`
+	Name     string     `json:"name"`
+	Prefix   string     `json:"prefix"`
+	Scopes   []string   `json:"scopes"`
+	Created  time.Time  `json:"created"`
+	Expires  *time.Time `json:"expires,omitempty"`
+	LastUsed *time.Time `json:"last_used,omitempty"`
+	LastIP   string     `json:"last_ip,omitempty"`
+	Token    string     `json:"token,omitempty"`
+}
+
+func viewOfToken(t *APIToken) *apiTokenView {
+	return &apiTokenView{t.ID, t.Name, t.Prefix, t.Scopes, t.Created, t.Expires, t.LastUsed, t.LastIP, ""}
+}
+
+type apiTokenRequest struct {
+	Name      string   `json:"name"`
+	Scopes    []string `json:"scopes"`
+	ExpiresIn int      `json:"expires_in,omitempty"` // seconds; 0 for no expiry
+}
+
+func hashAPIToken(raw string) string {
+	sum := sha256.Sum256([]byte(raw))
+	return hex.EncodeToString(sum[:])
+}
+
+func checkScopes(scopes []string) error {
+	if len(scopes) == 0 {
+		return errors.New("a token needs at least one scope")
+	}
+	for _, scope := range scopes {
+		if scope == scopeQuery {
+			continue
+		}
+		context := strings.TrimPrefix(scope, scopeRoute)
+		if context == scope || context == "" || strings.Contains(context, "/") {
+			return fmt.Errorf("unknown scope '%v'", scope)
+		}
+		if _, own := endpointMethods[context]; own {
+			return fmt.Errorf("scope '%v' isn't allowed", scope)
+		}
+	}
+	return nil
+}
+
+// scopeAllows decides whether a token's scopes cover the request.
+func scopeAllows(scopes []string, r *http.Request) bool {
+	context := getPathContext(r)
+	has := func(scope string) bool {
+		for _, s := range scopes {
+			if s == scope {
+				return true
+			}
+		}
+		return false
+	}
+
+	if context == "query" {
+		return (r.Method == "GET" || r.Method == "HEAD") && has(scopeQuery)
+	}
+	if _, own := endpointMethods[context]; own {
+		return false
+	}
+	return has(scopeRoute+"*") || has(scopeRoute+context)
+}
+
+//-----------------------------------------------------------------------------
+
+// isAPIToken reports whether an Authorization header (or its value)
+// holds an access token rather than a JWT.
+func isAPIToken(auth string) bool {
+	return strings.HasPrefix(strings.Replace(auth, "Bearer ", "", 1), apiTokenPrefix)
+}
+
+// CreateAPIToken mints a token for a user, returning it and the raw
+// token, which isn't kept anywhere.
+func (db *Database) CreateAPIToken(idOrEmail, name string, scopes []string, expires *time.Time) (*APIToken, string, error) {
+	name = strings.TrimSpace(name)
+	if name == "" {
+		return nil, "", errors.New("a token needs a name")
+	}
+	if err := checkScopes(scopes); err != nil {
+		return nil, "", err
+	}
+
+	raw := make([]byte, 32)
+	if _, err := rand.Read(raw); err != nil {
+		return nil, "", err
+	}
+	secret := base64.RawURLEncoding.EncodeToString(raw)
+
+	token := &APIToken{
+		ID:      mkUUID(),
+		Name:    name,
+		Hash:    hashAPIToken(apiTokenPrefix + secret),
+		Prefix:  apiTokenPrefix + secret[:6],
+		Scopes:  scopes,
+		Created: time.Now().UTC(),
+		Expires: expires,
+	}
+
+	_, err := db.UpdateUser(idOrEmail, func(u *User) error {
+		for _, t := range u.APITokens {
+			if t.Name == name {
+				return fmt.Errorf("there's already a token named '%v'", name)
+			}
+		}
+		u.APITokens = append(u.APITokens, token)
+		return nil
+	})
+	if err != nil {
+		return nil, "", err
+	}
+
+	db.apiTokens.reset()
+	return token, apiTokenPrefix + secret, nil
+}
+
+// RevokeAPIToken deletes one of a user's tokens.
+func (db *Database) RevokeAPIToken(idOrEmail, tokenID string) (*APIToken, error) {
+	var revoked *APIToken
+	_, err := db.UpdateUser(idOrEmail, func(u *User) error {
+		for i, t := range u.APITokens {
+			if t.ID == tokenID {
+				revoked = t
+				u.APITokens = append(u.APITokens[:i], u.APITokens[i+1:]...)
+				return nil
+			}
+		}
+		return errAPITokenNotFound
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	db.apiTokens.reset()
+	return revoked, nil
+}
+
+var errAPITokenNotFound = errors.New("no such token")
+
+//-----------------------------------------------------------------------------
+
+type apiTokenOwner struct {
+	userID  string
+	tokenID string
+}
+
+type mintedToken struct {
+	token   string
+	roles   string
+	expires time.Time
+}
+
+// apiTokenIndex finds tokens by hash, rebuilding its index from the
+// user store after any change.
+type apiTokenIndex struct {
+	mutex  sync.Mutex
+	db     *Database
+	byHash map[string]apiTokenOwner
+	saved  map[string]time.Time
+	minted map[string]*mintedToken
+}
+
+func newAPITokenIndex(db *Database) *apiTokenIndex {
+	return &apiTokenIndex{db: db}
+}
+
+func (index *apiTokenIndex) reset() {
+	index.mutex.Lock()
+	defer index.mutex.Unlock()
+	index.byHash = nil
+	index.minted = nil
+}
+
+func (index *apiTokenIndex) find(hash string) (apiTokenOwner, bool) {
+	index.mutex.Lock()
+	defer index.mutex.Unlock()
+
+	if index.byHash == nil {
+		users, err := index.db.users.List()
+		if err != nil {
+			log.Printf("ERROR: unable to index API tokens: %v", err)
+			return apiTokenOwner{}, false
+		}
+		index.byHash = make(map[string]apiTokenOwner)
+		for _, u := range users {
+			for _, t := range u.APITokens {
+				index.byHash[t.Hash] = apiTokenOwner{u.ID, t.ID}
+			}
+		}
+	}
+
+	owner, ok := index.byHash[hash]
+	return owner, ok
+}
+
+// authenticate checks a personal access token for the request,
+// returning an access token standing in for it.
+func (index *apiTokenIndex) authenticate(r *http.Request, raw string, keys *KeyRing) (string, *User, error) {
+	owner, ok := index.find(hashAPIToken(raw))
+	if !ok {
+		return "", nil, errors.New(badAuthMsg)
+	}
+
+	user, err := index.db.findUserByID(owner.userID)
+	if err != nil {
+		return "", nil, errors.New(badAuthMsg)
+	}
+
+	var token *APIToken
+	for _, t := range user.APITokens {
+		if t.ID == owner.tokenID {
+			token = t
+		}
+	}
+	if token == nil {
+		return "", nil, errors.New(badAuthMsg)
+	}
+
+	now := time.Now()
+	if token.Expires != nil && now.After(*token.Expires) {
+		return "", nil, errors.New("API token expired")
+	}
+
+	if !scopeAllows(token.Scopes, r) {
+		return "", nil, errors.New("API token not valid for this resource")
+	}
+
+	index.noteUse(user, token, accessRecordFrom(r.Context()).RemoteAddr)
+
+	minted, err := index.mint(user, token, keys)
+	if err != nil {
+		return "", nil, err
+	}
+	return minted, user, nil
+}
+
+// noteUse records when (and where from) a token was last used, but
+// not on every request.
+func (index *apiTokenIndex) noteUse(user *User, token *APIToken, ip string) {
+	index.mutex.Lock()
+	if index.saved == nil {
+		index.saved = make(map[string]time.Time)
+	}
+	now := time.Now()
+	if now.Sub(index.saved[token.ID]) < apiTokenUseInterval {
+		index.mutex.Unlock()
+		return
+	}
+	index.saved[token.ID] = now
+	index.mutex.Unlock()
+
+	_, err := index.db.UpdateUser(user.ID, func(u *User) error {
+		for _, t := range u.APITokens {
+			if t.ID == token.ID {
+				used := now.UTC()
+				t.LastUsed = &used
+				t.LastIP = ip
+			}
+		}
+		return nil
+	})
+	if err != nil {
+		log.Printf("WARNING: unable to record API token use: %v", err)
+	}
+}
+
+// mint signs (or reuses) a short lived access token for the user on
+// behalf of the personal access token. These aren't sessions: they're
+// never renewed or handed back to the client.
+func (index *apiTokenIndex) mint(user *User, token *APIToken, keys *KeyRing) (string, error) {
+	roles := strings.Join(user.Roles, ",")
+
+	index.mutex.Lock()
+	defer index.mutex.Unlock()
+
+	if index.minted == nil {
+		index.minted = make(map[string]*mintedToken)
+	}
+
+	now := time.Now()
+	if m, ok := index.minted[token.ID]; ok && m.roles == roles && now.Before(m.expires.Add(-apiTokenTTL/2)) {
+		return m.token, nil
+	}
+
+	expires := now.Add(apiTokenTTL)
+	signed, err := keys.sign(Viewer{
+		ID:       user.ID,
+		Email:    user.Email,
+		Roles:    user.Roles,
+		APIToken: token.ID,
+		StandardClaims: jwt.StandardClaims{
+			Issuer:    "vaclav",
+			Id:        "pat-" + mkUUID(),
+			IssuedAt:  now.Unix(),
+			NotBefore: now.Unix(),
+			ExpiresAt: expires.Unix(),
+		},
+	})
+	if err != nil {
+		return "", err
+	}
+
+	index.minted[token.ID] = &mintedToken{signed, roles, expires}
+	return signed, nil
+}
+
+//-----------------------------------------------------------------------------
+// A user's own tokens.
+//
+//   GET    /tokens      -- list my tokens
+//   POST   /tokens      -- {"name": .., "scopes": [..], "expires_in": seconds}
+//   DELETE /tokens/:id  -- revoke one
+//-----------------------------------------------------------------------------
+
+func (proxy ProxyServer) handleTokens(w http.ResponseWriter, r *http.Request) {
+
+	token, err := proxy.checkAuth(w, r)
+	if err != nil {
+		proxy.writeError(w, r, http.StatusUnauthorized, err.Error())
+		return
+	}
+
+	viewer, err := proxy.decodeAuthToken(token)
+	if err != nil {
+		proxy.writeError(w, r, http.StatusUnauthorized, err.Error())
+		return
+	}
+
+	path := strings.Split(strings.Trim(removePathContext(r), "/"), "/")
+	if path[0] == "" {
+		path = path[:0]
+	}
+
+	proxy.setAuth(w, token)
+	proxy.serveAPITokens(w, r, viewer.ID, path)
+}
+
+// serveAPITokens lists, creates and revokes a user's tokens, for the
+// user or an admin.
+func (proxy ProxyServer) serveAPITokens(w http.ResponseWriter, r *http.Request, userID string, path []string) {
+
+	switch {
+
+	case len(path) == 0 && (r.Method == "GET" || r.Method == "HEAD"):
+		user, err := proxy.Database.User(userID)
+		if err != nil {
+			proxy.writeError(w, r, http.StatusNotFound, err.Error())
+			return
+		}
+		views := make([]*apiTokenView, 0, len(user.APITokens))
+		for _, t := range user.APITokens {
+			views = append(views, viewOfToken(t))
+		}
+		writeJSON(w, http.StatusOK, views)
+
+	case len(path) == 0 && r.Method == "POST":
+		var req apiTokenRequest
+		if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+			proxy.writeError(w, r, http.StatusBadRequest, "Can't deserialize token request.")
+			return
+		}
+
+		var expires *time.Time
+		if req.ExpiresIn > 0 {
+			t := time.Now().UTC().Add(time.Duration(req.ExpiresIn) * time.Second)
+			expires = &t
+		}
+
+		token, raw, err := proxy.Database.CreateAPIToken(userID, req.Name, req.Scopes, expires)
+		if err != nil {
+			proxy.audit(r, "token.create", req.Name, "failure", err.Error())
+			proxy.writeError(w, r, http.StatusBadRequest, err.Error())
+			return
+		}
+
+		log.Printf("- token.create: '%v' for user '%v'", token.Name, userID)
+		proxy.audit(r, "token.create", token.ID, "success", strings.Join(token.Scopes, " "))
+		view := viewOfToken(token)
+		view.Token = raw
+		writeJSON(w, http.StatusCreated, view)
+
+	case len(path) == 1 && r.Method == "DELETE":
+		token, err := proxy.Database.RevokeAPIToken(userID, path[0])
+		if err != nil {
+			proxy.writeError(w, r, http.StatusNotFound, err.Error())
+			return
+		}
+		log.Printf("- token.revoke: '%v' for user '%v'", token.Name, userID)
+		proxy.audit(r, "token.revoke", token.ID, "success", "")
+		w.WriteHeader(http.StatusNoContent)
+
+	default:
+		proxy.writeError(w, r, http.StatusNotFound, "Unknown token resource.")
+	}
+}
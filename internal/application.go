@@ -38,6 +38,7 @@ type InstalledApp struct {
 	Author      string `json:"author"`
 	Icon        string `json:"icon"`
 	Context     string `json:"context"`
+	Public      bool   `json:"public,omitempty"`
 }
 
 // Applications represents a collection of installed apps.
@@ -62,6 +63,29 @@ func (a *Applications) appMap() map[string]*InstalledApp {
 	return result
 }
 
+// isPublic returns true if the app installed at context is flagged as
+// public in its metadata, rereading the install directory if the app
+// isn't known yet.
+func (a *Applications) isPublic(context string) bool {
+	find := func() *InstalledApp {
+		for _, app := range a.InstalledApps {
+			if app.Context == context {
+				return app
+			}
+		}
+		return nil
+	}
+
+	app := find()
+	if app == nil {
+		if err := a.reload(); err != nil {
+			return false
+		}
+		app = find()
+	}
+	return app != nil && app.Public
+}
+
 func (a *Applications) reload() error {
 	apps, err := findApps(a.dir)
 	if err != nil {
@@ -21,6 +21,7 @@ import (
 	"io/ioutil"
 	"log"
 	"net/http"
+	"sync"
 	"time"
 )
 
@@ -29,15 +30,21 @@ type AppStore struct {
 	storeURL string
 	clock    *time.Ticker
 	db       *Database
+	metrics  *Metrics
+	fetched  time.Time
+	mutex    sync.Mutex
 }
 
 // NewAppStore is a service to fetch apps from the app store.
-func NewAppStore(storeURL string, db *Database) *AppStore {
-	return &AppStore{
+func NewAppStore(storeURL string, db *Database, metrics *Metrics) *AppStore {
+	store := &AppStore{
 		storeURL: storeURL,
 		clock:    time.NewTicker(17 * time.Second),
 		db:       db,
+		metrics:  metrics,
 	}
+	metrics.gaugeFunc(metricStoreCatalogAge, store.catalogAge)
+	return store
 }
 
 // Start the app store monitor and caching service.
@@ -64,7 +71,31 @@ func (store *AppStore) fetchStoreDataContinuously() {
 	}
 }
 
+// catalogAge is the number of seconds since the catalog was last
+// fetched, or -1 if it never has been.
+func (store *AppStore) catalogAge() float64 {
+	store.mutex.Lock()
+	defer store.mutex.Unlock()
+	if store.fetched.IsZero() {
+		return -1
+	}
+	return time.Since(store.fetched).Seconds()
+}
+
 func (store *AppStore) fetch() error {
+	if err := store.fetchCatalog(); err != nil {
+		store.metrics.inc(metricStoreFetches, "outcome", "failure")
+		return err
+	}
+
+	store.metrics.inc(metricStoreFetches, "outcome", "success")
+	store.mutex.Lock()
+	store.fetched = time.Now()
+	store.mutex.Unlock()
+	return nil
+}
+
+func (store *AppStore) fetchCatalog() error {
 
 	resp, err := http.Get(store.storeURL + "/catalog")
 	if err != nil {
@@ -0,0 +1,563 @@
+//
+// Copyright (C) 2017 Keith Irwin
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU General Public License as published
+// by the Free Software Foundation, either version 3 of the License,
+// or (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU General Public License for more details.
+//
+// You should have received a copy of the GNU General Public License
+// along with this program.  If not, see <http://www.gnu.org/licenses/>.
+
+package internal
+
+import (
+	"bufio"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+//-----------------------------------------------------------------------------
+// An append-only audit trail of security relevant events (logins,
+// logouts, access denials, app installs, route and user changes), one
+// JSON record per line.
+//
+// Each entry carries the hash of the one before, and its own hash
+// covers that, so editing, removing or reordering entries breaks the
+// chain from there on (see verify). The chain picks up where an
+// existing file left off. With a key (SetKey) the hashes are HMACs,
+// so someone who can edit the file can't recompute them.
+//-----------------------------------------------------------------------------
+
+type auditEntry struct {
+	Seq       int64     `json:"seq"`
+	Time      time.Time `json:"time"`
+	RequestID string    `json:"request_id,omitempty"`
+	User      string    `json:"user,omitempty"`
+	Remote    string    `json:"remote_addr,omitempty"`
+	Action    string    `json:"action"`
+	Resource  string    `json:"resource,omitempty"`
+	Outcome   string    `json:"outcome"`
+	Detail    string    `json:"detail,omitempty"`
+	Prev      string    `json:"prev"`
+	Hash      string    `json:"hash"`
+}
+
+// auditRecent is how many entries are kept in memory for queries when
+// there's no file to search.
+const auditRecent = 1000
+
+// auditBacklog is how many entries can wait for a slow syslog before
+// more are dropped (from syslog only; the file still gets them).
+const auditBacklog = 1000
+
+// auditDrain is how long Stop waits for syslog to catch up.
+const auditDrain = 2 * time.Second
+
+// AuditLog writes audit entries to a file (or stdout), and to syslog
+// if asked.
+type AuditLog struct {
+	out    io.Writer
+	file   *os.File
+	path   string
+	syslog chan auditSend
+	done   chan struct{}
+	behind int
+	key    []byte
+	seq    int64
+	last   string
+	recent []*auditEntry
+	mutex  sync.Mutex
+}
+
+// auditSink is somewhere else entries are copied to.
+type auditSink interface {
+	send(entry *auditEntry, line []byte) error
+	Close() error
+}
+
+type auditSend struct {
+	entry *auditEntry
+	line  []byte
+}
+
+// NewAuditLog returns an audit log appending to path, or if path is
+// empty, writing to stdout.
+func NewAuditLog(path string) (*AuditLog, error) {
+	audit := &AuditLog{out: os.Stdout}
+	if path != "" {
+		tail, err := auditTail(path)
+		if err != nil {
+			return nil, err
+		}
+		file, err := os.OpenFile(path, os.O_WRONLY|os.O_CREATE|os.O_APPEND, 0600)
+		if err != nil {
+			return nil, err
+		}
+		audit.file = file
+		audit.out = file
+		audit.path = path
+		audit.seq = tail.Seq
+		audit.last = tail.Hash
+	}
+	return audit, nil
+}
+
+// SetKey keys the hash chain with the secret in a file (or
+// "env:NAME"). An existing file must have been written with the same
+// key.
+func (a *AuditLog) SetKey(source string) error {
+	key, err := readSecret(source)
+	if err != nil {
+		return err
+	}
+	key = []byte(strings.TrimSpace(string(key)))
+	if len(key) == 0 {
+		return fmt.Errorf("audit key '%v' is empty", source)
+	}
+
+	a.mutex.Lock()
+	defer a.mutex.Unlock()
+
+	if a.path != "" {
+		tail, err := auditTail(a.path)
+		if err != nil {
+			return err
+		}
+		if tail.Seq > 0 && auditHash(key, tail) != tail.Hash {
+			return fmt.Errorf("'%v' wasn't written with this key, start a new audit log", a.path)
+		}
+	}
+	a.key = key
+	log.Println("- audit chain keyed (HMAC-SHA256)")
+	return nil
+}
+
+// Record writes an entry for something done outside a request (such
+// as the `proxy user` command).
+func (a *AuditLog) Record(user, action, resource, outcome, detail string) {
+	a.write(&auditEntry{
+		Time:     time.Now().UTC(),
+		User:     user,
+		Action:   action,
+		Resource: resource,
+		Outcome:  outcome,
+		Detail:   detail,
+	})
+}
+
+// SetSyslog copies entries to syslog: "local" for this host's daemon,
+// or udp://host:port or tcp://host:port for a remote one. They're sent
+// in the background, so a slow receiver can't hold up requests.
+func (a *AuditLog) SetSyslog(addr string) error {
+	sink, err := newSyslogSink(addr)
+	if err != nil {
+		return err
+	}
+	if err := a.forwardTo(sink); err != nil {
+		sink.Close()
+		return err
+	}
+	log.Printf("- audit entries also sent to syslog (%v)", addr)
+	return nil
+}
+
+func (a *AuditLog) forwardTo(sink auditSink) error {
+	a.mutex.Lock()
+	defer a.mutex.Unlock()
+	if a.syslog != nil {
+		return errors.New("audit entries already go to syslog")
+	}
+	a.syslog = make(chan auditSend, auditBacklog)
+	a.done = make(chan struct{})
+	go forward(sink, a.syslog, a.done)
+	return nil
+}
+
+// forward sends queued entries to the sink until the queue is closed.
+func forward(sink auditSink, queue chan auditSend, done chan struct{}) {
+	defer close(done)
+	for s := range queue {
+		if err := sink.send(s.entry, s.line); err != nil {
+			log.Printf("ERROR: audit syslog: %v", err)
+		}
+	}
+	sink.Close()
+}
+
+// Start the audit log.
+func (a *AuditLog) Start() {
+	log.Println("Starting audit log.")
+}
+
+// Stop the audit log, closing its file if any, and giving syslog a
+// moment to catch up.
+func (a *AuditLog) Stop() {
+	log.Println("Stopping audit log.")
+	a.mutex.Lock()
+	if a.file != nil {
+		a.file.Close()
+	}
+	done := a.done
+	if a.syslog != nil {
+		close(a.syslog)
+		a.syslog = nil
+	}
+	a.mutex.Unlock()
+
+	if done != nil {
+		select {
+		case <-done:
+		case <-time.After(auditDrain):
+			log.Println("WARNING: gave up waiting for syslog to take the last audit entries")
+		}
+	}
+}
+
+// auditTail finds a file's last entry.
+func auditTail(path string) (*auditEntry, error) {
+	var last auditEntry
+	file, err := os.Open(path)
+	if os.IsNotExist(err) {
+		return &last, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	defer file.Close()
+
+	err = scanAudit(file, func(entry *auditEntry) bool {
+		last = *entry
+		return true
+	})
+	if err != nil {
+		return nil, fmt.Errorf("reading audit log '%v': %v", path, err)
+	}
+	return &last, nil
+}
+
+// scanAudit calls fn with each entry in turn, until it returns false.
+func scanAudit(in io.Reader, fn func(entry *auditEntry) bool) error {
+	scanner := bufio.NewScanner(in)
+	scanner.Buffer(make([]byte, 64*1024), 1024*1024)
+	line := 0
+	for scanner.Scan() {
+		line++
+		if len(scanner.Bytes()) == 0 {
+			continue
+		}
+		var entry auditEntry
+		if err := json.Unmarshal(scanner.Bytes(), &entry); err != nil {
+			return fmt.Errorf("line %v: %v", line, err)
+		}
+		if !fn(&entry) {
+			break
+		}
+	}
+	return scanner.Err()
+}
+
+// auditHash is the hash of an entry (with its hash left out), an HMAC
+// if there's a key.
+func auditHash(key []byte, entry *auditEntry) string {
+	c := *entry
+	c.Hash = ""
+	data, _ := json.Marshal(&c)
+	if len(key) == 0 {
+		sum := sha256.Sum256(data)
+		return hex.EncodeToString(sum[:])
+	}
+	mac := hmac.New(sha256.New, key)
+	mac.Write(data)
+	return hex.EncodeToString(mac.Sum(nil))
+}
+
+func (a *AuditLog) write(entry *auditEntry) {
+	if a == nil {
+		return
+	}
+
+	a.mutex.Lock()
+	defer a.mutex.Unlock()
+
+	a.seq++
+	entry.Seq = a.seq
+	entry.Prev = a.last
+	entry.Hash = auditHash(a.key, entry)
+	a.last = entry.Hash
+
+	data, err := json.Marshal(entry)
+	if err != nil {
+		log.Printf("ERROR: audit log: %v", err)
+		return
+	}
+
+	if _, err := a.out.Write(append(data, '\n')); err != nil {
+		log.Printf("ERROR: audit log: %v", err)
+	}
+
+	if a.syslog != nil {
+		select {
+		case a.syslog <- auditSend{entry, data}:
+			if a.behind > 0 {
+				log.Printf("WARNING: %v audit entries weren't sent to syslog", a.behind)
+				a.behind = 0
+			}
+		default:
+			if a.behind == 0 {
+				log.Println("WARNING: syslog is behind, dropping audit entries (the file still has them)")
+			}
+			a.behind++
+		}
+	}
+
+	if a.file == nil {
+		a.recent = append(a.recent, entry)
+		if len(a.recent) > auditRecent {
+			a.recent = a.recent[len(a.recent)-auditRecent:]
+		}
+	}
+}
+
+// each calls fn with every entry available, oldest first: the whole
+// file, or without one, the recent entries kept in memory.
+func (a *AuditLog) each(fn func(entry *auditEntry) bool) error {
+	if a.path == "" {
+		a.mutex.Lock()
+		recent := append([]*auditEntry(nil), a.recent...)
+		a.mutex.Unlock()
+		for _, entry := range recent {
+			if !fn(entry) {
+				break
+			}
+		}
+		return nil
+	}
+
+	file, err := os.Open(a.path)
+	if err != nil {
+		return err
+	}
+	defer file.Close()
+	return scanAudit(file, fn)
+}
+
+//-----------------------------------------------------------------------------
+
+// auditFilter selects entries for a query. Empty fields match anything;
+// an action ending in "*" matches by prefix ("auth.*").
+type auditFilter struct {
+	User     string
+	Action   string
+	Resource string
+	Outcome  string
+	Remote   string
+	Since    time.Time
+	Until    time.Time
+	Limit    int
+}
+
+func (f *auditFilter) matches(entry *auditEntry) bool {
+	switch {
+	case f.User != "" && !strings.EqualFold(f.User, entry.User):
+		return false
+	case f.Resource != "" && f.Resource != entry.Resource:
+		return false
+	case f.Outcome != "" && f.Outcome != entry.Outcome:
+		return false
+	case f.Remote != "" && f.Remote != entry.Remote:
+		return false
+	case !f.Since.IsZero() && entry.Time.Before(f.Since):
+		return false
+	case !f.Until.IsZero() && !entry.Time.Before(f.Until):
+		return false
+	}
+	if strings.HasSuffix(f.Action, "*") {
+		return strings.HasPrefix(entry.Action, strings.TrimSuffix(f.Action, "*"))
+	}
+	return f.Action == "" || f.Action == entry.Action
+}
+
+// query returns the newest entries matching the filter, newest first.
+func (a *AuditLog) query(f *auditFilter) ([]*auditEntry, error) {
+	found := make([]*auditEntry, 0)
+	err := a.each(func(entry *auditEntry) bool {
+		if f.matches(entry) {
+			found = append(found, entry)
+			if len(found) > f.Limit {
+				found = found[1:]
+			}
+		}
+		return true
+	})
+	for i, j := 0, len(found)-1; i < j; i, j = i+1, j-1 {
+		found[i], found[j] = found[j], found[i]
+	}
+	return found, err
+}
+
+type auditCheck struct {
+	Entries  int64  `json:"entries"`
+	Intact   bool   `json:"intact"`
+	Keyed    bool   `json:"keyed"`
+	Head     string `json:"head,omitempty"`
+	BrokenAt int64  `json:"broken_at,omitempty"`
+	Problem  string `json:"problem,omitempty"`
+}
+
+// verify walks the chain, reporting the first entry that doesn't
+// follow from the one before, and checks the file still ends with the
+// last entry written. The head (the last hash) can be kept elsewhere
+// to check against later.
+func (a *AuditLog) verify() *auditCheck {
+	a.mutex.Lock()
+	key, seq, last := a.key, a.seq, a.last
+	a.mutex.Unlock()
+
+	check := &auditCheck{Intact: true, Keyed: len(key) > 0}
+	var prev *auditEntry
+	reached := false
+	err := a.each(func(entry *auditEntry) bool {
+		problem := ""
+		switch {
+		case entry.Hash == "":
+			problem = "entry not hashed"
+		case auditHash(key, entry) != entry.Hash:
+			problem = "entry altered"
+		case prev == nil && a.path != "" && (entry.Seq != 1 || entry.Prev != ""):
+			problem = "entries missing from the start"
+		case prev != nil && entry.Prev != prev.Hash:
+			problem = "chain broken (entry removed or reordered)"
+		case prev != nil && entry.Seq != prev.Seq+1:
+			problem = fmt.Sprintf("sequence jumps from %v", prev.Seq)
+		}
+		if problem != "" {
+			check.Intact = false
+			check.BrokenAt = entry.Seq
+			check.Problem = problem
+			return false
+		}
+		check.Entries++
+		check.Head = entry.Hash
+		prev = entry
+		if entry.Seq == seq {
+			reached = entry.Hash == last
+		}
+		return true
+	})
+	switch {
+	case err != nil:
+		check.Intact = false
+		check.Problem = err.Error()
+	case check.Intact && a.path != "" && seq > 0 && !reached:
+		check.Intact = false
+		check.BrokenAt = seq
+		check.Problem = "entries missing from the end"
+	}
+	return check
+}
+
+// auditEntry starts an entry for an action taken on behalf of the
+// request's user, for writing once the outcome is known.
+func (proxy ProxyServer) auditEntry(r *http.Request, action, resource string) *auditEntry {
+	return &auditEntry{
+		Time:      time.Now().UTC(),
+		RequestID: requestID(r),
+		User:      accessRecordFrom(r.Context()).User,
+		Remote:    proxy.clientIP(r).String(),
+		Action:    action,
+		Resource:  resource,
+	}
+}
+
+// audit records an action taken on behalf of the request's user.
+func (proxy ProxyServer) audit(r *http.Request, action, resource, outcome, detail string) {
+	entry := proxy.auditEntry(r, action, resource)
+	entry.Outcome = outcome
+	entry.Detail = detail
+	proxy.Audit.write(entry)
+}
+
+//-----------------------------------------------------------------------------
+// Audit queries (under /admin).
+//
+//   GET /admin/audit         -- newest first, filtered by user, action,
+//                               resource, outcome, remote_addr, since,
+//                               until (RFC 3339) and limit (default 100)
+//   GET /admin/audit/verify  -- check the hash chain
+//-----------------------------------------------------------------------------
+
+const maxAuditLimit = 1000
+
+func (proxy ProxyServer) handleAdminAudit(w http.ResponseWriter, r *http.Request, path []string) {
+
+	switch {
+
+	case len(path) == 0 && (r.Method == "GET" || r.Method == "HEAD"):
+		query := r.URL.Query()
+		filter := &auditFilter{
+			User:     query.Get("user"),
+			Action:   query.Get("action"),
+			Resource: query.Get("resource"),
+			Outcome:  query.Get("outcome"),
+			Remote:   query.Get("remote_addr"),
+			Limit:    100,
+		}
+
+		var err error
+		if since := query.Get("since"); since != "" {
+			if filter.Since, err = time.Parse(time.RFC3339, since); err != nil {
+				proxy.writeError(w, r, http.StatusBadRequest, "Can't parse 'since' (want RFC 3339).")
+				return
+			}
+		}
+		if until := query.Get("until"); until != "" {
+			if filter.Until, err = time.Parse(time.RFC3339, until); err != nil {
+				proxy.writeError(w, r, http.StatusBadRequest, "Can't parse 'until' (want RFC 3339).")
+				return
+			}
+		}
+		if limit := query.Get("limit"); limit != "" {
+			n, err := strconv.Atoi(limit)
+			if err != nil || n < 1 || n > maxAuditLimit {
+				proxy.writeError(w, r, http.StatusBadRequest, fmt.Sprintf("Limit must be 1 to %v.", maxAuditLimit))
+				return
+			}
+			filter.Limit = n
+		}
+
+		entries, err := proxy.Audit.query(filter)
+		if err != nil {
+			proxy.writeError(w, r, http.StatusInternalServerError, err.Error())
+			return
+		}
+		writeJSON(w, http.StatusOK, entries)
+
+	case len(path) == 1 && path[0] == "verify" && (r.Method == "GET" || r.Method == "HEAD"):
+		check := proxy.Audit.verify()
+		if !check.Intact {
+			log.Printf("WARNING: audit log chain broken at %v: %v", check.BrokenAt, check.Problem)
+		}
+		writeJSON(w, http.StatusOK, check)
+
+	default:
+		proxy.writeError(w, r, http.StatusNotFound, "Unknown audit resource.")
+	}
+}
@@ -0,0 +1,55 @@
+//
+// Copyright (C) 2017 Keith Irwin
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU General Public License as published
+// by the Free Software Foundation, either version 3 of the License,
+// or (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU General Public License for more details.
+//
+// You should have received a copy of the GNU General Public License
+// along with this program.  If not, see <http://www.gnu.org/licenses/>.
+
+//go:build !windows && !plan9
+
+package internal
+
+import (
+	"fmt"
+	"log/syslog"
+	"net/url"
+)
+
+type syslogSink struct {
+	*syslog.Writer
+}
+
+func newSyslogSink(addr string) (auditSink, error) {
+	var w *syslog.Writer
+	var err error
+	if addr == "local" {
+		w, err = syslog.New(syslog.LOG_AUTH|syslog.LOG_INFO, "launchpad-audit")
+	} else {
+		u, perr := url.Parse(addr)
+		if perr != nil || (u.Scheme != "udp" && u.Scheme != "tcp") || u.Host == "" {
+			return nil, fmt.Errorf("syslog address '%v' isn't 'local', udp://host:port or tcp://host:port", addr)
+		}
+		w, err = syslog.Dial(u.Scheme, u.Host, syslog.LOG_AUTH|syslog.LOG_INFO, "launchpad-audit")
+	}
+	if err != nil {
+		return nil, err
+	}
+	return syslogSink{w}, nil
+}
+
+// Failures and refusals go out as warnings, the rest as info.
+func (sink syslogSink) send(entry *auditEntry, line []byte) error {
+	if entry.Outcome == "success" {
+		return sink.Info(string(line))
+	}
+	return sink.Warning(string(line))
+}
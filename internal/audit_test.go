@@ -0,0 +1,64 @@
+//
+// Copyright (C) 2017 Keith Irwin
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU General Public License as published
+// by the Free Software Foundation, either version 3 of the License,
+// or (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU General Public License for more details.
+//
+// You should have received a copy of the GNU General Public License
+// along with this program.  If not, see <http://www.gnu.org/licenses/>.
+
+package internal
+
+import (
+	"io/ioutil"
+	"testing"
+	"time"
+)
+
+// stuckSink never finishes sending, like a hung TCP syslog receiver.
+type stuckSink struct {
+	release chan struct{}
+}
+
+func (sink stuckSink) send(entry *auditEntry, line []byte) error {
+	<-sink.release
+	return nil
+}
+
+func (sink stuckSink) Close() error {
+	return nil
+}
+
+func TestAuditNotHeldUpBySyslog(t *testing.T) {
+	audit := &AuditLog{out: ioutil.Discard}
+	sink := stuckSink{make(chan struct{})}
+	defer close(sink.release)
+	if err := audit.forwardTo(sink); err != nil {
+		t.Fatal(err)
+	}
+
+	written := make(chan bool)
+	go func() {
+		for i := 0; i < auditBacklog*2; i++ {
+			audit.Record("rae@example.com", "auth.password", "rae@example.com", "success", "")
+		}
+		written <- true
+	}()
+
+	select {
+	case <-written:
+	case <-time.After(5 * time.Second):
+		t.Fatal("audit writes blocked on syslog")
+	}
+
+	if check := audit.verify(); !check.Intact || audit.seq != auditBacklog*2 {
+		t.Errorf("chain after dropping syslog entries: seq %v, %+v", audit.seq, check)
+	}
+}
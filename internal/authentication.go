@@ -17,65 +17,164 @@
 package internal
 
 import (
+	"crypto/rand"
+	"errors"
 	"fmt"
+	"log"
+	"net/http"
+	"time"
 
 	jwt "github.com/dgrijalva/jwt-go"
 )
 
+// signingSecret is the development default; see LoadKeyRing.
 var signingSecret = []byte("should be in config file")
 
 const badAuthMsg = "Authentication token not found."
 const badSignMsg = "Unexpected authentication signing method: `%v`."
 
+// authSettings are how a server's tokens and their cookies are made.
+// They're set up before the server starts.
+type authSettings struct {
+	// Access tokens are short lived, and renewed (see setAuth) while
+	// they're in use. Refresh tokens get a new access token after a
+	// longer absence.
+	accessTTL  time.Duration
+	refreshTTL time.Duration
+
+	// Cookie attributes (see SetCookiePolicy, SetForwardAuth). An empty
+	// domain means this host only.
+	sameSite http.SameSite
+	secure   bool
+	domain   string
+
+	// csrfKey signs CSRF tokens. Tokens don't outlive the process:
+	// after a restart the next authenticated response hands out a new
+	// one, and the Origin check covers the gap.
+	csrfKey []byte
+}
+
+func newAuthSettings() *authSettings {
+	key := make([]byte, 32)
+	if _, err := rand.Read(key); err != nil {
+		log.Fatalf("Unable to make CSRF key: %v", err)
+	}
+	return &authSettings{
+		accessTTL:  15 * time.Minute,
+		refreshTTL: 72 * time.Hour,
+		sameSite:   http.SameSiteLaxMode,
+		csrfKey:    key,
+	}
+}
+
 // Viewer represents the currently authenticated user.
 type Viewer struct {
-	ID    string `json:"uuid"`
-	Email string `json:"email"`
+	ID    string   `json:"uuid"`
+	Email string   `json:"email"`
+	Roles []string `json:"roles,omitempty"`
+	// Session is shared by every token issued from one login.
+	Session string `json:"sid,omitempty"`
+	// APIToken is set instead, for a personal access token's stand-in.
+	APIToken string `json:"pat,omitempty"`
 	jwt.StandardClaims
 }
 
-func makeAuthToken(user *User) (string, error) {
-	claims := Viewer{
-		user.ID,
-		user.Email,
-		jwt.StandardClaims{
-			Issuer: "vaclav",
-		},
+// Valid rejects tokens without an expiry, as well as expired ones.
+func (v Viewer) Valid() error {
+	if v.ExpiresAt == 0 {
+		return errors.New("token has no expiry")
+	}
+	return v.StandardClaims.Valid()
+}
+
+func (proxy ProxyServer) makeAuthToken(user *User, session string) (string, error) {
+	return proxy.signAuthToken(Viewer{
+		ID:      user.ID,
+		Email:   user.Email,
+		Roles:   user.Roles,
+		Session: session,
+	}, "")
+}
+
+// signAuthToken issues a fresh token (new jti, times) for the viewer.
+// One renewing another (given by jti) only joins a session that's
+// still live, rather than starting it again.
+func (proxy ProxyServer) signAuthToken(viewer Viewer, renewing string) (string, error) {
+	now := time.Now()
+	viewer.StandardClaims = jwt.StandardClaims{
+		Issuer:    "vaclav",
+		Id:        mkUUID(),
+		IssuedAt:  now.Unix(),
+		NotBefore: now.Unix(),
+		ExpiresAt: now.Add(proxy.auth.accessTTL).Unix(),
+	}
+
+	token, err := proxy.keys.sign(viewer)
+	if err != nil {
+		return "", err
+	}
+	if renewing == "" {
+		proxy.sessions.register(&viewer)
+	} else if !proxy.sessions.renew(renewing, &viewer) {
+		return "", errSessionRevoked
+	}
+	return token, nil
+}
+
+// renewAuthToken returns a fresh token if the given (valid) token is
+// past half its lifetime, otherwise the same token. A fresh token has
+// the user's current email and roles, and isn't issued to a disabled
+// or deleted user, or for a session that has ended.
+func (proxy ProxyServer) renewAuthToken(token string) (string, error) {
+	viewer, err := proxy.decodeAuthToken(token)
+	if err != nil {
+		return token, nil
+	}
+
+	remaining := time.Until(time.Unix(viewer.ExpiresAt, 0))
+	if remaining > proxy.auth.accessTTL/2 {
+		return token, nil
 	}
 
-	token := jwt.NewWithClaims(jwt.SigningMethodHS256, claims)
-	tokenString, err := token.SignedString(signingSecret)
+	user, err := proxy.Database.findUserByID(viewer.ID)
 	if err != nil {
 		return "", err
 	}
-	return tokenString, nil
+
+	renewed := *viewer
+	renewed.Email = user.Email
+	renewed.Roles = user.Roles
+	return proxy.signAuthToken(renewed, viewer.Id)
 }
 
-func decodeAuthToken(token string) (*Viewer, error) {
-	result, err := jwtdecode(token)
+func (proxy ProxyServer) decodeAuthToken(token string) (*Viewer, error) {
+	result, err := proxy.jwtdecode(token)
+	if result == nil {
+		return nil, err
+	}
 	return result.Claims.(*Viewer), err
 }
 
-func isValidAuthToken(tokenString string) (bool, error) {
-	token, err := jwtdecode(tokenString)
+// tokenSession is the login session a token belongs to, or failing
+// that, the token itself.
+func (proxy ProxyServer) tokenSession(token string) string {
+	if viewer, err := proxy.decodeAuthToken(token); err == nil {
+		return viewer.Session
+	}
+	return token
+}
+
+func (proxy ProxyServer) isValidAuthToken(tokenString string) (bool, error) {
+	token, err := proxy.jwtdecode(tokenString)
 	if err != nil {
 		return false, fmt.Errorf(badAuthMsg)
 	}
 	return token.Valid, nil
 }
 
-func jwtdecode(tokenString string) (*jwt.Token, error) {
+func (proxy ProxyServer) jwtdecode(tokenString string) (*jwt.Token, error) {
 	if tokenString == "" {
 		return nil, fmt.Errorf(badAuthMsg)
 	}
-	return jwt.ParseWithClaims(tokenString, &Viewer{}, checkAlgKey())
-}
-
-func checkAlgKey() jwt.Keyfunc {
-	return func(token *jwt.Token) (interface{}, error) {
-		if _, ok := token.Method.(*jwt.SigningMethodHMAC); !ok {
-			return nil, fmt.Errorf(badSignMsg, token.Header["alg"])
-		}
-		return signingSecret, nil
-	}
+	return jwt.ParseWithClaims(tokenString, &Viewer{}, proxy.keys.keyFunc)
 }
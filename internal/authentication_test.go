@@ -0,0 +1,87 @@
+//
+// Copyright (C) 2017 Keith Irwin
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU General Public License as published
+// by the Free Software Foundation, either version 3 of the License,
+// or (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU General Public License for more details.
+//
+// You should have received a copy of the GNU General Public License
+// along with this program.  If not, see <http://www.gnu.org/licenses/>.
+
+package internal
+
+import (
+	"reflect"
+	"testing"
+	"time"
+)
+
+// renewableLogin logs a user in, then lengthens the access token
+// lifetime so their token is already due for renewal.
+func renewableLogin(t *testing.T, proxy ProxyServer, email string) (string, *User) {
+	t.Helper()
+	user, err := proxy.Database.CreateUser(email, "renew-password-1", []string{"user"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	proxy.auth.accessTTL = time.Minute
+	token, code := testLogin(t, proxy, email, "renew-password-1")
+	if code != 200 {
+		t.Fatalf("login: %v", code)
+	}
+	proxy.auth.accessTTL = time.Hour
+	return token, user
+}
+
+func TestRenewalTakesCurrentRoles(t *testing.T) {
+	proxy := newTestProxy(t)
+	token, user := renewableLogin(t, proxy, "olga@example.com")
+
+	// Set directly, so the session isn't ended as the admin API would.
+	if _, err := proxy.Database.SetRoles(user.ID, []string{"auditor"}); err != nil {
+		t.Fatal(err)
+	}
+
+	renewed, err := proxy.renewAuthToken(token)
+	if err != nil || renewed == token {
+		t.Fatalf("renewal: %v", err)
+	}
+	viewer, err := proxy.decodeAuthToken(renewed)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !reflect.DeepEqual(viewer.Roles, []string{"auditor"}) {
+		t.Errorf("renewed token roles %v, want [auditor]", viewer.Roles)
+	}
+}
+
+func TestRenewalRefused(t *testing.T) {
+	proxy := newTestProxy(t)
+
+	token, user := renewableLogin(t, proxy, "pat@example.com")
+	if _, err := proxy.Database.SetDisabled(user.ID, true); err != nil {
+		t.Fatal(err)
+	}
+	if renewed, err := proxy.renewAuthToken(token); err == nil {
+		t.Errorf("renewed %q for a disabled user", renewed)
+	}
+
+	token, _ = renewableLogin(t, proxy, "quinn@example.com")
+	viewer, err := proxy.decodeAuthToken(token)
+	if err != nil {
+		t.Fatal(err)
+	}
+	proxy.sessions.revoke(viewer.Session)
+	if renewed, err := proxy.renewAuthToken(token); err == nil {
+		t.Errorf("renewed %q for a revoked session", renewed)
+	}
+	if proxy.sessions.find(viewer.Session) != nil {
+		t.Error("renewal brought a revoked session back")
+	}
+}
@@ -20,19 +20,22 @@ import (
 	"fmt"
 	"log"
 	"sync"
+	"time"
 
 	"github.com/gorilla/websocket"
 )
 
 type client struct {
-	token string
-	conn  *websocket.Conn
+	session string
+	conn    *websocket.Conn
 }
 
-func newClient(token string, conn *websocket.Conn) *client {
+// Clients are known by login session rather than token, since tokens
+// are renewed while the socket stays open.
+func newClient(session string, conn *websocket.Conn) *client {
 	return &client{
-		token: token,
-		conn:  conn,
+		session: session,
+		conn:    conn,
 	}
 }
 
@@ -56,10 +59,12 @@ type ClientHub struct {
 }
 
 // NewClientHub returns a new ClientHub container.
-func NewClientHub() *ClientHub {
-	return &ClientHub{
+func NewClientHub(metrics *Metrics) *ClientHub {
+	hub := &ClientHub{
 		mutex: sync.Mutex{},
 	}
+	metrics.gaugeFunc(metricWebsocketClients, hub.count)
+	return hub
 }
 
 // Start the client hub.
@@ -72,9 +77,15 @@ func (hub *ClientHub) Stop() {
 	log.Println("Stopping client hub.")
 }
 
-func (hub *ClientHub) sendAck(token, command string) error {
+func (hub *ClientHub) count() float64 {
+	hub.mutex.Lock()
+	defer hub.mutex.Unlock()
+	return float64(len(hub.clients))
+}
+
+func (hub *ClientHub) sendAck(session, command string) error {
 	for _, c := range hub.clients {
-		if c.token == token {
+		if c.session == session {
 			return c.sendAck(command)
 		}
 	}
@@ -94,15 +105,29 @@ func (hub *ClientHub) delete(c *client) {
 	hub.mutex.Lock()
 	defer hub.mutex.Unlock()
 	clients := make([]*client, 0)
-	for _, c := range hub.clients {
-		if c.conn != c.conn {
-			clients = append(clients, c)
+	for _, other := range hub.clients {
+		if other.conn != c.conn {
+			clients = append(clients, other)
 		}
 	}
 	hub.clients = clients
 	log.Printf("- %v attached client(s)", len(hub.clients))
 }
 
+// closeSession disconnects the sockets opened by a login session.
+func (hub *ClientHub) closeSession(session string) {
+	hub.mutex.Lock()
+	defer hub.mutex.Unlock()
+	for _, c := range hub.clients {
+		if c.session == session {
+			c.conn.WriteControl(websocket.CloseMessage,
+				websocket.FormatCloseMessage(websocket.ClosePolicyViolation, "session ended"),
+				time.Now().Add(time.Second))
+			c.conn.Close()
+		}
+	}
+}
+
 type simpleNotification struct {
 	Type string `json:"type"`
 }
@@ -118,3 +143,19 @@ func (hub *ClientHub) notifyRefresh() {
 		}
 	}
 }
+
+type maintenanceNotification struct {
+	Type    string               `json:"type"`
+	Windows []*maintenanceWindow `json:"windows"`
+}
+
+func (hub *ClientHub) notifyMaintenance(windows []*maintenanceWindow) {
+	hub.mutex.Lock()
+	defer hub.mutex.Unlock()
+	msg := maintenanceNotification{"maintenance", windows}
+	for _, client := range hub.clients {
+		if err := client.send(msg); err != nil {
+			log.Printf("ERROR: Unable to write to socket.")
+		}
+	}
+}
@@ -18,12 +18,14 @@ package internal
 
 import (
 	"archive/zip"
+	"context"
 	"fmt"
 	"io"
 	"log"
 	"net/http"
 	"os"
 	"path/filepath"
+	"sync/atomic"
 )
 
 type commandCode int
@@ -46,6 +48,8 @@ type CommandProcessor struct {
 	database  *Database
 	clienthub *ClientHub
 	queue     chan commandFunc
+	pending   int64
+	metrics   *Metrics
 }
 
 const (
@@ -54,13 +58,18 @@ const (
 )
 
 // NewCommandProcessor returns a processor for running serialized, side-effect commmands
-func NewCommandProcessor(appDir string, database *Database, clients *ClientHub) *CommandProcessor {
-	return &CommandProcessor{
+func NewCommandProcessor(appDir string, database *Database, clients *ClientHub, metrics *Metrics) *CommandProcessor {
+	cp := &CommandProcessor{
 		appDir:    appDir,
 		database:  database,
 		clienthub: clients,
 		queue:     make(chan commandFunc),
+		metrics:   metrics,
 	}
+	metrics.gaugeFunc(metricCommandQueue, func() float64 {
+		return float64(atomic.LoadInt64(&cp.pending))
+	})
+	return cp
 }
 
 // Start the command processor.
@@ -75,7 +84,8 @@ func (cp *CommandProcessor) Stop() {
 	close(cp.queue)
 }
 
-func (cp *CommandProcessor) invoke(clientID, commandTag, xrn string) {
+// invoke queues a command, calling done (if given) with its result.
+func (cp *CommandProcessor) invoke(ctx context.Context, clientID, commandTag, xrn string, done func(commandResult)) {
 	var cmd command
 	switch commandTag {
 	case "install":
@@ -86,9 +96,32 @@ func (cp *CommandProcessor) invoke(clientID, commandTag, xrn string) {
 		cmd = unknownCmd{commandTag}
 	}
 
+	// The job runs after the request is done, so keep only its trace.
+	ctx = detachSpan(ctx)
+
+	atomic.AddInt64(&cp.pending, 1)
 	cp.queue <- func() {
+		atomic.AddInt64(&cp.pending, -1)
+
+		_, span := startSpan(ctx, "command."+commandTag, spanKindInternal)
+		span.set("command.xrn", xrn)
+		defer span.finish()
+
 		result := cmd.invoke(cp)
 		log.Printf("- %#v", result)
+		if result.code != commandOk {
+			span.fail(result.reason)
+		}
+
+		outcome := "ok"
+		if result.code != commandOk {
+			outcome = "error"
+		}
+		cp.metrics.inc(metricCommands, "command", commandTag, "outcome", outcome)
+
+		if done != nil {
+			done(result)
+		}
 	}
 }
 
@@ -0,0 +1,197 @@
+//
+// Copyright (C) 2017 Keith Irwin
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU General Public License as published
+// by the Free Software Foundation, either version 3 of the License,
+// or (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU General Public License for more details.
+//
+// You should have received a copy of the GNU General Public License
+// along with this program.  If not, see <http://www.gnu.org/licenses/>.
+
+package internal
+
+import (
+	"fmt"
+	"log"
+	"net/http"
+	"strconv"
+	"strings"
+)
+
+//-----------------------------------------------------------------------------
+
+// CORSPolicy says which other origins may call a route from a browser.
+// Origins are exact ("https://tools.example.com"), wildcards
+// ("https://*.example.com") or "*" for any. With Credentials, "*" and
+// wildcards broader than a registered domain aren't allowed, since any
+// matching site could then act as the signed-in user.
+type CORSPolicy struct {
+	Origins       []string `json:"origins"`
+	Methods       []string `json:"methods"`
+	Headers       []string `json:"headers"`
+	ExposeHeaders []string `json:"expose_headers"`
+	Credentials   bool     `json:"credentials"`
+	MaxAge        int      `json:"max_age"`
+}
+
+func matchOrigin(pattern, origin string) bool {
+	if pattern == "*" || strings.EqualFold(pattern, origin) {
+		return true
+	}
+
+	star := strings.Index(pattern, "*")
+	if star == -1 {
+		return false
+	}
+
+	prefix := strings.ToLower(pattern[:star])
+	suffix := strings.ToLower(pattern[star+1:])
+	origin = strings.ToLower(origin)
+
+	if len(origin) <= len(prefix)+len(suffix) {
+		return false
+	}
+	if !strings.HasPrefix(origin, prefix) || !strings.HasSuffix(origin, suffix) {
+		return false
+	}
+
+	// The wildcard stands for subdomain labels, never a path or port.
+	middle := origin[len(prefix) : len(origin)-len(suffix)]
+	return !strings.ContainsAny(middle, "/:")
+}
+
+// validate refuses credentialed policies that would trust any site.
+func (policy *CORSPolicy) validate() error {
+	if !policy.Credentials {
+		return nil
+	}
+	for _, pattern := range policy.Origins {
+		star := strings.Index(pattern, "*")
+		if star == -1 {
+			continue
+		}
+		prefix, suffix := pattern[:star], pattern[star+1:]
+		if !strings.HasSuffix(prefix, "://") || !strings.HasPrefix(suffix, ".") ||
+			strings.Count(suffix, ".") < 2 || strings.Contains(suffix, "*") {
+			return fmt.Errorf("origin '%v' is too broad for a policy with credentials", pattern)
+		}
+	}
+	return nil
+}
+
+func (policy *CORSPolicy) allowsOrigin(origin string) bool {
+	for _, pattern := range policy.Origins {
+		if matchOrigin(pattern, origin) {
+			return true
+		}
+	}
+	return false
+}
+
+func (policy *CORSPolicy) allowsMethod(method string) bool {
+	if len(policy.Methods) == 0 {
+		return method == "GET" || method == "HEAD" || method == "POST"
+	}
+	for _, m := range policy.Methods {
+		if strings.EqualFold(m, method) {
+			return true
+		}
+	}
+	return false
+}
+
+func (policy *CORSPolicy) allowsHeaders(requested string) bool {
+	allowed := make(map[string]bool)
+	for _, h := range policy.Headers {
+		allowed[strings.ToLower(h)] = true
+	}
+	for _, h := range strings.Split(requested, ",") {
+		h = strings.ToLower(strings.TrimSpace(h))
+		if h != "" && !allowed[h] && !allowed["*"] {
+			return false
+		}
+	}
+	return true
+}
+
+//-----------------------------------------------------------------------------
+
+// handleCORS applies a route's CORS policy. It answers preflight
+// requests itself (returning true), and adds headers to everything else
+// so that the browser lets the caller read the response, errors
+// included.
+func (proxy ProxyServer) handleCORS(w http.ResponseWriter, r *http.Request) bool {
+	origin := r.Header.Get("Origin")
+	if origin == "" {
+		return false
+	}
+
+	route := proxy.Routes.find(getPathContext(r))
+	if route == nil || route.CORS == nil {
+		return false
+	}
+
+	policy := route.CORS
+	w.Header().Add("Vary", "Origin")
+
+	preflight := r.Method == "OPTIONS" && r.Header.Get("Access-Control-Request-Method") != ""
+
+	if !policy.allowsOrigin(origin) {
+		if preflight {
+			log.Printf("- cors: origin '%v' not allowed for '/%v'", origin, route.Context)
+			proxy.writeError(w, r, http.StatusForbidden, "Origin not allowed.")
+			return true
+		}
+		return false
+	}
+
+	w.Header().Set("Access-Control-Allow-Origin", origin)
+	if policy.Credentials {
+		w.Header().Set("Access-Control-Allow-Credentials", "true")
+	}
+
+	if !preflight {
+		if len(policy.ExposeHeaders) > 0 {
+			w.Header().Set("Access-Control-Expose-Headers", strings.Join(policy.ExposeHeaders, ", "))
+		}
+		return false
+	}
+
+	method := r.Header.Get("Access-Control-Request-Method")
+	headers := r.Header.Get("Access-Control-Request-Headers")
+
+	if !policy.allowsMethod(method) || !policy.allowsHeaders(headers) {
+		log.Printf("- cors: preflight for %v [%v] not allowed for '/%v'", method, headers, route.Context)
+		proxy.writeError(w, r, http.StatusForbidden, "Method or headers not allowed.")
+		return true
+	}
+
+	w.Header().Add("Vary", "Access-Control-Request-Method")
+	w.Header().Add("Vary", "Access-Control-Request-Headers")
+	w.Header().Set("Access-Control-Allow-Methods", method)
+	if headers != "" {
+		w.Header().Set("Access-Control-Allow-Headers", headers)
+	}
+	if policy.MaxAge > 0 {
+		w.Header().Set("Access-Control-Max-Age", strconv.Itoa(policy.MaxAge))
+	}
+
+	w.WriteHeader(http.StatusNoContent)
+	return true
+}
+
+// stripCORS removes a backend's own CORS headers so they don't clash
+// with the ones the proxy sets from the route's policy.
+func stripCORS(h http.Header) {
+	for key := range h {
+		if strings.HasPrefix(key, "Access-Control-") {
+			h.Del(key)
+		}
+	}
+}
@@ -0,0 +1,186 @@
+//
+// Copyright (C) 2017 Keith Irwin
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU General Public License as published
+// by the Free Software Foundation, either version 3 of the License,
+// or (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU General Public License for more details.
+//
+// You should have received a copy of the GNU General Public License
+// along with this program.  If not, see <http://www.gnu.org/licenses/>.
+
+package internal
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/base64"
+	"fmt"
+	"log"
+	"net/http"
+	"net/url"
+	"strings"
+
+	jwt "github.com/dgrijalva/jwt-go"
+)
+
+//-----------------------------------------------------------------------------
+// Cross-site request forgery. Browsers attach the login cookie to any
+// request for our host, including ones a hostile page starts. So an
+// unsafe request (POST, PUT, DELETE, ..) that is only authenticated by
+// cookie must also show it came from us:
+//
+//   - an X-CSRF-Token header matching the csrfToken cookie, which is
+//     tied to the login session (the home app sends this), or
+//   - an Origin (or failing that, Referer) of this host, or one the
+//     route's CORS policy allows with credentials.
+//
+// Requests with an Authorization header are exempt, as a page can't
+// make the browser add one for us. So are routes set CSRF exempt.
+//-----------------------------------------------------------------------------
+
+const csrfCookie = "csrfToken"
+const csrfHeader = "X-CSRF-Token"
+
+// SetCookiePolicy sets the SameSite mode ("lax", "strict" or "none") of
+// the login cookie, and whether cookies are only sent over HTTPS.
+func (proxy ProxyServer) SetCookiePolicy(sameSite string, secure bool) error {
+	switch strings.ToLower(sameSite) {
+	case "lax", "":
+		proxy.auth.sameSite = http.SameSiteLaxMode
+	case "strict":
+		proxy.auth.sameSite = http.SameSiteStrictMode
+	case "none":
+		if !secure {
+			return fmt.Errorf("SameSite=None cookies must be secure")
+		}
+		proxy.auth.sameSite = http.SameSiteNoneMode
+	default:
+		return fmt.Errorf("unknown SameSite mode '%v'", sameSite)
+	}
+	proxy.auth.secure = secure
+	return nil
+}
+
+func (proxy ProxyServer) csrfToken(session string) string {
+	mac := hmac.New(sha256.New, proxy.auth.csrfKey)
+	mac.Write([]byte(session))
+	return base64.RawURLEncoding.EncodeToString(mac.Sum(nil))
+}
+
+// setCSRF hands the page the token for its session. Unlike the login
+// cookie, scripts can read it.
+func (proxy ProxyServer) setCSRF(w http.ResponseWriter, session string) {
+	http.SetCookie(w, &http.Cookie{
+		Path:     "/",
+		Domain:   proxy.auth.domain,
+		Name:     csrfCookie,
+		Value:    proxy.csrfToken(session),
+		MaxAge:   int(proxy.auth.refreshTTL.Seconds()),
+		Secure:   proxy.auth.secure,
+		SameSite: http.SameSiteStrictMode,
+	})
+}
+
+func (proxy ProxyServer) unsetCSRF(w http.ResponseWriter) {
+	http.SetCookie(w, &http.Cookie{Path: "/", Domain: proxy.auth.domain, Name: csrfCookie, Value: "deleted", MaxAge: -1})
+}
+
+// cookieSession finds the login session behind a request's cookies. An
+// expired (but genuine) access token still names it, as does a known
+// refresh token.
+func (proxy ProxyServer) cookieSession(r *http.Request) (string, bool) {
+	found := false
+	if c, err := r.Cookie("authToken"); err == nil {
+		found = true
+		token, err := proxy.jwtdecode(c.Value)
+		if ve, ok := err.(*jwt.ValidationError); err == nil || (ok && ve.Errors == jwt.ValidationErrorExpired) {
+			if session := token.Claims.(*Viewer).Session; session != "" {
+				return session, true
+			}
+		}
+	}
+	if c, err := r.Cookie(refreshCookie); err == nil {
+		return proxy.refresh.familyOf(c.Value), true
+	}
+	return "", found
+}
+
+func isSafeMethod(method string) bool {
+	return method == "GET" || method == "HEAD" || method == "OPTIONS"
+}
+
+// sameOrigin is true if a request's Origin (or Referer) is this proxy,
+// as reached directly, through a trusted proxy, or at its public URL.
+func (proxy ProxyServer) sameOrigin(r *http.Request, origin string) bool {
+	u, err := url.Parse(origin)
+	if err != nil || u.Host == "" {
+		return false
+	}
+
+	hosts := []string{r.Host}
+	if proxy.isTrustedPeer(r) {
+		if host := r.Header.Get("X-Forwarded-Host"); host != "" {
+			hosts = append(hosts, host)
+		}
+	}
+	if public, err := url.Parse(proxy.forwardAuthSettings().PublicURL); err == nil && public.Host != "" {
+		hosts = append(hosts, public.Host)
+	}
+
+	for _, host := range hosts {
+		if strings.EqualFold(u.Host, host) {
+			return true
+		}
+	}
+	return false
+}
+
+// checkCSRF refuses unsafe, cookie authenticated requests that can't
+// show they came from one of our own pages.
+func (proxy ProxyServer) checkCSRF(w http.ResponseWriter, r *http.Request) bool {
+	if isSafeMethod(r.Method) || r.Header.Get("Authorization") != "" {
+		return true
+	}
+
+	session, ok := proxy.cookieSession(r)
+	if !ok {
+		return true
+	}
+
+	route := proxy.Routes.find(getPathContext(r))
+	if route != nil && route.CSRFExempt {
+		return true
+	}
+
+	if token := r.Header.Get(csrfHeader); token != "" && session != "" {
+		if hmac.Equal([]byte(token), []byte(proxy.csrfToken(session))) {
+			return true
+		}
+	}
+
+	origin := r.Header.Get("Origin")
+	if origin == "" || origin == "null" {
+		if u, err := url.Parse(r.Header.Get("Referer")); err == nil && u.Host != "" {
+			origin = u.Scheme + "://" + u.Host
+		}
+	}
+	if origin != "" {
+		if proxy.sameOrigin(r, origin) {
+			return true
+		}
+		if route != nil && route.CORS != nil && route.CORS.Credentials && route.CORS.allowsOrigin(origin) {
+			return true
+		}
+	}
+
+	log.Printf("WARNING: refused cross-site %v %v from '%v'", r.Method, r.URL.Path, origin)
+	proxy.audit(r, "csrf.refused", r.URL.Path, "failure", origin)
+	proxy.writeError(w, r, http.StatusForbidden, "Cross-site request refused.")
+	return false
+}
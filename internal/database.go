@@ -17,7 +17,9 @@
 package internal
 
 //-----------------------------------------------------------------------------
-// A fake database for exploring auth related issues.
+// The database: user accounts (kept by a UserStore, users.json by
+// default), the chain of authenticators that sign them in, password
+// hashing, and the app store catalog.
 //-----------------------------------------------------------------------------
 
 import (
@@ -26,6 +28,7 @@ import (
 	"fmt"
 	"log"
 	"strings"
+	"time"
 
 	uuid "github.com/satori/go.uuid"
 	"golang.org/x/crypto/bcrypt"
@@ -33,9 +36,21 @@ import (
 
 // A User represents a user of the system.
 type User struct {
-	ID       string
-	Email    string
-	Password string
+	ID        string     `json:"id"`
+	Email     string     `json:"email"`
+	Password  string     `json:"password"`
+	Roles     []string   `json:"roles"`
+	Disabled  bool       `json:"disabled"`
+	Created   time.Time  `json:"created"`
+	LastLogin *time.Time `json:"last_login,omitempty"`
+	External  string     `json:"external,omitempty"`
+
+	TOTPEnabled   bool     `json:"totp_enabled"`
+	TOTPSecret    string   `json:"totp_secret,omitempty"`
+	TOTPLastStep  int64    `json:"totp_last_step,omitempty"`
+	RecoveryCodes []string `json:"recovery_codes,omitempty"`
+
+	APITokens []*APIToken `json:"api_tokens,omitempty"`
 }
 
 type appStoreSku struct {
@@ -52,15 +67,93 @@ type appStoreSku struct {
 
 // Database represents the abstraction for storing application data.
 type Database struct {
-	users []*User
+	users UserStore
 	skus  []*appStoreSku
+	auth  []Authenticator
+
+	apiTokens *apiTokenIndex
+
+	// Password policy, set up before the database is used.
+	passwordCost      int // bcrypt cost for new hashes
+	passwordMinLength int
+	breachedPasswords map[string]bool // upper case hex SHA-1
+}
+
+// An Authenticator checks a login, returning the local user (created
+// if need be) on success, or errUserNotFound to let the next one try.
+type Authenticator interface {
+	Name() string
+	Authenticate(db *Database, login, password string) (*User, error)
+}
+
+// NewDatabase returns a database abstraction for storing application
+// data.
+func NewDatabase(users UserStore) *Database {
+	db := &Database{
+		users:             users,
+		auth:              []Authenticator{LocalAuthenticator},
+		passwordCost:      bcrypt.DefaultCost,
+		passwordMinLength: 8,
+	}
+	db.apiTokens = newAPITokenIndex(db)
+	return db
 }
 
-// NewDatabase returns a database abstraction for storing application data.
-func NewDatabase() *Database {
-	return &Database{
-		users: []*User{newUser("test@example.com", "test1234")},
+// SetAuthenticators replaces the chain of authenticators tried, in
+// order, for password logins.
+func (db *Database) SetAuthenticators(chain ...Authenticator) {
+	db.auth = chain
+	names := make([]string, 0, len(chain))
+	for _, a := range chain {
+		names = append(names, a.Name())
 	}
+	log.Printf("- password logins checked by: %v", strings.Join(names, ", "))
+}
+
+// SeedTestUsers adds test users with a well known password, if there
+// are no users at all. It's only for development, with an in-memory
+// store: the accounts must never be saved anywhere.
+func (db *Database) SeedTestUsers() error {
+	existing, err := db.users.List()
+	if err != nil {
+		return err
+	}
+
+	if len(existing) > 0 {
+		return nil
+	}
+
+	log.Println("WARNING: development mode, adding test@example.com and guest@example.com.")
+	for _, seed := range []struct{ email, role string }{
+		{"test@example.com", "admin"},
+		{"guest@example.com", "user"},
+	} {
+		u, err := db.newUser(seed.email, "test1234", seed.role)
+		if err != nil {
+			return err
+		}
+		if err := db.users.Create(u); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// WarnIfEmpty points out that nobody can log in yet.
+func (db *Database) WarnIfEmpty() {
+	if existing, err := db.users.List(); err == nil && len(existing) == 0 {
+		log.Println("WARNING: no users, add an admin with 'proxy user add -role admin <email>'.")
+	}
+}
+
+// SetPasswordCost sets the bcrypt cost for password hashes. Older
+// hashes with a lower cost are upgraded when their owners next log in.
+func (db *Database) SetPasswordCost(cost int) error {
+	if cost < bcrypt.MinCost || cost > bcrypt.MaxCost {
+		return fmt.Errorf("bcrypt cost must be between %v and %v", bcrypt.MinCost, bcrypt.MaxCost)
+	}
+	db.passwordCost = cost
+	return nil
 }
 
 // Start the database service.
@@ -73,26 +166,100 @@ func (db *Database) Stop() {
 	log.Println("Stopping database.")
 }
 
-func newUser(email, password string) *User {
-	passcode, err := encryptPassword(password)
+func (db *Database) newUser(email, password string, roles ...string) (*User, error) {
+	if err := db.checkPassword(password); err != nil {
+		return nil, err
+	}
+	passcode, err := db.encryptPassword(password)
 	if err != nil {
-		log.Fatalf("Unable to encrypt password: %v", err)
+		return nil, err
 	}
 	return &User{
 		ID:       mkUUID(),
 		Email:    email,
 		Password: passcode,
-	}
+		Roles:    roles,
+		Created:  time.Now().UTC(),
+	}, nil
 }
 
-func (db *Database) findUser(email, password string) (*User, error) {
-	test := strings.ToLower(email)
-	for _, u := range db.users {
-		if strings.ToLower(u.Email) == test && validPassword(password, u.Password) {
+// findUser checks a login against each authenticator in turn.
+func (db *Database) findUser(login, password string) (*User, error) {
+	for _, a := range db.auth {
+		u, err := a.Authenticate(db, login, password)
+		if err == nil {
 			return u, nil
 		}
+		if err != errUserNotFound {
+			log.Printf("WARNING: %v login for '%v': %v", a.Name(), login, err)
+		}
+	}
+	return nil, errUserNotFound
+}
+
+// LocalAuthenticator checks passwords in the user store.
+var LocalAuthenticator Authenticator = localAuthenticator{}
+
+type localAuthenticator struct{}
+
+func (localAuthenticator) Name() string {
+	return "local"
+}
+
+// Authenticate checks a login, recording it and upgrading the password
+// hash if it was made with a lower cost than we use now.
+func (localAuthenticator) Authenticate(db *Database, email, password string) (*User, error) {
+	u, err := db.users.FindByEmail(email)
+	if err != nil {
+		// Spend the same time as a real check, so response times
+		// don't tell which emails have accounts.
+		validPassword(password, dummyHash)
+		return nil, errUserNotFound
+	}
+
+	if !validPassword(password, u.Password) {
+		return nil, errUserNotFound
+	}
+
+	if u.Disabled {
+		log.Printf("- login refused for disabled user '%v'", u.Email)
+		return nil, errUserNotFound
+	}
+
+	upgrade := ""
+	if passwordCostOf(u.Password) < db.passwordCost {
+		if hash, err := db.encryptPassword(password); err == nil {
+			upgrade = hash
+		}
+	}
+
+	now := time.Now().UTC()
+	changed, err := db.users.Change(u.ID, func(c *User) error {
+		// Unless the password changed meanwhile.
+		if upgrade != "" && c.Password == u.Password {
+			c.Password = upgrade
+			log.Printf("- upgraded password hash for '%v' to cost %v", c.Email, db.passwordCost)
+		}
+		c.LastLogin = &now
+		return nil
+	})
+	if err != nil {
+		log.Printf("WARNING: unable to record login for '%v': %v", u.Email, err)
+		return u, nil
 	}
-	return nil, errors.New("user not found")
+	return changed, nil
+}
+
+// findUserByID returns an enabled user.
+func (db *Database) findUserByID(id string) (*User, error) {
+	u, err := db.users.Get(id)
+	if err != nil {
+		return nil, err
+	}
+	if u.Disabled {
+		return nil, errors.New("user disabled")
+	}
+	return u, nil
 }
 
 func (db *Database) findSKU(xrn string) (*appStoreSku, error) {
@@ -123,6 +290,8 @@ func (db *Database) setSKUs(skus []*appStoreSku) {
 	db.skus = skus
 }
 
+var dummyHash, _ = hashPassword("not a password", bcrypt.DefaultCost)
+
 func validPassword(password, hash string) bool {
 	decoded, err := hex.DecodeString(hash)
 	if err != nil {
@@ -135,14 +304,30 @@ func validPassword(password, hash string) bool {
 	return true
 }
 
-func encryptPassword(password string) (string, error) {
-	raw, err := bcrypt.GenerateFromPassword([]byte(password), bcrypt.DefaultCost)
+func (db *Database) encryptPassword(password string) (string, error) {
+	return hashPassword(password, db.passwordCost)
+}
+
+func hashPassword(password string, cost int) (string, error) {
+	raw, err := bcrypt.GenerateFromPassword([]byte(password), cost)
 	if err != nil {
 		return "", err
 	}
 	return fmt.Sprintf("%x", raw), nil
 }
 
+func passwordCostOf(hash string) int {
+	decoded, err := hex.DecodeString(hash)
+	if err != nil {
+		return 0
+	}
+	cost, err := bcrypt.Cost(decoded)
+	if err != nil {
+		return 0
+	}
+	return cost
+}
+
 func mkUUID() string {
 	return fmt.Sprintf("%s", uuid.NewV4())
 }
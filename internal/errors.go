@@ -0,0 +1,190 @@
+//
+// Copyright (C) 2017 Keith Irwin
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU General Public License as published
+// by the Free Software Foundation, either version 3 of the License,
+// or (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU General Public License for more details.
+//
+// You should have received a copy of the GNU General Public License
+// along with this program.  If not, see <http://www.gnu.org/licenses/>.
+
+package internal
+
+import (
+	"bytes"
+	"encoding/json"
+	"html/template"
+	"log"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+)
+
+//-----------------------------------------------------------------------------
+// Error responses are content negotiated: browsers get an HTML page,
+// everything else gets RFC 7807 application/problem+json.
+//
+// HTML pages are looked up in the error page directory, most specific
+// first:
+//
+//   <dir>/<context>/<status>.html
+//   <dir>/<context>/error.html
+//   <dir>/<status>.html
+//   <dir>/error.html
+//
+// falling back to a built-in page if none exist.
+//-----------------------------------------------------------------------------
+
+type problem struct {
+	Type      string `json:"type"`
+	Title     string `json:"title"`
+	Status    int    `json:"status"`
+	Detail    string `json:"detail,omitempty"`
+	Instance  string `json:"instance,omitempty"`
+	RequestID string `json:"request_id,omitempty"`
+	Context   string `json:"-"`
+}
+
+// ErrorPages renders error responses for the proxy.
+type ErrorPages struct {
+	dir string
+}
+
+// NewErrorPages returns an error renderer that looks for custom HTML
+// pages in dir.
+func NewErrorPages(dir string) *ErrorPages {
+	return &ErrorPages{dir: dir}
+}
+
+var defaultErrorPage = template.Must(template.New("error").Parse(`<!doctype html>
+<html lang="en">
+  <head>
+    <title>Launch Pad: {{.Title}}</title>
+    <meta charset="utf-8">
+    <meta name="viewport" content="width=device-width, initial-scale=1, shrink-to-fit=no">
+    <style>
+      body { margin: 0; font-family: helvetica, sans-serif; background: #f4f4f4; color: #333; }
+      .Panel { max-width: 32em; margin: 15vh auto; padding: 2em; background: white;
+               border: 1px solid silver; border-radius: 4px; }
+      h1 { font-size: 1.4em; margin-top: 0; }
+      .RequestID { font-size: 9pt; color: #999; }
+      a { color: #369; text-decoration: none; }
+    </style>
+  </head>
+  <body>
+    <div class="Panel">
+      <h1>{{.Status}} {{.Title}}</h1>
+      {{if .Detail}}<p>{{.Detail}}</p>{{end}}
+      <p><a href="/">Return to the Launch Pad</a></p>
+      {{if .RequestID}}<p class="RequestID">Request ID: {{.RequestID}}</p>{{end}}
+    </div>
+  </body>
+</html>
+`))
+
+func (pages *ErrorPages) template(context string, status int) *template.Template {
+	if pages == nil || pages.dir == "" {
+		return defaultErrorPage
+	}
+
+	code := strconv.Itoa(status) + ".html"
+	candidates := []string{
+		filepath.Join(pages.dir, code),
+		filepath.Join(pages.dir, "error.html"),
+	}
+
+	if context != "" && !strings.ContainsAny(context, `/\`) {
+		candidates = append([]string{
+			filepath.Join(pages.dir, context, code),
+			filepath.Join(pages.dir, context, "error.html"),
+		}, candidates...)
+	}
+
+	for _, file := range candidates {
+		if _, err := os.Stat(file); err != nil {
+			continue
+		}
+		t, err := template.ParseFiles(file)
+		if err != nil {
+			log.Printf("WARNING: unable to parse error page '%v': %v", file, err)
+			continue
+		}
+		return t
+	}
+
+	return defaultErrorPage
+}
+
+func (pages *ErrorPages) render(w http.ResponseWriter, r *http.Request, p problem) {
+	w.Header().Set("Cache-Control", "no-store")
+	w.Header().Del("Content-Length")
+
+	if wantsHTML(r) {
+		buf := new(bytes.Buffer)
+		if err := pages.template(p.Context, p.Status).Execute(buf, p); err != nil {
+			log.Printf("ERROR: rendering error page: %v", err)
+			buf.Reset()
+			defaultErrorPage.Execute(buf, p)
+		}
+		w.Header().Set("Content-Type", "text/html; charset=utf-8")
+		w.WriteHeader(p.Status)
+		w.Write(buf.Bytes())
+		return
+	}
+
+	body, err := json.Marshal(p)
+	if err != nil {
+		http.Error(w, p.Detail, p.Status)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/problem+json")
+	w.WriteHeader(p.Status)
+	w.Write(body)
+}
+
+// wantsHTML returns true if the client would rather have HTML than
+// JSON, which is to say it's a browser navigating to a page.
+func wantsHTML(r *http.Request) bool {
+	accept := r.Header.Get("Accept")
+	html := strings.Index(accept, "text/html")
+	if html == -1 {
+		return false
+	}
+	data := strings.Index(accept, "json")
+	return data == -1 || html < data
+}
+
+//-----------------------------------------------------------------------------
+
+func (proxy ProxyServer) writeError(w http.ResponseWriter, r *http.Request, status int, reason string) {
+	id := requestID(r)
+	log.Printf("Error: [%v] [%v] %v", id, status, reason)
+
+	proxy.ErrorPages.render(w, r, problem{
+		Type:      "about:blank",
+		Title:     http.StatusText(status),
+		Status:    status,
+		Detail:    reason,
+		Instance:  r.URL.Path,
+		RequestID: id,
+		Context:   getPathContext(r),
+	})
+}
+
+// proxyErrorHandler replaces ReverseProxy's default (an empty 502) for
+// failures reaching the upstream.
+func (proxy ProxyServer) proxyErrorHandler(r *http.Request, upstream *upstream) func(http.ResponseWriter, *http.Request, error) {
+	return func(w http.ResponseWriter, _ *http.Request, err error) {
+		log.Printf("`-> proxy error: [%v] %v", upstream.Name, err)
+		proxy.writeError(w, r, http.StatusBadGateway, "The service behind this route is unavailable.")
+	}
+}
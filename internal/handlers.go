@@ -24,6 +24,7 @@ import (
 	"net"
 	"net/http"
 	"net/http/httputil"
+	"path"
 	"strings"
 	"time"
 
@@ -32,44 +33,69 @@ import (
 
 //-----------------------------------------------------------------------------
 
-type routeMap map[string]string
-
-func newProxyRoutes() routeMap {
-	return routeMap{}
-}
-
-func (routes routeMap) Set(context, url string) {
-	routes[context] = url
-}
-
-//-----------------------------------------------------------------------------
-
 // ProxyServer represents a running server and all its depenendent
 // resources.
 type ProxyServer struct {
 	Applications   *Applications
 	Database       *Database
-	Routes         routeMap
+	Routes         *routeTable
 	RootAppHandler http.Handler
 	StaticHandler  http.Handler
+	ErrorPages     *ErrorPages
+	AccessLog      *AccessLog
+	Tracer         *Tracer
+	Audit          *AuditLog
+	Metrics        *Metrics
+	MetricsAddr    string
 	Checker        *time.Ticker
 	commander      *CommandProcessor
 	clienthub      *ClientHub
+	maintenance    *Maintenance
+	trusted        *netList
+	ipRules        *ipRules
+	policy         *policyHolder
+	auth           *authSettings
+	keys           *KeyRing
+	sessions       *sessionRegistry
+	refresh        *refreshStore
+	challenges     *challengeStore
+	mfa            *mfaSettings
+	throttle       *loginThrottle
+	oidc           *oidcProvider
+	forwardAuth    *forwardAuth
+	resets         *resetStore
+	mailer         *mailer
 }
 
 // NewProxyServer represents a running server and all its depenendent
 // resources.
-func NewProxyServer(appDir, hostDir string, database *Database,
-	commander *CommandProcessor, clients *ClientHub) ProxyServer {
+func NewProxyServer(appDir, hostDir, errorDir string, database *Database,
+	commander *CommandProcessor, clients *ClientHub, maintenance *Maintenance) ProxyServer {
 	return ProxyServer{
 		Database:       database,
 		commander:      commander,
 		clienthub:      clients,
+		maintenance:    maintenance,
 		StaticHandler:  http.FileServer(http.Dir(appDir)),
 		RootAppHandler: http.FileServer(http.Dir(hostDir)),
+		ErrorPages:     NewErrorPages(errorDir),
 		Applications:   newApplications(appDir),
 		Routes:         newProxyRoutes(),
 		Checker:        time.NewTicker(15 * time.Second),
+		trusted:        &netList{},
+		ipRules:        newIPRules(),
+		policy:         newPolicyHolder(),
+		auth:           newAuthSettings(),
+		keys:           defaultKeyRing(),
+		sessions:       newSessionRegistry(),
+		refresh:        newRefreshStore(),
+		challenges:     newChallengeStore(),
+		mfa:            &mfaSettings{},
+		throttle:       newLoginThrottle(),
+		oidc:           newOIDCProvider(),
+		forwardAuth:    &forwardAuth{},
+		resets:         newResetStore(),
+		mailer:         &mailer{},
 	}
 }
 
@@ -77,11 +103,29 @@ func NewProxyServer(appDir, hostDir string, database *Database,
 func (proxy ProxyServer) Start() {
 	log.Println("Starting proxy.")
 
+	if proxy.MetricsAddr != "" {
+		go proxy.serveMetrics()
+	}
+
 	server := http.Server{Addr: ":8080", Handler: proxy}
 	go proxy.testConnectionsContinuously()
 	go log.Fatal(server.ListenAndServe())
 }
 
+// serveMetrics serves /metrics, without authentication, on a separate
+// listener meant to be reachable only by the monitoring system.
+func (proxy ProxyServer) serveMetrics() {
+	log.Printf("Starting metrics listener [%v].", proxy.MetricsAddr)
+	mux := http.NewServeMux()
+	mux.HandleFunc("/metrics", func(w http.ResponseWriter, r *http.Request) {
+		proxy.writeMetrics(w)
+	})
+	server := http.Server{Addr: proxy.MetricsAddr, Handler: mux}
+	if err := server.ListenAndServe(); err != nil {
+		log.Printf("ERROR: metrics listener: %v", err)
+	}
+}
+
 // Stop the proxy server
 func (proxy ProxyServer) Stop() {
 	log.Println("Stopping proxy.")
@@ -95,19 +139,66 @@ func (proxy ProxyServer) AddRoute(context, host string) {
 	proxy.Routes.Set(context, host)
 }
 
+// SetCORS sets the CORS policy for a context route.
+func (proxy ProxyServer) SetCORS(context string, policy CORSPolicy) error {
+	return proxy.Routes.SetCORS(context, &policy)
+}
+
+// TrustProxies sets the addresses (or CIDRs) of proxies and load
+// balancers in front of this one, whose forwarded headers we believe.
+func (proxy ProxyServer) TrustProxies(cidrs []string) error {
+	list, err := parseNetList(cidrs)
+	if err != nil {
+		return err
+	}
+	*proxy.trusted = *list
+	return nil
+}
+
+// SetPublic serves a context route without authentication. Given
+// paths (such as "/webhooks"), only those paths are public.
+func (proxy ProxyServer) SetPublic(context string, paths ...string) error {
+	return proxy.Routes.SetPublic(context, len(paths) == 0, paths)
+}
+
+// SetCSRFExempt turns off CSRF checks for a context, for back-ends
+// that do their own.
+func (proxy ProxyServer) SetCSRFExempt(context string, exempt bool) error {
+	return proxy.Routes.SetCSRFExempt(context, exempt)
+}
+
+// AddUpstream adds a named, weighted upstream group (such as a canary)
+// to a context route.
+func (proxy ProxyServer) AddUpstream(context, name, host string, weight int) {
+	proxy.Routes.SetUpstream(context, name, host, weight)
+}
+
+// AllowPinning lets (or stops) clients choosing a context's upstream
+// group with the X-Proxy-Upstream header or the proxyUpstream cookie.
+func (proxy ProxyServer) AllowPinning(context string, allow bool) error {
+	if allow {
+		return proxy.Routes.SetPinning(context, defaultPinHeader, defaultPinCookie)
+	}
+	return proxy.Routes.SetPinning(context, "", "")
+}
+
 func (proxy ProxyServer) testConnections() {
-	test := func(context, addr string) {
+	test := func(context, name, addr string) {
 		conn, err := net.DialTimeout("tcp", addr, 2*time.Second)
 		if err != nil {
 			log.Printf("WARNING: ROUTE '/%v' CANNOT CONNECT TO '%v' (%v).", context, addr, err)
+			proxy.Metrics.set(metricUpstreamUp, 0, "route", context, "upstream", name, "addr", addr)
 			return
 		}
 		conn.Close()
+		proxy.Metrics.set(metricUpstreamUp, 1, "route", context, "upstream", name, "addr", addr)
 	}
 
-	for context, addr := range proxy.Routes {
-		// Run in background to allow for longer timeouts
-		go test(context, addr)
+	for _, route := range proxy.Routes.list() {
+		for _, upstream := range route.Upstreams {
+			// Run in background to allow for longer timeouts
+			go test(route.Context, upstream.Name, upstream.Addr)
+		}
 	}
 }
 
@@ -119,37 +210,73 @@ func (proxy ProxyServer) testConnectionsContinuously() {
 }
 
 func (proxy ProxyServer) isAPI(r *http.Request) bool {
-	return proxy.Routes[getPathContext(r)] != ""
+	return proxy.Routes.has(getPathContext(r))
 }
 
-func (proxy ProxyServer) makeContextDirector() func(req *http.Request) {
+func (proxy ProxyServer) makeContextDirector(upstream *upstream) func(req *http.Request) {
 	return func(req *http.Request) {
-		host := req.Host
-		path := req.URL.Path
 		context := getPathContext(req)
 
 		req.URL.Scheme = "http"
-		req.URL.Host = proxy.Routes[context]
-		req.URL.Path = removePathContext(req)
+		req.URL.Host = upstream.Addr
+		req.URL.Path = backendPath(req)
+		req.URL.RawPath = ""
 
 		// So that back-ends can prefix URLs to get back here.
 		//req.Header.Set("X-Proxy-Context", "http://"+req.Host+"/"+context)
 		req.Header.Set("X-Proxy-Context", context)
-
-		log.Printf("`-> proxy: http://%v%v --> %v", host, path, req.URL.String())
+		req.Header.Set("X-Request-ID", requestID(req))
 	}
 }
 
 func (proxy ProxyServer) ServeHTTP(w http.ResponseWriter, r *http.Request) {
-	logRequest(r)
+	proxy.assignRequestID(w, r)
+
+	ctx, span := proxy.Tracer.startRequest(r)
+	r = r.WithContext(ctx)
+
+	rec := newAccessRecord(r, proxy.clientIP(r))
+	if span != nil {
+		rec.TraceID = span.traceID
+	}
+
+	defer func() {
+		rec.finish()
+		proxy.AccessLog.write(rec)
+		proxy.recordMetrics(rec)
+
+		span.set("http.status_code", rec.Status)
+		if rec.Status >= 500 {
+			span.fail(http.StatusText(rec.Status))
+		}
+		span.finish()
+	}()
+
+	r = withAccessRecord(r, rec)
+	w = &recordingWriter{w, rec}
+
+	if !proxy.checkIP(w, r) {
+		return
+	}
+
+	if proxy.handleCORS(w, r) {
+		return
+	}
 
-	if r.Method == "HEAD" || r.Method == "OPTIONS" {
+	if !proxy.checkCSRF(w, r) {
 		return
 	}
 
 	w.Header().Set("Cache-Control", "public, max-age=-1")
 
-	switch getPathContext(r) {
+	context := getPathContext(r)
+	if methods, ok := endpointMethods[context]; ok {
+		if !proxy.allowMethod(w, r, methods) {
+			return
+		}
+	}
+
+	switch context {
 
 	case "logout":
 		proxy.handleLogout(w, r)
@@ -166,16 +293,38 @@ func (proxy ProxyServer) ServeHTTP(w http.ResponseWriter, r *http.Request) {
 	case "ws":
 		proxy.handleWebSocket(w, r)
 
+	case "admin":
+		proxy.handleAdmin(w, r)
+
+	case "sessions":
+		proxy.handleSessions(w, r)
+
+	case "tokens":
+		proxy.handleTokens(w, r)
+
+	case "password":
+		proxy.handlePassword(w, r)
+
+	case "metrics":
+		proxy.handleMetrics(w, r)
+
 	case "static":
 		proxy.handleHomeApp(w, r)
 
 	case "":
+		if r.URL.Path == jwksPath {
+			proxy.handleJWKS(w, r)
+			return
+		}
 		proxy.handleHomeApp(w, r)
 
 	default:
+		if proxy.underMaintenance(w, r) {
+			return
+		}
 		if proxy.isAPI(r) {
 			proxy.handleBackend(w, r)
-		} else {
+		} else if proxy.allowMethod(w, r, staticMethods) {
 			proxy.handleInstalledApps(w, r)
 		}
 	}
@@ -183,12 +332,58 @@ func (proxy ProxyServer) ServeHTTP(w http.ResponseWriter, r *http.Request) {
 
 //-----------------------------------------------------------------------------
 
+var staticMethods = []string{"GET", "HEAD"}
+
+// endpointMethods lists the proxy's own endpoints and the methods they
+// answer. Backend routes aren't here: they get every method, OPTIONS
+// included, and decide for themselves.
+var endpointMethods = map[string][]string{
+	"":         staticMethods,
+	"static":   staticMethods,
+	"logout":   {"GET"},
+	"auth":     {"GET", "POST"},
+	"query":    {"GET", "HEAD"},
+	"command":  {"POST"},
+	"ws":       {"GET"},
+	"admin":    {"GET", "HEAD", "PUT", "POST", "DELETE"},
+	"sessions": {"GET", "HEAD", "DELETE"},
+	"tokens":   {"GET", "HEAD", "POST", "DELETE"},
+	"password": {"POST"},
+	"metrics":  {"GET", "HEAD"},
+}
+
+// allowMethod answers OPTIONS with an Allow header, rejects methods the
+// endpoint doesn't support, and returns true if the request should go
+// on to the handler. Handlers answer HEAD as they would GET, and
+// net/http drops the body.
+func (proxy ProxyServer) allowMethod(w http.ResponseWriter, r *http.Request, methods []string) bool {
+	allow := strings.Join(methods, ", ") + ", OPTIONS"
+
+	if r.Method == "OPTIONS" {
+		w.Header().Set("Allow", allow)
+		w.WriteHeader(http.StatusNoContent)
+		return false
+	}
+
+	for _, m := range methods {
+		if r.Method == m {
+			return true
+		}
+	}
+
+	w.Header().Set("Allow", allow)
+	proxy.writeError(w, r, http.StatusMethodNotAllowed, "Method not allowed.")
+	return false
+}
+
+//-----------------------------------------------------------------------------
+
 func (proxy ProxyServer) handleHomeApp(w http.ResponseWriter, r *http.Request) {
-	token, err := checkAuth(w, r)
+	token, err := proxy.checkAuth(w, r)
 	if err != nil {
-		unsetCookie(w)
+		proxy.unsetCookie(w)
 	} else {
-		setAuth(w, token)
+		proxy.setAuth(w, token)
 	}
 	proxy.RootAppHandler.ServeHTTP(w, r)
 }
@@ -204,24 +399,24 @@ var pingPacket = []byte(`{"type":"ping"}`)
 
 func (proxy ProxyServer) handleWebSocket(w http.ResponseWriter, r *http.Request) {
 
-	token, err := checkAuth(w, r)
+	token, err := proxy.checkAuth(w, r)
 	if err != nil {
-		writeError(w, http.StatusUnauthorized, err.Error())
+		proxy.writeError(w, r, http.StatusUnauthorized, err.Error())
 		return
 	}
 
 	conn, err := upgrader.Upgrade(w, r, nil)
 	if err != nil {
-		writeError(w, 500, err.Error())
+		proxy.writeError(w, r, 500, err.Error())
 		return
 	}
 
 	defer conn.Close()
 
-	client := newClient(token, conn)
+	client := newClient(proxy.tokenSession(token), conn)
 	proxy.clienthub.add(client)
 
-	viewer, _ := decodeAuthToken(token)
+	viewer, _ := proxy.decodeAuthToken(token)
 	log.Printf("- socket.open: [%v]", viewer.Email)
 
 	for {
@@ -258,7 +453,20 @@ func (proxy ProxyServer) handleWebSocket(w http.ResponseWriter, r *http.Request)
 //-----------------------------------------------------------------------------
 
 func (proxy ProxyServer) handleLogout(w http.ResponseWriter, r *http.Request) {
-	unsetCookie(w)
+	session := ""
+	if token, err := proxy.checkAuth(w, r); err == nil {
+		if viewer, err := proxy.decodeAuthToken(token); err == nil {
+			session = viewer.Session
+		}
+	} else if c, err := r.Cookie(refreshCookie); err == nil {
+		session = proxy.refresh.familyOf(c.Value)
+	}
+	if session != "" {
+		proxy.endSession(r, session, "logout")
+		proxy.audit(r, "auth.logout", session, "success", "")
+	}
+	unsetRefresh(w)
+	proxy.unsetCookie(w)
 	http.Redirect(w, r, "/", http.StatusTemporaryRedirect)
 }
 
@@ -266,16 +474,72 @@ func (proxy ProxyServer) handleLogout(w http.ResponseWriter, r *http.Request) {
 
 func (proxy ProxyServer) handleBackend(w http.ResponseWriter, r *http.Request) {
 
-	_, err := checkAuth(w, r)
-	if err != nil {
-		writeError(w, http.StatusUnauthorized, err.Error())
+	route := proxy.Routes.find(getPathContext(r))
+	if route == nil {
+		proxy.writeError(w, r, http.StatusNotFound, "No such route.")
+		return
+	}
+
+	// Paths are checked (and forwarded) clean, so "/public/../private"
+	// can't pass for a public path; ones that climb like that aren't
+	// public, and aren't forwarded either.
+	climbs := hasDotDot(r.URL.Path)
+
+	// Public routes still pick up the user, if any, for stickiness.
+	token, err := proxy.checkAuth(w, r)
+	if climbs || !route.isPublic(backendPath(r)) {
+		if err != nil {
+			proxy.writeError(w, r, http.StatusUnauthorized, err.Error())
+			return
+		}
+
+		if !proxy.permit(w, r, token, policyRoute, route.Context) {
+			return
+		}
+	}
+
+	if climbs {
+		proxy.writeError(w, r, http.StatusBadRequest, "Paths can't contain '..' segments.")
+		return
+	}
+
+	_, span := startSpan(r.Context(), "route.select", spanKindInternal)
+
+	upstream := route.choose(r, proxy.stickyKey(w, r, token))
+	if upstream == nil {
+		span.fail("no upstream")
+		span.finish()
+		proxy.writeError(w, r, http.StatusBadGateway, "No upstream available for route.")
 		return
 	}
 
+	span.set("proxy.route", route.Context)
+	span.set("proxy.upstream", upstream.Name)
+	span.finish()
+
+	rec := accessRecordFrom(r.Context())
+	rec.Upstream = upstream.Name + " " + upstream.Addr
+	rec.upstreamName = upstream.Name
+
+	// An access token is a long-lived secret; upstreams get the
+	// short-lived stand-in instead, as they would with a cookie.
+	if isAPIToken(r.Header.Get("Authorization")) {
+		r.Header.Del("Authorization")
+		if token != "" {
+			r.Header.Set("Authorization", "Bearer "+token)
+		}
+	}
+
 	reverseProxy := &httputil.ReverseProxy{
-		Director: proxy.makeContextDirector(),
+		Transport:    timedTransport{http.DefaultTransport},
+		Director:     proxy.makeContextDirector(upstream),
+		ErrorHandler: proxy.proxyErrorHandler(r, upstream),
 		ModifyResponse: func(res *http.Response) error {
 			res.Header.Set("X-Proxy-Context", getPathContext(r))
+			res.Header.Set("X-Proxy-Upstream", upstream.Name)
+			if route.CORS != nil {
+				stripCORS(res.Header)
+			}
 			return nil
 		},
 	}
@@ -286,29 +550,39 @@ func (proxy ProxyServer) handleBackend(w http.ResponseWriter, r *http.Request) {
 //-----------------------------------------------------------------------------
 
 func (proxy ProxyServer) handleInstalledApps(w http.ResponseWriter, r *http.Request) {
-	token, err := checkAuth(w, r)
+	if proxy.Applications.isPublic(getPathContext(r)) {
+		proxy.StaticHandler.ServeHTTP(w, r)
+		return
+	}
+
+	token, err := proxy.checkAuth(w, r)
 	if err != nil {
-		unsetCookie(w)
+		proxy.unsetCookie(w)
 		http.Redirect(w, r, "/", http.StatusTemporaryRedirect)
 		return
 	}
 
-	setAuth(w, token)
+	if !proxy.permit(w, r, token, policyApp, getPathContext(r)) {
+		return
+	}
+
+	proxy.setAuth(w, token)
 	proxy.StaticHandler.ServeHTTP(w, r)
 }
 
 //-----------------------------------------------------------------------------
 
 type queryResults struct {
-	Applications []*InstalledApp `json:"applications"`
-	AppStore     []*appStoreSku  `json:"app_store"`
+	Applications []*InstalledApp      `json:"applications"`
+	AppStore     []*appStoreSku       `json:"app_store"`
+	Maintenance  []*maintenanceWindow `json:"maintenance"`
 }
 
 func (proxy ProxyServer) handleQuery(w http.ResponseWriter, r *http.Request) {
 
-	token, err := checkAuth(w, r)
+	token, err := proxy.checkAuth(w, r)
 	if err != nil {
-		writeError(w, http.StatusUnauthorized, err.Error())
+		proxy.writeError(w, r, http.StatusUnauthorized, err.Error())
 		return
 	}
 
@@ -323,8 +597,9 @@ func (proxy ProxyServer) handleQuery(w http.ResponseWriter, r *http.Request) {
 	}
 
 	graph := &queryResults{
-		Applications: proxy.Applications.InstalledApps,
+		Applications: proxy.visibleApps(token, proxy.Applications.InstalledApps),
 		AppStore:     skus,
+		Maintenance:  proxy.maintenance.current(),
 	}
 
 	buf := new(bytes.Buffer)
@@ -334,11 +609,11 @@ func (proxy ProxyServer) handleQuery(w http.ResponseWriter, r *http.Request) {
 
 	if err := enc.Encode(graph); err != nil {
 		log.Printf("ERROR: %v", err)
-		writeError(w, http.StatusInternalServerError, "Unable to deserialize app data.")
+		proxy.writeError(w, r, http.StatusInternalServerError, "Unable to deserialize app data.")
 		return
 	}
 
-	setAuth(w, token)
+	proxy.setAuth(w, token)
 	w.Write(buf.Bytes())
 }
 
@@ -351,123 +626,344 @@ type commandRequest struct {
 
 func (proxy ProxyServer) handleCommand(w http.ResponseWriter, r *http.Request) {
 
-	token, err := checkAuth(w, r)
+	token, err := proxy.checkAuth(w, r)
 	if err != nil {
-		writeError(w, http.StatusUnauthorized, err.Error())
+		proxy.writeError(w, r, http.StatusUnauthorized, err.Error())
 		return
 	}
 
 	var command commandRequest
 	if err := json.NewDecoder(r.Body).Decode(&command); err != nil {
-		writeError(w, http.StatusBadRequest, "Can't deserialize command request.")
+		proxy.writeError(w, r, http.StatusBadRequest, "Can't deserialize command request.")
+		return
+	}
+
+	if !proxy.permit(w, r, token, policyCommand, command.Command) {
 		return
 	}
 
 	log.Printf("- invoking command '%v'", command.Command)
-	proxy.commander.invoke(token, command.Command, command.ID)
+	entry := proxy.auditEntry(r, "app."+command.Command, command.ID)
+	proxy.commander.invoke(r.Context(), token, command.Command, command.ID, func(result commandResult) {
+		entry.Outcome = "success"
+		if result.code != commandOk {
+			entry.Outcome = "failure"
+			entry.Detail = result.reason
+		}
+		proxy.Audit.write(entry)
+	})
 
-	proxy.clienthub.sendAck(token, command.Command)
+	proxy.clienthub.sendAck(proxy.tokenSession(token), command.Command)
 
-	setAuth(w, token)
+	proxy.setAuth(w, token)
 	w.WriteHeader(200)
 }
 
 //-----------------------------------------------------------------------------
 
 type authRequest struct {
-	Email    string `json:"email,omitempty"`
-	Password string `json:"password,omitempty"`
-	Token    string `json:"token"`
+	Email        string `json:"email,omitempty"`
+	Password     string `json:"password,omitempty"`
+	Token        string `json:"token"`
+	RefreshToken string `json:"refresh_token,omitempty"`
+	ExpiresIn    int    `json:"expires_in,omitempty"`
+
+	// Second factor
+	Challenge      string   `json:"challenge,omitempty"`
+	Code           string   `json:"code,omitempty"`
+	MFARequired    bool     `json:"mfa_required,omitempty"`
+	EnrollRequired bool     `json:"mfa_enrollment_required,omitempty"`
+	RecoveryCodes  []string `json:"recovery_codes,omitempty"`
 }
 
 func (proxy ProxyServer) handleAuth(w http.ResponseWriter, r *http.Request) {
 
+	// Single sign on is a browser redirect dance and forward auth is
+	// asked by other gateways, everything else is a POST of an
+	// authRequest.
+	sub := strings.Trim(removePathContext(r), "/")
+	if sub == "oidc" || strings.HasPrefix(sub, "oidc/") {
+		proxy.handleOIDC(w, r, strings.TrimPrefix(strings.TrimPrefix(sub, "oidc"), "/"))
+		return
+	}
+	if sub == "verify" || strings.HasPrefix(sub, "verify/") {
+		proxy.handleVerify(w, r, strings.TrimPrefix(strings.TrimPrefix(sub, "verify"), "/"))
+		return
+	}
+
+	if !proxy.allowMethod(w, r, []string{"POST"}) {
+		return
+	}
+
 	var params authRequest
 
 	if err := json.NewDecoder(r.Body).Decode(&params); err != nil {
-		writeError(w, http.StatusBadRequest, "Can't deserialize auth request.")
+		proxy.writeError(w, r, http.StatusBadRequest, "Can't deserialize auth request.")
 		return
 	}
 
 	writeParams := func(auth authRequest) {
 		bytes, err := json.Marshal(auth)
 		if err != nil {
-			writeError(w, http.StatusInternalServerError, "Unable to serialize auth response.")
+			proxy.writeError(w, r, http.StatusInternalServerError, "Unable to serialize auth response.")
 			return
 		}
 
-		setAuth(w, auth.Token)
 		w.Write(bytes)
 	}
 
+	// A login (or refresh) starts (or continues) a refresh token family.
+	writeLogin := func(user *User, family string, recoveryCodes []string) {
+		token, refresh, err := proxy.startLogin(w, r, user, family)
+		if err != nil {
+			proxy.writeError(w, r, http.StatusInternalServerError, "Can't construct token.")
+			return
+		}
+		accessRecordFrom(r.Context()).User = user.Email
+
+		writeParams(authRequest{
+			Token:         token,
+			Email:         user.Email,
+			RefreshToken:  refresh,
+			ExpiresIn:     int(proxy.auth.accessTTL.Seconds()),
+			RecoveryCodes: recoveryCodes,
+		})
+	}
+
+	switch {
+	case strings.HasPrefix(sub, "totp/"):
+		proxy.handleTOTP(w, r, strings.TrimPrefix(sub, "totp/"), params, writeLogin)
+		return
+	case sub != "":
+		proxy.writeError(w, r, http.StatusNotFound, "Unknown auth resource.")
+		return
+	}
+
+	// AUTH BY LOGIN CHALLENGE AND SECOND FACTOR
+
+	if params.Challenge != "" {
+		userID, ok := proxy.challenges.attempt(params.Challenge)
+		if !ok {
+			proxy.Metrics.inc(metricAuth, "method", "totp", "outcome", "failure")
+			proxy.writeError(w, r, http.StatusUnauthorized, "Login challenge expired.")
+			return
+		}
+
+		user, err := proxy.Database.findUserByID(userID)
+		if err != nil {
+			proxy.Metrics.inc(metricAuth, "method", "totp", "outcome", "failure")
+			proxy.writeError(w, r, http.StatusUnauthorized, badCodeMsg)
+			return
+		}
+
+		account, ip := accountKey(user.Email), ipKey(proxy.clientIP(r).String())
+		if proxy.throttled(w, r, account, ip) {
+			return
+		}
+
+		if err := proxy.Database.verifySecondFactor(userID, params.Code); err != nil {
+			proxy.Metrics.inc(metricAuth, "method", "totp", "outcome", "failure")
+			proxy.loginFailed(r, account, ip)
+			proxy.audit(r, "auth.totp", user.Email, "failure", err.Error())
+			proxy.writeError(w, r, http.StatusUnauthorized, badCodeMsg)
+			return
+		}
+
+		proxy.throttle.succeed(account, ip)
+		proxy.challenges.done(params.Challenge)
+		proxy.Metrics.inc(metricAuth, "method", "totp", "outcome", "success")
+		proxy.audit(r, "auth.totp", user.Email, "success", "")
+		writeLogin(user, mkUUID(), nil)
+		return
+	}
+
+	// AUTH BY REFRESH TOKEN (from the body, or for browsers, the cookie)
+
+	if params.RefreshToken == "" && params.Token == "" && params.Email == "" {
+		if c, err := r.Cookie(refreshCookie); err == nil {
+			params.RefreshToken = c.Value
+		}
+	}
+
+	if params.RefreshToken != "" {
+		rec, err := proxy.refresh.redeem(params.RefreshToken)
+		if err == errRefreshReused {
+			log.Printf("WARNING: refresh token reuse for user '%v', revoking session '%v'", rec.userID, rec.family)
+			proxy.audit(r, "token.refresh", rec.family, "reuse", "session revoked")
+			proxy.endSession(r, rec.family, "refresh reuse")
+		}
+		if err != nil {
+			proxy.Metrics.inc(metricAuth, "method", "refresh", "outcome", "failure")
+			unsetRefresh(w)
+			proxy.writeError(w, r, http.StatusUnauthorized, err.Error())
+			return
+		}
+
+		user, err := proxy.Database.findUserByID(rec.userID)
+		if err != nil {
+			proxy.Metrics.inc(metricAuth, "method", "refresh", "outcome", "failure")
+			proxy.refresh.revoke(rec.family)
+			unsetRefresh(w)
+			proxy.writeError(w, r, http.StatusUnauthorized, badAuthMsg)
+			return
+		}
+
+		proxy.Metrics.inc(metricAuth, "method", "refresh", "outcome", "success")
+		writeLogin(user, rec.family, nil)
+		return
+	}
+
 	// AUTH BY TOKEN
 
 	if params.Token != "" {
-		valid, err := isValidAuthToken(params.Token)
+		valid, err := proxy.isValidAuthToken(params.Token)
 		if err != nil {
 			log.Printf("Auth validity check: %v", err)
 		}
 
+		if valid {
+			viewer, _ := proxy.decodeAuthToken(params.Token)
+			rec := accessRecordFrom(r.Context())
+			if err := proxy.sessions.touch(viewer.Id, rec.RemoteAddr, r.UserAgent()); err != nil {
+				valid = false
+			}
+		}
+
 		if !valid {
-			writeError(w, http.StatusUnauthorized, err.Error())
+			proxy.Metrics.inc(metricAuth, "method", "token", "outcome", "failure")
+			proxy.writeError(w, r, http.StatusUnauthorized, badAuthMsg)
 			return
 		}
 
-		writeParams(authRequest{Token: params.Token})
+		proxy.Metrics.inc(metricAuth, "method", "token", "outcome", "success")
+
+		writeParams(authRequest{Token: proxy.setAuth(w, params.Token)})
 		return
 	}
 
 	// AUTH BY USER/PASS
 
+	account, ip := accountKey(params.Email), ipKey(proxy.clientIP(r).String())
+	if proxy.throttled(w, r, account, ip) {
+		proxy.Metrics.inc(metricAuth, "method", "password", "outcome", "throttled")
+		return
+	}
+
+	// Whatever the reason (no such user, disabled, wrong password), the
+	// answer is the same.
 	user, err := proxy.Database.findUser(params.Email, params.Password)
 	if err != nil {
-		writeError(w, http.StatusUnauthorized, err.Error())
+		proxy.Metrics.inc(metricAuth, "method", "password", "outcome", "failure")
+		proxy.loginFailed(r, account, ip)
+		proxy.audit(r, "auth.password", params.Email, "failure", "")
+		proxy.writeError(w, r, http.StatusUnauthorized, badLoginMsg)
 		return
 	}
 
-	token, err := makeAuthToken(user)
-	if err != nil {
-		writeError(w, http.StatusInternalServerError, "Can't construct token.")
+	proxy.throttle.succeed(account, ip)
+	accessRecordFrom(r.Context()).User = user.Email
+
+	proxy.Metrics.inc(metricAuth, "method", "password", "outcome", "success")
+
+	// With two-factor on (or required), the password only earns a
+	// challenge to present with a code (or to enroll with).
+	if user.TOTPEnabled || proxy.mfaRequired(user) {
+		challenge, err := proxy.challenges.issue(user.ID)
+		if err != nil {
+			proxy.writeError(w, r, http.StatusInternalServerError, "Can't construct challenge.")
+			return
+		}
+		proxy.audit(r, "auth.password", user.Email, "success", "second factor required")
+		writeParams(authRequest{
+			Email:          user.Email,
+			Challenge:      challenge,
+			MFARequired:    user.TOTPEnabled,
+			EnrollRequired: !user.TOTPEnabled,
+		})
 		return
 	}
 
-	writeParams(authRequest{Token: token, Email: params.Email})
+	proxy.audit(r, "auth.password", user.Email, "success", "")
+	writeLogin(user, mkUUID(), nil)
+}
+
+// startLogin issues the user's access and refresh tokens, setting them
+// as cookies (and the access token as the Authorization header).
+func (proxy ProxyServer) startLogin(w http.ResponseWriter, r *http.Request, user *User, family string) (string, string, error) {
+	token, err := proxy.makeAuthToken(user, family)
+	if err != nil {
+		return "", "", err
+	}
+
+	if viewer, err := proxy.decodeAuthToken(token); err == nil {
+		proxy.sessions.touch(viewer.Id, accessRecordFrom(r.Context()).RemoteAddr, r.UserAgent())
+	}
+
+	refresh, err := proxy.refresh.issue(user.ID, family, proxy.auth.refreshTTL)
+	if err != nil {
+		return "", "", err
+	}
+	proxy.sessions.extend(family, time.Now().Add(proxy.auth.refreshTTL))
+
+	proxy.setAuth(w, token)
+	proxy.setRefresh(w, refresh)
+	return token, refresh, nil
 }
 
 //-----------------------------------------------------------------------------
 // Implementation
 //-----------------------------------------------------------------------------
 
-func newCookie(token string) *http.Cookie {
-	threeDays := 259200
+func (proxy ProxyServer) newCookie(token string) *http.Cookie {
 	return &http.Cookie{
 		Path:     "/",
+		Domain:   proxy.auth.domain,
 		Name:     "authToken",
 		Value:    token,
-		MaxAge:   threeDays,
-		Secure:   false, // only send cookie if HTTPS
-		HttpOnly: true,  // clients can't see cookie
-		Unparsed: []string{"SameSite", "Strict"},
+		MaxAge:   int(proxy.auth.accessTTL.Seconds()),
+		Secure:   proxy.auth.secure, // only send cookie if HTTPS
+		HttpOnly: true,              // clients can't see cookie
+		SameSite: proxy.auth.sameSite,
 	}
 }
 
-func unsetCookie(w http.ResponseWriter) {
+func (proxy ProxyServer) unsetCookie(w http.ResponseWriter) {
 	before := time.Now().AddDate(-1, 0, 0)
 	unset := &http.Cookie{
 		Path:    "/",
+		Domain:  proxy.auth.domain,
 		Name:    "authToken",
 		Value:   "deleted",
 		MaxAge:  -1,
 		Expires: before,
 	}
 	http.SetCookie(w, unset)
+	proxy.unsetCSRF(w)
 }
 
-func checkAuth(w http.ResponseWriter, r *http.Request) (string, error) {
+func unsetRefresh(w http.ResponseWriter) {
+	for _, path := range []string{"/auth", "/logout"} {
+		http.SetCookie(w, &http.Cookie{Path: path, Name: refreshCookie, Value: "deleted", MaxAge: -1})
+	}
+}
+
+func (proxy ProxyServer) checkAuth(w http.ResponseWriter, r *http.Request) (string, error) {
+	_, span := startSpan(r.Context(), "auth.check", spanKindInternal)
+	defer span.finish()
 
 	authToken := r.Header.Get("Authorization")
 	if authToken != "" {
 		authToken = strings.Replace(authToken, "Bearer ", "", 1)
+
+		if isAPIToken(authToken) {
+			token, user, err := proxy.Database.apiTokens.authenticate(r, authToken, proxy.keys)
+			if err != nil {
+				span.fail(err.Error())
+				return "", err
+			}
+			accessRecordFrom(r.Context()).User = user.Email
+			return token, nil
+		}
 	} else {
 		c, err := r.Cookie("authToken")
 		if err == nil {
@@ -475,15 +971,30 @@ func checkAuth(w http.ResponseWriter, r *http.Request) (string, error) {
 		}
 	}
 
-	valid, err := isValidAuthToken(authToken)
+	valid, err := proxy.isValidAuthToken(authToken)
 	if err != nil {
+		span.fail(err.Error())
 		return "", err
 	}
 
 	if !valid {
+		span.fail("invalid authorization")
 		return "", errors.New("invalid authorization")
 	}
 
+	viewer, err := proxy.decodeAuthToken(authToken)
+	if err != nil {
+		span.fail(err.Error())
+		return "", err
+	}
+
+	rec := accessRecordFrom(r.Context())
+	if err := proxy.sessions.touch(viewer.Id, rec.RemoteAddr, r.UserAgent()); err != nil {
+		span.fail(err.Error())
+		return "", err
+	}
+
+	rec.User = viewer.Email
 	return authToken, nil
 }
 
@@ -503,17 +1014,107 @@ func removePathContext(req *http.Request) string {
 	return strings.Replace(path, "/"+context, "", 1)
 }
 
-func logRequest(r *http.Request) {
-	log.Printf("%v %v", r.Method, r.URL.Path)
+// backendPath is the (cleaned) path a backend sees, keeping any
+// trailing slash.
+func backendPath(req *http.Request) string {
+	p := removePathContext(req)
+	clean := path.Clean("/" + p)
+	if strings.HasSuffix(p, "/") && clean != "/" {
+		clean += "/"
+	}
+	return clean
 }
 
-func writeError(w http.ResponseWriter, status int, reason string) {
-	log.Printf("Error: [%v] %v", status, reason)
+// hasDotDot returns true if the (decoded) path has a ".." segment.
+func hasDotDot(p string) bool {
+	for _, segment := range strings.Split(p, "/") {
+		if segment == ".." {
+			return true
+		}
+	}
+	return false
+}
+
+// stickyKey returns the value used to keep a client on the same
+// upstream group: the authenticated user's ID, or failing that, a
+// random value stored in a cookie.
+func (proxy ProxyServer) stickyKey(w http.ResponseWriter, r *http.Request, token string) string {
+	if viewer, err := proxy.decodeAuthToken(token); err == nil && viewer.ID != "" {
+		return viewer.ID
+	}
+
+	if c, err := r.Cookie(stickyCookie); err == nil && c.Value != "" {
+		return c.Value
+	}
+
+	key := mkUUID()
+	http.SetCookie(w, &http.Cookie{Path: "/", Name: stickyCookie, Value: key, HttpOnly: true})
+	return key
+}
+
+// SplitList splits a comma separated list, dropping blank items.
+func SplitList(s string) []string {
+	result := make([]string, 0)
+	for _, item := range strings.Split(s, ",") {
+		if item = strings.TrimSpace(item); item != "" {
+			result = append(result, item)
+		}
+	}
+	return result
+}
+
+func writeJSON(w http.ResponseWriter, status int, data interface{}) {
+	buf := new(bytes.Buffer)
+	enc := json.NewEncoder(buf)
+	enc.SetEscapeHTML(false)
+	enc.SetIndent("", "  ")
+
+	if err := enc.Encode(data); err != nil {
+		log.Printf("ERROR: %v", err)
+		http.Error(w, "Unable to serialize response.", http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json; charset=utf-8")
 	w.WriteHeader(status)
-	w.Write([]byte(reason))
+	w.Write(buf.Bytes())
 }
 
-func setAuth(w http.ResponseWriter, token string) {
+// setAuth returns the token to the client, renewed if it's getting old
+// so that active users stay logged in. It returns the token it set, or
+// if it can't be renewed (see renewAuthToken), clears it and returns "".
+func (proxy ProxyServer) setAuth(w http.ResponseWriter, token string) string {
+	// Stand-ins for personal access tokens stay on the server.
+	if viewer, err := proxy.decodeAuthToken(token); err == nil && viewer.APIToken != "" {
+		return token
+	}
+
+	token, err := proxy.renewAuthToken(token)
+	if err != nil {
+		log.Printf("- not renewing token: %v", err)
+		proxy.unsetCookie(w)
+		return ""
+	}
 	w.Header().Set("Authorization", "Bearer "+token)
-	http.SetCookie(w, newCookie(token))
+	http.SetCookie(w, proxy.newCookie(token))
+	if viewer, err := proxy.decodeAuthToken(token); err == nil && viewer.Session != "" {
+		proxy.setCSRF(w, viewer.Session)
+	}
+	return token
+}
+
+// setRefresh stores the refresh token in a cookie only sent to /auth
+// (and /logout, to revoke it).
+func (proxy ProxyServer) setRefresh(w http.ResponseWriter, token string) {
+	for _, path := range []string{"/auth", "/logout"} {
+		http.SetCookie(w, &http.Cookie{
+			Path:     path,
+			Name:     refreshCookie,
+			Value:    token,
+			MaxAge:   int(proxy.auth.refreshTTL.Seconds()),
+			Secure:   proxy.auth.secure,
+			HttpOnly: true,
+			SameSite: http.SameSiteStrictMode,
+		})
+	}
 }
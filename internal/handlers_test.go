@@ -0,0 +1,153 @@
+//
+// Copyright (C) 2017 Keith Irwin
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU General Public License as published
+// by the Free Software Foundation, either version 3 of the License,
+// or (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU General Public License for more details.
+//
+// You should have received a copy of the GNU General Public License
+// along with this program.  If not, see <http://www.gnu.org/licenses/>.
+
+package internal
+
+import (
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+// newTestProxy returns a proxy with an in-memory user store, keeping
+// audit entries in memory.
+func newTestProxy(t *testing.T) ProxyServer {
+	t.Helper()
+	users, err := NewUserStore("")
+	if err != nil {
+		t.Fatal(err)
+	}
+	clients := NewClientHub(nil)
+	proxy := NewProxyServer("", "", "", NewDatabase(users), nil, clients, NewMaintenance(clients))
+	proxy.Audit = &AuditLog{out: ioutil.Discard}
+	return proxy
+}
+
+func TestPublicPathsAreClean(t *testing.T) {
+	seen := make(chan string, 10)
+	backend := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		seen <- r.URL.Path
+	}))
+	defer backend.Close()
+
+	proxy := newTestProxy(t)
+	proxy.AddRoute("api", strings.TrimPrefix(backend.URL, "http://"))
+	if err := proxy.Routes.SetPublic("api", false, []string{"/webhooks"}); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := proxy.Database.CreateUser("jo@example.com", "jo-password-1", []string{"user"}); err != nil {
+		t.Fatal(err)
+	}
+	token, _ := testLogin(t, proxy, "jo@example.com", "jo-password-1")
+
+	get := func(target, token string) int {
+		r := httptest.NewRequest("GET", target, nil)
+		if token != "" {
+			r.Header.Set("Authorization", "Bearer "+token)
+		}
+		w := httptest.NewRecorder()
+		proxy.ServeHTTP(w, r)
+		return w.Code
+	}
+
+	for _, c := range []struct {
+		target string
+		token  string
+		status int
+		path   string
+	}{
+		{"/api/webhooks/hook", "", http.StatusOK, "/webhooks/hook"},
+		{"/api//webhooks/./hook/", "", http.StatusOK, "/webhooks/hook/"},
+		{"/api/admin", "", http.StatusUnauthorized, ""},
+		{"/api/webhooks/../admin", "", http.StatusUnauthorized, ""},
+		{"/api/webhooks/%2e%2e/admin", "", http.StatusUnauthorized, ""},
+		{"/api/webhooks/..%2fadmin", "", http.StatusUnauthorized, ""},
+		{"/api/webhooks-extra", "", http.StatusUnauthorized, ""},
+		{"/api/webhooks/../admin", token, http.StatusBadRequest, ""},
+		{"/api/admin", token, http.StatusOK, "/admin"},
+	} {
+		if status := get(c.target, c.token); status != c.status {
+			t.Errorf("%v (token %v): got %v, want %v", c.target, c.token != "", status, c.status)
+			continue
+		}
+		if c.path == "" {
+			continue
+		}
+		if path := <-seen; path != c.path {
+			t.Errorf("%v: backend saw %q, want %q", c.target, path, c.path)
+		}
+	}
+	if len(seen) > 0 {
+		t.Errorf("backend saw %v unexpected requests", len(seen))
+	}
+}
+
+func TestHeadAnsweredAsGet(t *testing.T) {
+	proxy := newTestProxy(t)
+	if _, err := proxy.Database.CreateUser("kim@example.com", "kim-password-1", []string{"admin"}); err != nil {
+		t.Fatal(err)
+	}
+	token, _ := testLogin(t, proxy, "kim@example.com", "kim-password-1")
+
+	for _, target := range []string{"/admin/users", "/admin/audit", "/admin/audit/verify", "/admin/lockouts", "/sessions"} {
+		for _, method := range []string{"GET", "HEAD"} {
+			r := httptest.NewRequest(method, target, nil)
+			r.Header.Set("Authorization", "Bearer "+token)
+			w := httptest.NewRecorder()
+			proxy.ServeHTTP(w, r)
+			if w.Code != http.StatusOK {
+				t.Errorf("%v %v: got %v, want %v", method, target, w.Code, http.StatusOK)
+			}
+		}
+	}
+}
+
+func TestAccessTokenNotForwarded(t *testing.T) {
+	seen := make(chan string, 10)
+	backend := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		seen <- r.Header.Get("Authorization")
+	}))
+	defer backend.Close()
+
+	proxy := newTestProxy(t)
+	proxy.AddRoute("api", strings.TrimPrefix(backend.URL, "http://"))
+	if _, err := proxy.Database.CreateUser("lee@example.com", "lee-password-1", []string{"user"}); err != nil {
+		t.Fatal(err)
+	}
+	_, raw, err := proxy.Database.CreateAPIToken("lee@example.com", "ci", []string{"route:api"}, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	r := httptest.NewRequest("GET", "/api/things", nil)
+	r.Header.Set("Authorization", "Bearer "+raw)
+	w := httptest.NewRecorder()
+	proxy.ServeHTTP(w, r)
+	if w.Code != http.StatusOK {
+		t.Fatalf("got %v, want %v", w.Code, http.StatusOK)
+	}
+
+	auth := <-seen
+	if strings.Contains(auth, apiTokenPrefix) {
+		t.Fatalf("upstream saw the access token: %v", auth)
+	}
+	viewer, err := proxy.decodeAuthToken(strings.TrimPrefix(auth, "Bearer "))
+	if err != nil || viewer.Email != "lee@example.com" {
+		t.Errorf("upstream got %q (%v), want a token for lee@example.com", auth, err)
+	}
+}
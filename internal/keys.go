@@ -0,0 +1,422 @@
+//
+// Copyright (C) 2017 Keith Irwin
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU General Public License as published
+// by the Free Software Foundation, either version 3 of the License,
+// or (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU General Public License for more details.
+//
+// You should have received a copy of the GNU General Public License
+// along with this program.  If not, see <http://www.gnu.org/licenses/>.
+
+package internal
+
+import (
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/ed25519"
+	"crypto/elliptic"
+	"crypto/rsa"
+	"crypto/sha256"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/pem"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"log"
+	"math/big"
+	"net/http"
+	"os"
+	"strings"
+	"sync"
+
+	jwt "github.com/dgrijalva/jwt-go"
+)
+
+//-----------------------------------------------------------------------------
+// Token signing keys. One key signs new tokens; any number of others
+// (such as the previous signing key) still verify tokens issued with
+// them, found by the token's `kid` header. Public halves of asymmetric
+// keys are published at /.well-known/jwks.json so backends can verify
+// tokens themselves.
+//-----------------------------------------------------------------------------
+
+const jwksPath = "/.well-known/jwks.json"
+
+type signingKey struct {
+	ID      string
+	Method  jwt.SigningMethod
+	private interface{}
+	public  interface{}
+}
+
+// KeyRing holds the signing key and the keys accepted for verification.
+type KeyRing struct {
+	mutex   sync.RWMutex
+	signing *signingKey
+	keys    map[string]*signingKey
+	order   []string
+}
+
+// defaultKeyRing signs with the built-in development secret, which is
+// fine for exploring, but not for anything else.
+func defaultKeyRing() *KeyRing {
+	key, err := newSigningKey(signingSecret)
+	if err != nil {
+		log.Fatalf("Unable to make default signing key: %v", err)
+	}
+	return newKeyRing(key)
+}
+
+func newKeyRing(signing *signingKey, verify ...*signingKey) *KeyRing {
+	ring := &KeyRing{signing: signing, keys: make(map[string]*signingKey)}
+	for _, key := range append([]*signingKey{signing}, verify...) {
+		if _, ok := ring.keys[key.ID]; !ok {
+			ring.keys[key.ID] = key
+			ring.order = append(ring.order, key.ID)
+		}
+	}
+	return ring
+}
+
+// LoadKeyRing reads the signing key and any extra verification keys.
+// Each source is a file path or "env:NAME" for an environment variable,
+// holding either a PEM key (RSA, P-256 or Ed25519; a public key can
+// only verify) or a raw HMAC secret.
+func LoadKeyRing(signing string, verify []string) (*KeyRing, error) {
+	signer, err := loadSigningKey(signing)
+	if err != nil {
+		return nil, err
+	}
+	if signer.private == nil {
+		return nil, fmt.Errorf("signing key '%v' is a public key", signing)
+	}
+
+	others := make([]*signingKey, 0, len(verify))
+	for _, source := range verify {
+		if source = strings.TrimSpace(source); source == "" {
+			continue
+		}
+		key, err := loadSigningKey(source)
+		if err != nil {
+			return nil, err
+		}
+		others = append(others, key)
+	}
+
+	return newKeyRing(signer, others...), nil
+}
+
+func loadSigningKey(source string) (*signingKey, error) {
+	data, err := readSecret(source)
+	if err != nil {
+		return nil, err
+	}
+
+	key, err := newSigningKey(data)
+	if err != nil {
+		return nil, fmt.Errorf("key '%v': %v", source, err)
+	}
+	return key, nil
+}
+
+// readSecret reads a file, or with "env:NAME", an environment variable.
+func readSecret(source string) ([]byte, error) {
+	if strings.HasPrefix(source, "env:") {
+		name := strings.TrimPrefix(source, "env:")
+		data := []byte(os.Getenv(name))
+		if len(data) == 0 {
+			return nil, fmt.Errorf("environment variable '%v' is empty", name)
+		}
+		return data, nil
+	}
+	return ioutil.ReadFile(source)
+}
+
+func newSigningKey(data []byte) (*signingKey, error) {
+	block, _ := pem.Decode(data)
+	if block == nil {
+		secret := []byte(strings.TrimSpace(string(data)))
+		if len(secret) == 0 {
+			return nil, errors.New("empty secret")
+		}
+		sum := sha256.Sum256(append([]byte("kid:"), secret...))
+		return &signingKey{
+			ID:      "hs-" + hex.EncodeToString(sum[:6]),
+			Method:  jwt.SigningMethodHS256,
+			private: secret,
+			public:  secret,
+		}, nil
+	}
+
+	var private, public interface{}
+	var err error
+
+	switch block.Type {
+	case "RSA PRIVATE KEY":
+		private, err = x509.ParsePKCS1PrivateKey(block.Bytes)
+	case "EC PRIVATE KEY":
+		private, err = x509.ParseECPrivateKey(block.Bytes)
+	case "PRIVATE KEY":
+		private, err = x509.ParsePKCS8PrivateKey(block.Bytes)
+	case "PUBLIC KEY":
+		public, err = x509.ParsePKIXPublicKey(block.Bytes)
+	default:
+		err = fmt.Errorf("unsupported PEM block '%v'", block.Type)
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	if private != nil {
+		public = private.(crypto.Signer).Public()
+	}
+
+	var method jwt.SigningMethod
+	switch k := public.(type) {
+	case *rsa.PublicKey:
+		method = jwt.SigningMethodRS256
+	case *ecdsa.PublicKey:
+		if k.Curve != elliptic.P256() {
+			return nil, errors.New("only P-256 EC keys are supported")
+		}
+		method = jwt.SigningMethodES256
+	case ed25519.PublicKey:
+		method = signingMethodEdDSA
+		// The signer wants the key itself, not a pointer.
+		if p, ok := private.(*ed25519.PrivateKey); ok {
+			private = *p
+		}
+	default:
+		return nil, fmt.Errorf("unsupported key type %T", public)
+	}
+
+	der, err := x509.MarshalPKIXPublicKey(public)
+	if err != nil {
+		return nil, err
+	}
+	sum := sha256.Sum256(der)
+
+	return &signingKey{
+		ID:      hex.EncodeToString(sum[:8]),
+		Method:  method,
+		private: private,
+		public:  public,
+	}, nil
+}
+
+//-----------------------------------------------------------------------------
+
+func (ring *KeyRing) sign(claims jwt.Claims) (string, error) {
+	ring.mutex.RLock()
+	key := ring.signing
+	ring.mutex.RUnlock()
+
+	token := jwt.NewWithClaims(key.Method, claims)
+	token.Header["kid"] = key.ID
+	return token.SignedString(key.private)
+}
+
+// keyFunc finds the verification key for a token by its kid, refusing
+// any mismatch between the token's alg and the key's. Tokens without a
+// kid (issued before keys were configurable) are checked against the
+// first key of the same alg.
+func (ring *KeyRing) keyFunc(token *jwt.Token) (interface{}, error) {
+	ring.mutex.RLock()
+	defer ring.mutex.RUnlock()
+
+	var key *signingKey
+	if kid, ok := token.Header["kid"].(string); ok {
+		key = ring.keys[kid]
+	} else {
+		for _, id := range ring.order {
+			if ring.keys[id].Method.Alg() == token.Method.Alg() {
+				key = ring.keys[id]
+				break
+			}
+		}
+	}
+
+	if key == nil {
+		return nil, fmt.Errorf("unknown signing key")
+	}
+
+	if key.Method.Alg() != token.Method.Alg() {
+		return nil, fmt.Errorf(badSignMsg, token.Header["alg"])
+	}
+
+	return key.public, nil
+}
+
+type jwk struct {
+	Kty string `json:"kty"`
+	Use string `json:"use"`
+	Alg string `json:"alg"`
+	Kid string `json:"kid"`
+	N   string `json:"n,omitempty"`
+	E   string `json:"e,omitempty"`
+	Crv string `json:"crv,omitempty"`
+	X   string `json:"x,omitempty"`
+	Y   string `json:"y,omitempty"`
+}
+
+func b64(b []byte) string {
+	return base64.RawURLEncoding.EncodeToString(b)
+}
+
+// jwks lists the public keys. HMAC secrets are never published.
+func (ring *KeyRing) jwks() []jwk {
+	ring.mutex.RLock()
+	defer ring.mutex.RUnlock()
+
+	keys := make([]jwk, 0, len(ring.order))
+	for _, id := range ring.order {
+		key := ring.keys[id]
+		k := jwk{Use: "sig", Alg: key.Method.Alg(), Kid: key.ID}
+
+		switch pub := key.public.(type) {
+		case *rsa.PublicKey:
+			k.Kty = "RSA"
+			k.N = b64(pub.N.Bytes())
+			k.E = b64(big.NewInt(int64(pub.E)).Bytes())
+		case *ecdsa.PublicKey:
+			size := (pub.Curve.Params().BitSize + 7) / 8
+			k.Kty = "EC"
+			k.Crv = "P-256"
+			k.X = b64(pad(pub.X.Bytes(), size))
+			k.Y = b64(pad(pub.Y.Bytes(), size))
+		case ed25519.PublicKey:
+			k.Kty = "OKP"
+			k.Crv = "Ed25519"
+			k.X = b64(pub)
+		default:
+			continue
+		}
+
+		keys = append(keys, k)
+	}
+	return keys
+}
+
+// publicKey decodes a published key (such as an identity provider's)
+// and the method it verifies.
+func (k jwk) publicKey() (interface{}, jwt.SigningMethod, error) {
+	decode := func(s string) (*big.Int, error) {
+		b, err := base64.RawURLEncoding.DecodeString(s)
+		if err != nil {
+			return nil, err
+		}
+		return new(big.Int).SetBytes(b), nil
+	}
+
+	switch {
+	case k.Kty == "RSA":
+		n, err := decode(k.N)
+		if err != nil {
+			return nil, nil, err
+		}
+		e, err := decode(k.E)
+		if err != nil {
+			return nil, nil, err
+		}
+		return &rsa.PublicKey{N: n, E: int(e.Int64())}, jwt.SigningMethodRS256, nil
+
+	case k.Kty == "EC" && k.Crv == "P-256":
+		x, err := decode(k.X)
+		if err != nil {
+			return nil, nil, err
+		}
+		y, err := decode(k.Y)
+		if err != nil {
+			return nil, nil, err
+		}
+		return &ecdsa.PublicKey{Curve: elliptic.P256(), X: x, Y: y}, jwt.SigningMethodES256, nil
+
+	case k.Kty == "OKP" && k.Crv == "Ed25519":
+		x, err := base64.RawURLEncoding.DecodeString(k.X)
+		if err != nil {
+			return nil, nil, err
+		}
+		if len(x) != ed25519.PublicKeySize {
+			return nil, nil, errors.New("bad Ed25519 key size")
+		}
+		return ed25519.PublicKey(x), signingMethodEdDSA, nil
+	}
+
+	return nil, nil, fmt.Errorf("unsupported key type '%v %v'", k.Kty, k.Crv)
+}
+
+func pad(b []byte, size int) []byte {
+	if len(b) >= size {
+		return b
+	}
+	return append(make([]byte, size-len(b)), b...)
+}
+
+// SetKeyRing makes ring the source of keys for signing and verifying
+// auth tokens.
+func (proxy ProxyServer) SetKeyRing(ring *KeyRing) {
+	ring.mutex.RLock()
+	signing, keys, order := ring.signing, ring.keys, ring.order
+	ring.mutex.RUnlock()
+
+	proxy.keys.mutex.Lock()
+	proxy.keys.signing, proxy.keys.keys, proxy.keys.order = signing, keys, order
+	proxy.keys.mutex.Unlock()
+
+	log.Printf("- signing tokens with %v key '%v' (%v keys accepted)",
+		signing.Method.Alg(), signing.ID, len(keys))
+}
+
+func (proxy ProxyServer) handleJWKS(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Cache-Control", "public, max-age=300")
+	writeJSON(w, http.StatusOK, map[string][]jwk{"keys": proxy.keys.jwks()})
+}
+
+//-----------------------------------------------------------------------------
+// EdDSA (Ed25519) for jwt-go, which only knows HMAC, RSA and ECDSA.
+//-----------------------------------------------------------------------------
+
+type signingMethodEd25519 struct{}
+
+var signingMethodEdDSA = &signingMethodEd25519{}
+
+func init() {
+	jwt.RegisterSigningMethod(signingMethodEdDSA.Alg(), func() jwt.SigningMethod {
+		return signingMethodEdDSA
+	})
+}
+
+func (m *signingMethodEd25519) Alg() string {
+	return "EdDSA"
+}
+
+func (m *signingMethodEd25519) Verify(signingString, signature string, key interface{}) error {
+	public, ok := key.(ed25519.PublicKey)
+	if !ok {
+		return jwt.ErrInvalidKeyType
+	}
+	sig, err := jwt.DecodeSegment(signature)
+	if err != nil {
+		return err
+	}
+	if !ed25519.Verify(public, []byte(signingString), sig) {
+		return jwt.ErrSignatureInvalid
+	}
+	return nil
+}
+
+func (m *signingMethodEd25519) Sign(signingString string, key interface{}) (string, error) {
+	private, ok := key.(ed25519.PrivateKey)
+	if !ok {
+		return "", jwt.ErrInvalidKeyType
+	}
+	return jwt.EncodeSegment(ed25519.Sign(private, []byte(signingString))), nil
+}
@@ -0,0 +1,687 @@
+//
+// Copyright (C) 2017 Keith Irwin
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU General Public License as published
+// by the Free Software Foundation, either version 3 of the License,
+// or (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU General Public License for more details.
+//
+// You should have received a copy of the GNU General Public License
+// along with this program.  If not, see <http://www.gnu.org/licenses/>.
+
+package internal
+
+import (
+	"bufio"
+	"bytes"
+	"crypto/tls"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/url"
+	"os"
+	"strings"
+	"time"
+)
+
+//-----------------------------------------------------------------------------
+// Password logins checked against an LDAP directory (or Active
+// Directory): find the user's entry with a service account, bind as
+// them to check the password, then look up their groups for roles.
+// Directory users get a local account on first login.
+//-----------------------------------------------------------------------------
+
+// LDAPSettings describe the directory and how its users map to local
+// ones. In filters, {login} is the name typed at login and {dn} is the
+// user's entry, both escaped.
+type LDAPSettings struct {
+	URL          string // ldap://host:389 or ldaps://host:636
+	StartTLS     bool
+	Insecure     bool   // skip TLS certificate checks (test directories only)
+	BindDN       string // service account; empty to search anonymously
+	BindPassword string // or env:NAME
+	BaseDN       string
+	UserFilter   string // e.g. (&(objectClass=person)(|(uid={login})(mail={login})))
+	EmailAttr    string // e.g. mail
+	GroupBaseDN  string // default BaseDN
+	GroupFilter  string // e.g. (member={dn}); empty to skip groups
+	GroupAttr    string // e.g. cn
+	RoleMap      map[string]string
+	DefaultRoles []string
+	Timeout      time.Duration
+}
+
+type ldapAuthenticator struct {
+	settings LDAPSettings
+	tls      *tls.Config
+	address  string
+	secure   bool
+}
+
+// NewLDAPAuthenticator returns an authenticator checking passwords
+// against the directory.
+func NewLDAPAuthenticator(settings LDAPSettings) (Authenticator, error) {
+	u, err := url.Parse(settings.URL)
+	if err != nil {
+		return nil, err
+	}
+
+	a := &ldapAuthenticator{settings: settings, address: u.Host}
+	switch u.Scheme {
+	case "ldap":
+		if u.Port() == "" {
+			a.address = net.JoinHostPort(u.Hostname(), "389")
+		}
+	case "ldaps":
+		a.secure = true
+		if u.Port() == "" {
+			a.address = net.JoinHostPort(u.Hostname(), "636")
+		}
+	default:
+		return nil, fmt.Errorf("LDAP URL must be ldap:// or ldaps://, not '%v'", settings.URL)
+	}
+
+	if settings.BaseDN == "" || settings.UserFilter == "" {
+		return nil, errors.New("LDAP needs a base DN and a user filter")
+	}
+
+	for _, filter := range []string{settings.UserFilter, settings.GroupFilter} {
+		if filter == "" {
+			continue
+		}
+		if _, err := parseLDAPFilter(strings.NewReplacer("{login}", "x", "{dn}", "x").Replace(filter)); err != nil {
+			return nil, fmt.Errorf("filter '%v': %v", filter, err)
+		}
+	}
+
+	if strings.HasPrefix(settings.BindPassword, "env:") {
+		a.settings.BindPassword = os.Getenv(strings.TrimPrefix(settings.BindPassword, "env:"))
+	}
+	if a.settings.GroupBaseDN == "" {
+		a.settings.GroupBaseDN = settings.BaseDN
+	}
+	if a.settings.Timeout == 0 {
+		a.settings.Timeout = 10 * time.Second
+	}
+
+	a.tls = &tls.Config{ServerName: u.Hostname(), InsecureSkipVerify: settings.Insecure}
+	return a, nil
+}
+
+func (a *ldapAuthenticator) Name() string {
+	return "ldap"
+}
+
+// Authenticate looks the login up in the directory and binds as the
+// entry found.
+func (a *ldapAuthenticator) Authenticate(db *Database, login, password string) (*User, error) {
+	// An empty password is an "unauthenticated bind", which many
+	// directories accept for any DN.
+	if login == "" || password == "" {
+		return nil, errUserNotFound
+	}
+
+	conn, err := a.connect()
+	if err != nil {
+		return nil, err
+	}
+	defer conn.close()
+
+	s := a.settings
+	if err := conn.bind(s.BindDN, s.BindPassword); err != nil {
+		return nil, fmt.Errorf("service bind: %v", err)
+	}
+
+	filter := strings.Replace(s.UserFilter, "{login}", ldapEscape(login), -1)
+	entries, err := conn.search(s.BaseDN, filter, []string{s.EmailAttr}, 2)
+	if err != nil {
+		return nil, err
+	}
+	if len(entries) != 1 {
+		return nil, errUserNotFound
+	}
+	entry := entries[0]
+
+	if err := conn.bind(entry.dn, password); err != nil {
+		if err == errLDAPInvalidCredentials {
+			return nil, errUserNotFound
+		}
+		return nil, err
+	}
+
+	email := entry.first(s.EmailAttr)
+	if email == "" && strings.Contains(login, "@") {
+		email = login
+	}
+	if email == "" {
+		return nil, fmt.Errorf("entry '%v' has no %v", entry.dn, s.EmailAttr)
+	}
+
+	var roles []string
+	if s.GroupFilter != "" {
+		// Back to the service account, which can usually see more.
+		if err := conn.bind(s.BindDN, s.BindPassword); err != nil {
+			return nil, fmt.Errorf("service bind: %v", err)
+		}
+		filter := strings.Replace(s.GroupFilter, "{dn}", ldapEscape(entry.dn), -1)
+		groups, err := conn.search(s.GroupBaseDN, filter, []string{s.GroupAttr}, 0)
+		if err != nil {
+			return nil, err
+		}
+		roles = a.roles(groups)
+	}
+
+	return db.provisionUser("ldap:"+entry.dn, email, roles, s.DefaultRoles)
+}
+
+// roles maps group names to local roles, returning nil if none map,
+// so new accounts get the default roles and existing ones keep theirs.
+func (a *ldapAuthenticator) roles(groups []*ldapEntry) []string {
+	var roles []string
+	seen := make(map[string]bool)
+	for _, group := range groups {
+		for _, name := range group.attrs[strings.ToLower(a.settings.GroupAttr)] {
+			role := name
+			if len(a.settings.RoleMap) > 0 {
+				role = a.settings.RoleMap[name]
+			}
+			if role != "" && !seen[role] {
+				seen[role] = true
+				roles = append(roles, role)
+			}
+		}
+	}
+	return roles
+}
+
+func (a *ldapAuthenticator) connect() (*ldapConn, error) {
+	dialer := &net.Dialer{Timeout: a.settings.Timeout}
+
+	var raw net.Conn
+	var err error
+	if a.secure {
+		raw, err = tls.DialWithDialer(dialer, "tcp", a.address, a.tls)
+	} else {
+		raw, err = dialer.Dial("tcp", a.address)
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	raw.SetDeadline(time.Now().Add(a.settings.Timeout))
+	conn := newLDAPConn(raw, a.settings.Timeout)
+
+	if a.settings.StartTLS && !a.secure {
+		if err := conn.startTLS(a.tls); err != nil {
+			raw.Close()
+			return nil, fmt.Errorf("StartTLS: %v", err)
+		}
+	}
+	return conn, nil
+}
+
+//-----------------------------------------------------------------------------
+// Just enough of LDAPv3 (RFC 4511) for the above: simple bind, search,
+// StartTLS and unbind, over hand-rolled BER.
+//-----------------------------------------------------------------------------
+
+const (
+	ldapBindRequest      = 0x60
+	ldapBindResponse     = 0x61
+	ldapUnbindRequest    = 0x42
+	ldapSearchRequest    = 0x63
+	ldapSearchEntry      = 0x64
+	ldapSearchDone       = 0x65
+	ldapSearchReference  = 0x73
+	ldapExtendedRequest  = 0x77
+	ldapExtendedResponse = 0x78
+
+	ldapStartTLSOID = "1.3.6.1.4.1.1466.20037"
+
+	ldapSuccess            = 0
+	ldapInvalidCredentials = 49
+)
+
+var errLDAPInvalidCredentials = errors.New("invalid credentials")
+
+type ldapEntry struct {
+	dn    string
+	attrs map[string][]string // by lower case name
+}
+
+func (e *ldapEntry) first(attr string) string {
+	if values := e.attrs[strings.ToLower(attr)]; len(values) > 0 {
+		return values[0]
+	}
+	return ""
+}
+
+type ldapConn struct {
+	conn    net.Conn
+	reader  *bufio.Reader
+	nextID  int64
+	timeout time.Duration
+}
+
+func newLDAPConn(conn net.Conn, timeout time.Duration) *ldapConn {
+	return &ldapConn{conn: conn, reader: bufio.NewReader(conn), timeout: timeout}
+}
+
+func (c *ldapConn) close() {
+	c.send(berPrimitive(ldapUnbindRequest, nil))
+	c.conn.Close()
+}
+
+func (c *ldapConn) send(op *berElement) (int64, error) {
+	c.nextID++
+	msg := berSequence(berInteger(c.nextID), op)
+	_, err := c.conn.Write(msg.encode())
+	return c.nextID, err
+}
+
+// receive reads the next message for id, returning its operation.
+func (c *ldapConn) receive(id int64) (*berElement, error) {
+	for {
+		msg, err := readBER(c.reader)
+		if err != nil {
+			return nil, err
+		}
+		if len(msg.children) < 2 {
+			return nil, errors.New("malformed LDAP message")
+		}
+		if msg.children[0].int() == id {
+			return msg.children[1], nil
+		}
+	}
+}
+
+// ldapResult checks an LDAPResult: resultCode, matchedDN, diagnosticMessage.
+func ldapResult(op *berElement, tag byte) error {
+	if op.tag != tag || len(op.children) < 3 {
+		return fmt.Errorf("unexpected LDAP response 0x%x", op.tag)
+	}
+	switch code := op.children[0].int(); code {
+	case ldapSuccess:
+		return nil
+	case ldapInvalidCredentials:
+		return errLDAPInvalidCredentials
+	default:
+		return fmt.Errorf("LDAP result %v: %s", code, op.children[2].value)
+	}
+}
+
+func (c *ldapConn) bind(dn, password string) error {
+	id, err := c.send(berConstructed(ldapBindRequest,
+		berInteger(3),
+		berString(dn),
+		berPrimitive(0x80, []byte(password))))
+	if err != nil {
+		return err
+	}
+
+	op, err := c.receive(id)
+	if err != nil {
+		return err
+	}
+	return ldapResult(op, ldapBindResponse)
+}
+
+func (c *ldapConn) search(base, filter string, attrs []string, limit int64) ([]*ldapEntry, error) {
+	f, err := parseLDAPFilter(filter)
+	if err != nil {
+		return nil, err
+	}
+
+	wanted := make([]*berElement, 0, len(attrs))
+	for _, attr := range attrs {
+		if attr != "" {
+			wanted = append(wanted, berString(attr))
+		}
+	}
+
+	id, err := c.send(berConstructed(ldapSearchRequest,
+		berString(base),
+		berEnumerated(2), // whole subtree
+		berEnumerated(0), // never dereference aliases
+		berInteger(limit),
+		berInteger(int64(c.timeout.Seconds())),
+		berBoolean(false),
+		f,
+		berSequence(wanted...)))
+	if err != nil {
+		return nil, err
+	}
+
+	var entries []*ldapEntry
+	for {
+		op, err := c.receive(id)
+		if err != nil {
+			return nil, err
+		}
+
+		switch op.tag {
+		case ldapSearchEntry:
+			if len(op.children) < 2 {
+				return nil, errors.New("malformed search entry")
+			}
+			entry := &ldapEntry{dn: string(op.children[0].value), attrs: make(map[string][]string)}
+			for _, attr := range op.children[1].children {
+				if len(attr.children) < 2 {
+					continue
+				}
+				name := strings.ToLower(string(attr.children[0].value))
+				for _, v := range attr.children[1].children {
+					entry.attrs[name] = append(entry.attrs[name], string(v.value))
+				}
+			}
+			entries = append(entries, entry)
+		case ldapSearchReference:
+			// Referrals to other servers aren't followed.
+		case ldapSearchDone:
+			if err := ldapResult(op, ldapSearchDone); err != nil {
+				return nil, err
+			}
+			return entries, nil
+		default:
+			return nil, fmt.Errorf("unexpected LDAP response 0x%x", op.tag)
+		}
+	}
+}
+
+func (c *ldapConn) startTLS(config *tls.Config) error {
+	id, err := c.send(berConstructed(ldapExtendedRequest,
+		berPrimitive(0x80, []byte(ldapStartTLSOID))))
+	if err != nil {
+		return err
+	}
+
+	op, err := c.receive(id)
+	if err != nil {
+		return err
+	}
+	if err := ldapResult(op, ldapExtendedResponse); err != nil {
+		return err
+	}
+
+	secure := tls.Client(c.conn, config)
+	if err := secure.Handshake(); err != nil {
+		return err
+	}
+	c.conn = secure
+	c.reader = bufio.NewReader(secure)
+	return nil
+}
+
+// ldapEscape escapes a value for use in a filter (RFC 4515), so a login
+// like "*)(uid=*" can't change the filter's meaning.
+func ldapEscape(s string) string {
+	var b strings.Builder
+	for i := 0; i < len(s); i++ {
+		switch c := s[i]; c {
+		case '*', '(', ')', '\\', 0:
+			fmt.Fprintf(&b, "\\%02x", c)
+		default:
+			b.WriteByte(c)
+		}
+	}
+	return b.String()
+}
+
+// parseLDAPFilter turns a string filter into BER. It knows &, |, !,
+// equality, and presence (attr=*), which is all logins need.
+func parseLDAPFilter(filter string) (*berElement, error) {
+	f, rest, err := parseFilterItem(strings.TrimSpace(filter))
+	if err != nil {
+		return nil, err
+	}
+	if rest != "" {
+		return nil, fmt.Errorf("unexpected '%v'", rest)
+	}
+	return f, nil
+}
+
+func parseFilterItem(s string) (*berElement, string, error) {
+	if !strings.HasPrefix(s, "(") {
+		return nil, "", errors.New("filter must start with '('")
+	}
+	s = s[1:]
+
+	if s == "" {
+		return nil, "", errors.New("unterminated filter")
+	}
+
+	switch s[0] {
+	case '&', '|':
+		tag := byte(0xa0)
+		if s[0] == '|' {
+			tag = 0xa1
+		}
+		s = s[1:]
+		var items []*berElement
+		for strings.HasPrefix(s, "(") {
+			item, rest, err := parseFilterItem(s)
+			if err != nil {
+				return nil, "", err
+			}
+			items = append(items, item)
+			s = rest
+		}
+		if !strings.HasPrefix(s, ")") {
+			return nil, "", errors.New("unterminated filter")
+		}
+		return berConstructed(tag, items...), s[1:], nil
+
+	case '!':
+		item, rest, err := parseFilterItem(s[1:])
+		if err != nil {
+			return nil, "", err
+		}
+		if !strings.HasPrefix(rest, ")") {
+			return nil, "", errors.New("unterminated filter")
+		}
+		return berConstructed(0xa2, item), rest[1:], nil
+	}
+
+	end := strings.Index(s, ")")
+	if end < 0 {
+		return nil, "", errors.New("unterminated filter")
+	}
+	item, rest := s[:end], s[end+1:]
+
+	eq := strings.Index(item, "=")
+	if eq < 1 {
+		return nil, "", fmt.Errorf("bad filter item '%v'", item)
+	}
+	attr, value := item[:eq], item[eq+1:]
+	if strings.ContainsAny(attr, "<>~:") {
+		return nil, "", fmt.Errorf("unsupported filter item '%v'", item)
+	}
+
+	if value == "*" {
+		return berPrimitive(0x87, []byte(attr)), rest, nil
+	}
+	if strings.Contains(value, "*") {
+		return nil, "", fmt.Errorf("substring filters aren't supported: '%v'", item)
+	}
+
+	unescaped, err := ldapUnescape(value)
+	if err != nil {
+		return nil, "", err
+	}
+	return berConstructed(0xa3, berString(attr), berString(unescaped)), rest, nil
+}
+
+func ldapUnescape(s string) (string, error) {
+	var b strings.Builder
+	for i := 0; i < len(s); i++ {
+		if s[i] != '\\' {
+			b.WriteByte(s[i])
+			continue
+		}
+		if i+2 >= len(s) {
+			return "", fmt.Errorf("bad escape in '%v'", s)
+		}
+		c, err := hex.DecodeString(s[i+1 : i+3])
+		if err != nil {
+			return "", fmt.Errorf("bad escape in '%v'", s)
+		}
+		b.Write(c)
+		i += 2
+	}
+	return b.String(), nil
+}
+
+//-----------------------------------------------------------------------------
+// BER: tag, length, contents. Constructed elements (tag bit 0x20)
+// contain more elements.
+//-----------------------------------------------------------------------------
+
+const berMaxLength = 1 << 24
+
+// LDAP responses nest a handful of levels; anything deeper is hostile.
+const berMaxDepth = 32
+
+type berElement struct {
+	tag      byte
+	value    []byte
+	children []*berElement
+}
+
+func berPrimitive(tag byte, value []byte) *berElement {
+	return &berElement{tag: tag, value: value}
+}
+
+func berConstructed(tag byte, children ...*berElement) *berElement {
+	return &berElement{tag: tag | 0x20, children: children}
+}
+
+func berSequence(children ...*berElement) *berElement {
+	return berConstructed(0x30, children...)
+}
+
+func berString(s string) *berElement {
+	return berPrimitive(0x04, []byte(s))
+}
+
+func berBoolean(b bool) *berElement {
+	if b {
+		return berPrimitive(0x01, []byte{0xff})
+	}
+	return berPrimitive(0x01, []byte{0x00})
+}
+
+func berInteger(n int64) *berElement {
+	return berPrimitive(0x02, berIntBytes(n))
+}
+
+func berEnumerated(n int64) *berElement {
+	return berPrimitive(0x0a, berIntBytes(n))
+}
+
+// berIntBytes is the shortest two's complement form.
+func berIntBytes(n int64) []byte {
+	b := []byte{byte(n)}
+	for (n > 0x7f || n < -0x80) && len(b) < 8 {
+		n >>= 8
+		b = append([]byte{byte(n)}, b...)
+	}
+	return b
+}
+
+func (e *berElement) int() int64 {
+	var n int64
+	for i, b := range e.value {
+		if i == 0 && b&0x80 != 0 {
+			n = -1
+		}
+		n = n<<8 | int64(b)
+	}
+	return n
+}
+
+func (e *berElement) encode() []byte {
+	contents := e.value
+	if e.tag&0x20 != 0 {
+		contents = nil
+		for _, child := range e.children {
+			contents = append(contents, child.encode()...)
+		}
+	}
+
+	out := []byte{e.tag}
+	if n := len(contents); n < 0x80 {
+		out = append(out, byte(n))
+	} else {
+		var length []byte
+		for ; n > 0; n >>= 8 {
+			length = append([]byte{byte(n)}, length...)
+		}
+		out = append(out, 0x80|byte(len(length)))
+		out = append(out, length...)
+	}
+	return append(out, contents...)
+}
+
+func readBER(r io.Reader) (*berElement, error) {
+	return readBERAt(r, 0)
+}
+
+func readBERAt(r io.Reader, depth int) (*berElement, error) {
+	if depth > berMaxDepth {
+		return nil, errors.New("BER nested too deeply")
+	}
+
+	header := make([]byte, 2)
+	if _, err := io.ReadFull(r, header); err != nil {
+		return nil, err
+	}
+
+	length := int(header[1])
+	if length&0x80 != 0 {
+		size := length & 0x7f
+		if size == 0 || size > 3 {
+			return nil, errors.New("unsupported BER length")
+		}
+		buf := make([]byte, size)
+		if _, err := io.ReadFull(r, buf); err != nil {
+			return nil, err
+		}
+		length = 0
+		for _, b := range buf {
+			length = length<<8 | int(b)
+		}
+	}
+	if length > berMaxLength {
+		return nil, errors.New("BER element too large")
+	}
+
+	contents := make([]byte, length)
+	if _, err := io.ReadFull(r, contents); err != nil {
+		return nil, err
+	}
+	return parseBER(header[0], contents, depth)
+}
+
+func parseBER(tag byte, contents []byte, depth int) (*berElement, error) {
+	e := &berElement{tag: tag, value: contents}
+	if tag&0x20 == 0 {
+		return e, nil
+	}
+
+	r := bytes.NewReader(contents)
+	for r.Len() > 0 {
+		child, err := readBERAt(r, depth+1)
+		if err != nil {
+			return nil, err
+		}
+		e.children = append(e.children, child)
+	}
+	return e, nil
+}
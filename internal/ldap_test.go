@@ -0,0 +1,416 @@
+//
+// Copyright (C) 2017 Keith Irwin
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU General Public License as published
+// by the Free Software Foundation, either version 3 of the License,
+// or (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU General Public License for more details.
+//
+// You should have received a copy of the GNU General Public License
+// along with this program.  If not, see <http://www.gnu.org/licenses/>.
+
+package internal
+
+import (
+	"bytes"
+	"io"
+	"net"
+	"reflect"
+	"sort"
+	"strings"
+	"testing"
+	"time"
+)
+
+//-----------------------------------------------------------------------------
+// A directory just big enough to log in against, served in process.
+//-----------------------------------------------------------------------------
+
+type testDirectory struct {
+	passwords map[string]string              // by dn
+	entries   map[string]map[string][]string // by dn, attrs by lower case name
+}
+
+func newTestDirectory() *testDirectory {
+	return &testDirectory{
+		passwords: map[string]string{
+			"cn=reader,dc=example,dc=com":           "reader",
+			"uid=alice,ou=people,dc=example,dc=com": "alice1234",
+			"uid=bob,ou=people,dc=example,dc=com":   "bob12345",
+			"uid=carol,ou=people,dc=example,dc=com": "carol1234",
+		},
+		entries: map[string]map[string][]string{
+			"uid=alice,ou=people,dc=example,dc=com": {"objectclass": {"person"}, "uid": {"alice"}, "mail": {"alice@example.com"}},
+			"uid=bob,ou=people,dc=example,dc=com":   {"objectclass": {"person"}, "uid": {"bob"}, "mail": {"bob@example.com"}},
+			"uid=carol,ou=people,dc=example,dc=com": {"objectclass": {"person"}, "uid": {"carol"}, "mail": {"carol@example.com"}},
+			"cn=admins,ou=groups,dc=example,dc=com": {"cn": {"admins"}, "member": {"uid=alice,ou=people,dc=example,dc=com"}},
+			"cn=staff,ou=groups,dc=example,dc=com": {"cn": {"staff"}, "member": {
+				"uid=alice,ou=people,dc=example,dc=com", "uid=bob,ou=people,dc=example,dc=com"}},
+			"cn=contractors,ou=groups,dc=example,dc=com": {"cn": {"contractors"}, "member": {"uid=carol,ou=people,dc=example,dc=com"}},
+		},
+	}
+}
+
+func ldapTestResult(tag byte, code int64) *berElement {
+	return berConstructed(tag, berEnumerated(code), berString(""), berString(""))
+}
+
+func (dir *testDirectory) matches(attrs map[string][]string, filter *berElement) bool {
+	switch filter.tag {
+	case 0xa0:
+		for _, f := range filter.children {
+			if !dir.matches(attrs, f) {
+				return false
+			}
+		}
+		return true
+	case 0xa1:
+		for _, f := range filter.children {
+			if dir.matches(attrs, f) {
+				return true
+			}
+		}
+		return false
+	case 0xa2:
+		return !dir.matches(attrs, filter.children[0])
+	case 0x87:
+		return len(attrs[strings.ToLower(string(filter.value))]) > 0
+	case 0xa3:
+		for _, v := range attrs[strings.ToLower(string(filter.children[0].value))] {
+			if strings.EqualFold(v, string(filter.children[1].value)) {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// respond answers one request (bind or search) with its messages.
+func (dir *testDirectory) respond(op *berElement) []*berElement {
+	switch op.tag {
+	case ldapBindRequest:
+		dn, password := string(op.children[1].value), string(op.children[2].value)
+		if want, ok := dir.passwords[dn]; !ok || want != password || password == "" {
+			return []*berElement{ldapTestResult(ldapBindResponse, ldapInvalidCredentials)}
+		}
+		return []*berElement{ldapTestResult(ldapBindResponse, ldapSuccess)}
+
+	case ldapSearchRequest:
+		base, filter, wanted := string(op.children[0].value), op.children[6], op.children[7]
+		var result []*berElement
+		for dn, attrs := range dir.entries {
+			if !strings.HasSuffix(dn, base) || !dir.matches(attrs, filter) {
+				continue
+			}
+			var list []*berElement
+			for _, w := range wanted.children {
+				name := string(w.value)
+				var values []*berElement
+				for _, v := range attrs[strings.ToLower(name)] {
+					values = append(values, berString(v))
+				}
+				list = append(list, berSequence(berString(name), berConstructed(0x31, values...)))
+			}
+			result = append(result, berConstructed(ldapSearchEntry, berString(dn), berSequence(list...)))
+		}
+		return append(result, ldapTestResult(ldapSearchDone, ldapSuccess))
+	}
+	return []*berElement{ldapTestResult(op.tag+1, 2)}
+}
+
+// serveLDAP listens on a local port, answering each request with
+// whatever respond writes back, until the test ends.
+func serveLDAP(t *testing.T, respond func(id int64, op *berElement) []byte) string {
+	t.Helper()
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { listener.Close() })
+
+	go func() {
+		for {
+			conn, err := listener.Accept()
+			if err != nil {
+				return
+			}
+			go func(conn net.Conn) {
+				defer conn.Close()
+				for {
+					msg, err := readBER(conn)
+					if err != nil || len(msg.children) < 2 || msg.children[1].tag == ldapUnbindRequest {
+						return
+					}
+					if _, err := conn.Write(respond(msg.children[0].int(), msg.children[1])); err != nil {
+						return
+					}
+				}
+			}(conn)
+		}
+	}()
+
+	return listener.Addr().String()
+}
+
+func (dir *testDirectory) serve(t *testing.T) string {
+	return serveLDAP(t, func(id int64, op *berElement) []byte {
+		var out []byte
+		for _, reply := range dir.respond(op) {
+			out = append(out, berSequence(berInteger(id), reply).encode()...)
+		}
+		return out
+	})
+}
+
+func testLDAPSettings(addr string) LDAPSettings {
+	return LDAPSettings{
+		URL:          "ldap://" + addr,
+		BindDN:       "cn=reader,dc=example,dc=com",
+		BindPassword: "reader",
+		BaseDN:       "dc=example,dc=com",
+		UserFilter:   "(&(objectClass=person)(|(uid={login})(mail={login})))",
+		EmailAttr:    "mail",
+		GroupFilter:  "(member={dn})",
+		GroupAttr:    "cn",
+		RoleMap:      map[string]string{"admins": "admin", "staff": "user"},
+		DefaultRoles: []string{"guest"},
+		Timeout:      2 * time.Second,
+	}
+}
+
+func testLDAPDatabase(t *testing.T, settings LDAPSettings) (*Database, Authenticator) {
+	t.Helper()
+	auth, err := NewLDAPAuthenticator(settings)
+	if err != nil {
+		t.Fatal(err)
+	}
+	users, err := NewUserStore("")
+	if err != nil {
+		t.Fatal(err)
+	}
+	db := NewDatabase(users)
+	db.SetAuthenticators(auth)
+	return db, auth
+}
+
+//-----------------------------------------------------------------------------
+
+func TestLDAPLogin(t *testing.T) {
+	db, _ := testLDAPDatabase(t, testLDAPSettings(newTestDirectory().serve(t)))
+
+	user, err := db.findUser("alice", "alice1234")
+	if err != nil {
+		t.Fatalf("alice: %v", err)
+	}
+	if user.Email != "alice@example.com" || user.External != "ldap:uid=alice,ou=people,dc=example,dc=com" || user.Password != "" {
+		t.Errorf("alice provisioned as %+v", user)
+	}
+	roles := append([]string(nil), user.Roles...)
+	sort.Strings(roles)
+	if !reflect.DeepEqual(roles, []string{"admin", "user"}) {
+		t.Errorf("alice roles %v, want admin and user", user.Roles)
+	}
+
+	again, err := db.findUser("alice@example.com", "alice1234")
+	if err != nil || again.ID != user.ID {
+		t.Errorf("alice by email: %v, %+v", err, again)
+	}
+
+	for _, c := range []struct{ login, password string }{
+		{"alice", "wrong"},
+		{"alice", ""},
+		{"nobody", "alice1234"},
+		{"*", "alice1234"},
+		{"alice)(uid=*", "alice1234"},
+	} {
+		if _, err := db.findUser(c.login, c.password); err != errUserNotFound {
+			t.Errorf("%q/%q: got %v, want %v", c.login, c.password, err, errUserNotFound)
+		}
+	}
+}
+
+func TestLDAPGroupMapping(t *testing.T) {
+	db, _ := testLDAPDatabase(t, testLDAPSettings(newTestDirectory().serve(t)))
+
+	bob, err := db.findUser("bob", "bob12345")
+	if err != nil || !reflect.DeepEqual(bob.Roles, []string{"user"}) {
+		t.Fatalf("bob: %v, roles %v, want [user]", err, bob)
+	}
+
+	// No group maps, so a new account gets the defaults...
+	carol, err := db.findUser("carol", "carol1234")
+	if err != nil || !reflect.DeepEqual(carol.Roles, []string{"guest"}) {
+		t.Fatalf("carol: %v, %+v, want default roles", err, carol)
+	}
+
+	// ...and an existing one keeps what it was given by hand.
+	if _, err := db.SetRoles(carol.ID, []string{"ops"}); err != nil {
+		t.Fatal(err)
+	}
+	carol, err = db.findUser("carol", "carol1234")
+	if err != nil || !reflect.DeepEqual(carol.Roles, []string{"ops"}) {
+		t.Errorf("carol after login: %v, %+v, want [ops] kept", err, carol)
+	}
+}
+
+func TestLDAPDoesNotLinkLocalAccounts(t *testing.T) {
+	db, auth := testLDAPDatabase(t, testLDAPSettings(newTestDirectory().serve(t)))
+
+	local, err := db.newUser("alice@example.com", "local-secret", "admin")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := db.users.Create(local); err != nil {
+		t.Fatal(err)
+	}
+
+	if _, err := auth.Authenticate(db, "alice", "alice1234"); err != errEmailTaken {
+		t.Errorf("got %v, want %v", err, errEmailTaken)
+	}
+	if u, _ := db.users.FindByEmail("alice@example.com"); u.External != "" || u.Password != local.Password {
+		t.Errorf("local account changed: %+v", u)
+	}
+}
+
+func TestLDAPMalformedResponses(t *testing.T) {
+	cases := []struct {
+		name  string
+		reply func(id int64) []byte
+	}{
+		{"truncated", func(id int64) []byte {
+			return berSequence(berInteger(id), ldapTestResult(ldapBindResponse, 0)).encode()[:5]
+		}},
+		{"bad length", func(id int64) []byte { return []byte{0x30, 0x84, 0, 0, 0, 1, 0} }},
+		{"too large", func(id int64) []byte { return []byte{0x30, 0x83, 0xff, 0xff, 0xff} }},
+		{"no operation", func(id int64) []byte { return berSequence(berInteger(id)).encode() }},
+		{"short result", func(id int64) []byte {
+			return berSequence(berInteger(id), berConstructed(ldapBindResponse, berEnumerated(0))).encode()
+		}},
+		{"wrong response", func(id int64) []byte {
+			return berSequence(berInteger(id), ldapTestResult(ldapSearchDone, 0)).encode()
+		}},
+		{"child overruns parent", func(id int64) []byte { return []byte{0x30, 0x03, 0x02, 0x05, 0x01} }},
+	}
+
+	for _, c := range cases {
+		t.Run(c.name, func(t *testing.T) {
+			addr := serveLDAP(t, func(id int64, op *berElement) []byte { return c.reply(id) })
+			settings := testLDAPSettings(addr)
+			settings.Timeout = 500 * time.Millisecond
+			db, auth := testLDAPDatabase(t, settings)
+
+			done := make(chan error, 1)
+			go func() {
+				_, err := auth.Authenticate(db, "alice", "alice1234")
+				done <- err
+			}()
+
+			select {
+			case err := <-done:
+				if err == nil || err == errUserNotFound {
+					t.Errorf("got %v, want a protocol error", err)
+				}
+			case <-time.After(5 * time.Second):
+				t.Fatal("Authenticate didn't return")
+			}
+		})
+	}
+}
+
+//-----------------------------------------------------------------------------
+
+func TestBERRoundTrip(t *testing.T) {
+	for _, n := range []int64{0, 1, 127, 128, 255, 256, -1, -128, -129, 1 << 40, -(1 << 40)} {
+		e, err := readBER(bytes.NewReader(berInteger(n).encode()))
+		if err != nil || e.int() != n {
+			t.Errorf("integer %v: got %v (%v)", n, e, err)
+		}
+	}
+
+	long := strings.Repeat("x", 70000)
+	msg := berSequence(berInteger(7), berConstructed(ldapBindRequest,
+		berInteger(3), berString(long), berPrimitive(0x80, []byte("secret")), berBoolean(true)))
+
+	e, err := readBER(bytes.NewReader(msg.encode()))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(e.encode(), msg.encode()) {
+		t.Error("re-encoding changed the message")
+	}
+	op := e.children[1]
+	if e.children[0].int() != 7 || op.tag != ldapBindRequest || string(op.children[1].value) != long ||
+		string(op.children[2].value) != "secret" || op.children[3].value[0] != 0xff {
+		t.Errorf("decoded %+v", op)
+	}
+}
+
+func TestBERMalformed(t *testing.T) {
+	nested := func(depth int) []byte {
+		e := berString("x")
+		for i := 0; i < depth; i++ {
+			e = berSequence(e)
+		}
+		return e.encode()
+	}
+
+	if _, err := readBER(bytes.NewReader(nested(berMaxDepth))); err != nil {
+		t.Errorf("nested %v deep: %v", berMaxDepth, err)
+	}
+
+	for _, c := range []struct {
+		name string
+		data []byte
+	}{
+		{"empty", nil},
+		{"header only", []byte{0x04}},
+		{"short contents", []byte{0x04, 0x05, 'a', 'b'}},
+		{"indefinite length", []byte{0x30, 0x80, 0x04, 0x00, 0x00, 0x00}},
+		{"length too long", []byte{0x04, 0x84, 0, 0, 0, 1, 'a'}},
+		{"truncated length", []byte{0x04, 0x82, 0x01}},
+		{"too large", []byte{0x04, 0x83, 0xff, 0xff, 0xff}},
+		{"child overruns parent", []byte{0x30, 0x03, 0x04, 0x05, 'a'}},
+		{"child header cut", []byte{0x30, 0x01, 0x04}},
+		{"too deep", nested(berMaxDepth + 1)},
+	} {
+		if e, err := readBER(bytes.NewReader(c.data)); err == nil {
+			t.Errorf("%v: decoded %+v, want an error", c.name, e)
+		} else if c.name == "empty" && err != io.EOF {
+			t.Errorf("%v: got %v, want EOF", c.name, err)
+		}
+	}
+}
+
+func TestParseLDAPFilter(t *testing.T) {
+	for _, good := range []string{
+		"(uid=alice)",
+		"(objectClass=*)",
+		"(&(objectClass=person)(|(uid=a)(mail=a@example.com)))",
+		"(!(disabled=TRUE))",
+		"(cn=" + ldapEscape("*)(uid=*\\") + ")",
+	} {
+		if _, err := parseLDAPFilter(good); err != nil {
+			t.Errorf("%v: %v", good, err)
+		}
+	}
+
+	for _, bad := range []string{
+		"", "uid=alice", "(uid=alice", "(&(uid=a)", "(=alice)", "(uid~=alice)",
+		"(uid=al*ce)", "(uid=\\zz)", "(uid=\\4)", "(uid=a)(uid=b)", "(!(uid=a)",
+	} {
+		if _, err := parseLDAPFilter(bad); err == nil {
+			t.Errorf("%q: parsed, want an error", bad)
+		}
+	}
+
+	// Escaped values reach the directory as typed.
+	f, _ := parseLDAPFilter("(uid=" + ldapEscape("*)(uid=*") + ")")
+	if got := string(f.children[1].value); got != "*)(uid=*" {
+		t.Errorf("escaped value came through as %q", got)
+	}
+}
@@ -0,0 +1,105 @@
+//
+// Copyright (C) 2017 Keith Irwin
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU General Public License as published
+// by the Free Software Foundation, either version 3 of the License,
+// or (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU General Public License for more details.
+//
+// You should have received a copy of the GNU General Public License
+// along with this program.  If not, see <http://www.gnu.org/licenses/>.
+
+package internal
+
+import (
+	"errors"
+	"fmt"
+	"net"
+	"net/smtp"
+	"os"
+	"strings"
+	"sync"
+	"time"
+)
+
+//-----------------------------------------------------------------------------
+// Outgoing email (password reset links), through an SMTP relay. The
+// relay is asked for STARTTLS when it offers it.
+//-----------------------------------------------------------------------------
+
+// MailSettings say how to send email.
+type MailSettings struct {
+	Relay    string // host:port
+	From     string
+	Username string // empty to send without authenticating
+	Password string // or env:NAME
+}
+
+type mailer struct {
+	mutex    sync.RWMutex
+	settings *MailSettings
+}
+
+func (m *mailer) config() *MailSettings {
+	m.mutex.RLock()
+	defer m.mutex.RUnlock()
+	return m.settings
+}
+
+func (m *mailer) set(settings MailSettings) error {
+	if _, _, err := net.SplitHostPort(settings.Relay); err != nil {
+		return fmt.Errorf("SMTP relay '%v' isn't host:port", settings.Relay)
+	}
+	if !strings.Contains(settings.From, "@") {
+		return errors.New("email needs a From address")
+	}
+	if strings.HasPrefix(settings.Password, "env:") {
+		name := strings.TrimPrefix(settings.Password, "env:")
+		if settings.Password = os.Getenv(name); settings.Password == "" {
+			return fmt.Errorf("environment variable '%v' is empty", name)
+		}
+	}
+
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+	m.settings = &settings
+	return nil
+}
+
+// send mails a plain text message.
+func (m *mailer) send(to, subject, body string) error {
+	settings := m.config()
+	if settings == nil {
+		return errors.New("no SMTP relay")
+	}
+
+	// Addresses and subject go in headers, so no line breaks.
+	if strings.ContainsAny(to+subject, "\r\n") {
+		return fmt.Errorf("bad address or subject for '%v'", to)
+	}
+
+	var auth smtp.Auth
+	if settings.Username != "" {
+		host, _, _ := net.SplitHostPort(settings.Relay)
+		auth = smtp.PlainAuth("", settings.Username, settings.Password, host)
+	}
+
+	msg := strings.Join([]string{
+		"From: " + settings.From,
+		"To: " + to,
+		"Subject: " + subject,
+		"Date: " + time.Now().Format(time.RFC1123Z),
+		"Message-ID: <" + mkUUID() + "@" + strings.SplitN(settings.From, "@", 2)[1] + ">",
+		"MIME-Version: 1.0",
+		"Content-Type: text/plain; charset=utf-8",
+		"",
+		strings.Replace(body, "\n", "\r\n", -1),
+	}, "\r\n")
+
+	return smtp.SendMail(settings.Relay, auth, settings.From, []string{to}, []byte(msg))
+}
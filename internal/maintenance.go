@@ -0,0 +1,252 @@
+//
+// Copyright (C) 2017 Keith Irwin
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU General Public License as published
+// by the Free Software Foundation, either version 3 of the License,
+// or (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU General Public License for more details.
+//
+// You should have received a copy of the GNU General Public License
+// along with this program.  If not, see <http://www.gnu.org/licenses/>.
+
+package internal
+
+import (
+	"html/template"
+	"log"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+//-----------------------------------------------------------------------------
+
+const defaultRetryAfter = 5 * time.Minute
+
+type maintenanceWindow struct {
+	Context string     `json:"context"`
+	Message string     `json:"message"`
+	Start   *time.Time `json:"start,omitempty"`
+	End     *time.Time `json:"end,omitempty"`
+}
+
+func (m *maintenanceWindow) activeAt(t time.Time) bool {
+	if m.Start != nil && t.Before(*m.Start) {
+		return false
+	}
+	if m.End != nil && !t.Before(*m.End) {
+		return false
+	}
+	return true
+}
+
+func (m *maintenanceWindow) retryAfter(t time.Time) time.Duration {
+	if m.End == nil || !m.End.After(t) {
+		return defaultRetryAfter
+	}
+	return m.End.Sub(t)
+}
+
+// Maintenance tracks routes and installed apps taken down for
+// maintenance, and tells connected launchpads when that changes.
+type Maintenance struct {
+	windows   map[string]*maintenanceWindow
+	active    string
+	mutex     sync.Mutex
+	clock     *time.Ticker
+	clienthub *ClientHub
+}
+
+// NewMaintenance returns a service for managing maintenance windows.
+func NewMaintenance(clients *ClientHub) *Maintenance {
+	return &Maintenance{
+		windows:   make(map[string]*maintenanceWindow),
+		clock:     time.NewTicker(5 * time.Second),
+		clienthub: clients,
+	}
+}
+
+// Start the maintenance scheduler.
+func (m *Maintenance) Start() {
+	log.Println("Starting maintenance scheduler.")
+	go m.checkContinuously()
+}
+
+// Stop the maintenance scheduler.
+func (m *Maintenance) Stop() {
+	log.Println("Stopping maintenance scheduler.")
+	if m.clock != nil {
+		m.clock.Stop()
+	}
+}
+
+func (m *Maintenance) checkContinuously() {
+	c := m.clock.C
+	for _ = range c {
+		m.check()
+	}
+}
+
+// check notifies clients if the set of active windows has changed
+// since the last check, and drops windows that have ended.
+func (m *Maintenance) check() {
+	m.mutex.Lock()
+	now := time.Now()
+	for context, w := range m.windows {
+		if w.End != nil && !now.Before(*w.End) {
+			delete(m.windows, context)
+		}
+	}
+
+	windows := m.activeWindows(now)
+	contexts := make([]string, 0, len(windows))
+	for _, w := range windows {
+		contexts = append(contexts, w.Context)
+	}
+
+	key := strings.Join(contexts, ",")
+	changed := key != m.active
+	m.active = key
+	m.mutex.Unlock()
+
+	if changed {
+		log.Printf("- maintenance: [%v]", key)
+		m.clienthub.notifyMaintenance(windows)
+	}
+}
+
+func (m *Maintenance) activeWindows(t time.Time) []*maintenanceWindow {
+	result := make([]*maintenanceWindow, 0)
+	for _, w := range m.windows {
+		if w.activeAt(t) {
+			c := *w
+			result = append(result, &c)
+		}
+	}
+	sort.Slice(result, func(i, j int) bool {
+		return result[i].Context < result[j].Context
+	})
+	return result
+}
+
+func (m *Maintenance) set(window *maintenanceWindow) {
+	m.mutex.Lock()
+	m.windows[window.Context] = window
+	m.mutex.Unlock()
+	m.check()
+}
+
+func (m *Maintenance) clear(context string) bool {
+	m.mutex.Lock()
+	_, ok := m.windows[context]
+	delete(m.windows, context)
+	m.mutex.Unlock()
+	m.check()
+	return ok
+}
+
+func (m *Maintenance) list() []*maintenanceWindow {
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+
+	result := make([]*maintenanceWindow, 0, len(m.windows))
+	for _, w := range m.windows {
+		c := *w
+		result = append(result, &c)
+	}
+	sort.Slice(result, func(i, j int) bool {
+		return result[i].Context < result[j].Context
+	})
+	return result
+}
+
+func (m *Maintenance) current() []*maintenanceWindow {
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+	return m.activeWindows(time.Now())
+}
+
+func (m *Maintenance) find(context string) *maintenanceWindow {
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+	if w, ok := m.windows[context]; ok && w.activeAt(time.Now()) {
+		c := *w
+		return &c
+	}
+	return nil
+}
+
+//-----------------------------------------------------------------------------
+
+var maintenancePage = template.Must(template.New("maintenance").Parse(`<!doctype html>
+<html lang="en">
+  <head>
+    <title>Launch Pad: Down for maintenance</title>
+    <meta charset="utf-8">
+    <meta name="viewport" content="width=device-width, initial-scale=1, shrink-to-fit=no">
+    <style>
+      body { margin: 0; font-family: helvetica, sans-serif; background: #f4f4f4; color: #333; }
+      .Panel { max-width: 32em; margin: 15vh auto; padding: 2em; background: white;
+               border: 1px solid silver; border-radius: 4px; }
+      h1 { font-size: 1.4em; margin-top: 0; }
+      a { color: #369; text-decoration: none; }
+    </style>
+  </head>
+  <body>
+    <div class="Panel">
+      <h1>'{{.Context}}' is down for maintenance</h1>
+      <p>{{if .Message}}{{.Message}}{{else}}This service is temporarily unavailable.{{end}}</p>
+      {{if .End}}<p>Expected back at {{.End.Format "Jan 2, 15:04 MST"}}.</p>{{end}}
+      <p><a href="/">Return to the Launch Pad</a></p>
+    </div>
+  </body>
+</html>
+`))
+
+type maintenanceResponse struct {
+	Error     string     `json:"error"`
+	Context   string     `json:"context"`
+	Message   string     `json:"message,omitempty"`
+	End       *time.Time `json:"end,omitempty"`
+	RequestID string     `json:"request_id,omitempty"`
+}
+
+// underMaintenance writes a 503 response (HTML for browsers, JSON for
+// everything else) and returns true if the request's context is
+// currently down for maintenance.
+func (proxy ProxyServer) underMaintenance(w http.ResponseWriter, r *http.Request) bool {
+	window := proxy.maintenance.find(getPathContext(r))
+	if window == nil {
+		return false
+	}
+
+	retry := window.retryAfter(time.Now())
+	w.Header().Set("Retry-After", strconv.Itoa(int(retry.Seconds())))
+	w.Header().Set("Cache-Control", "no-store")
+
+	if wantsHTML(r) {
+		w.Header().Set("Content-Type", "text/html; charset=utf-8")
+		w.WriteHeader(http.StatusServiceUnavailable)
+		if err := maintenancePage.Execute(w, window); err != nil {
+			log.Printf("ERROR: %v", err)
+		}
+		return true
+	}
+
+	writeJSON(w, http.StatusServiceUnavailable, maintenanceResponse{
+		Error:     "maintenance",
+		Context:   window.Context,
+		Message:   window.Message,
+		End:       window.End,
+		RequestID: requestID(r),
+	})
+	return true
+}
@@ -0,0 +1,315 @@
+//
+// Copyright (C) 2017 Keith Irwin
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU General Public License as published
+// by the Free Software Foundation, either version 3 of the License,
+// or (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU General Public License for more details.
+//
+// You should have received a copy of the GNU General Public License
+// along with this program.  If not, see <http://www.gnu.org/licenses/>.
+
+package internal
+
+import (
+	"bytes"
+	"fmt"
+	"log"
+	"math"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+)
+
+//-----------------------------------------------------------------------------
+// A minimal registry for metrics in the Prometheus text exposition
+// format. All the metrics the proxy exports are declared here.
+//-----------------------------------------------------------------------------
+
+const (
+	metricRequests         = "proxy_requests_total"
+	metricRequestDuration  = "proxy_request_duration_seconds"
+	metricUpstreamLatency  = "proxy_upstream_duration_seconds"
+	metricUpstreamUp       = "proxy_upstream_up"
+	metricWebsocketClients = "proxy_websocket_clients"
+	metricCommandQueue     = "proxy_command_queue_depth"
+	metricCommands         = "proxy_commands_total"
+	metricStoreFetches     = "proxy_appstore_fetches_total"
+	metricStoreCatalogAge  = "proxy_appstore_catalog_age_seconds"
+	metricAuth             = "proxy_auth_total"
+)
+
+var defaultBuckets = []float64{.005, .01, .025, .05, .1, .25, .5, 1, 2.5, 5, 10}
+
+// NewMetrics returns a registry with all the proxy's metrics declared.
+func NewMetrics() *Metrics {
+	reg := &Metrics{families: make(map[string]*family)}
+
+	reg.declare(metricRequests, "counter", "Requests handled, by route, status class and upstream.", nil)
+	reg.declare(metricRequestDuration, "histogram", "Request latency, by route, status class and upstream.", defaultBuckets)
+	reg.declare(metricUpstreamLatency, "histogram", "Upstream round trip latency, by route and upstream.", defaultBuckets)
+	reg.declare(metricUpstreamUp, "gauge", "Whether the last connection test to an upstream succeeded.", nil)
+	reg.declare(metricWebsocketClients, "gauge", "Websocket clients attached to the client hub.", nil)
+	reg.declare(metricCommandQueue, "gauge", "Commands waiting to be processed.", nil)
+	reg.declare(metricCommands, "counter", "Commands processed, by command and outcome.", nil)
+	reg.declare(metricStoreFetches, "counter", "App store catalog fetches, by outcome.", nil)
+	reg.declare(metricStoreCatalogAge, "gauge", "Seconds since the app store catalog was last fetched.", nil)
+	reg.declare(metricAuth, "counter", "Authentication attempts, by method and outcome.", nil)
+
+	return reg
+}
+
+type series struct {
+	labels string
+	value  float64
+	counts []uint64
+	count  uint64
+}
+
+type family struct {
+	name    string
+	kind    string
+	help    string
+	buckets []float64
+	series  map[string]*series
+	collect func() float64
+}
+
+// Metrics is a registry of metric families. A nil *Metrics records
+// nothing.
+type Metrics struct {
+	mutex    sync.Mutex
+	families map[string]*family
+}
+
+func (reg *Metrics) declare(name, kind, help string, buckets []float64) {
+	reg.families[name] = &family{
+		name:    name,
+		kind:    kind,
+		help:    help,
+		buckets: buckets,
+		series:  make(map[string]*series),
+	}
+}
+
+// renderLabels turns key/value pairs into `{k="v",...}`.
+func renderLabels(pairs []string) string {
+	if len(pairs) == 0 {
+		return ""
+	}
+	buf := new(bytes.Buffer)
+	buf.WriteString("{")
+	for i := 0; i+1 < len(pairs); i += 2 {
+		if i > 0 {
+			buf.WriteString(",")
+		}
+		value := strings.NewReplacer(`\`, `\\`, `"`, `\"`, "\n", `\n`).Replace(pairs[i+1])
+		fmt.Fprintf(buf, `%s="%s"`, pairs[i], value)
+	}
+	buf.WriteString("}")
+	return buf.String()
+}
+
+func (reg *Metrics) find(name string, labels []string) *series {
+	f, ok := reg.families[name]
+	if !ok {
+		log.Printf("WARNING: undeclared metric '%v'", name)
+		return nil
+	}
+	key := renderLabels(labels)
+	s, ok := f.series[key]
+	if !ok {
+		s = &series{labels: key, counts: make([]uint64, len(f.buckets))}
+		f.series[key] = s
+	}
+	return s
+}
+
+func (reg *Metrics) inc(name string, labels ...string) {
+	if reg == nil {
+		return
+	}
+	reg.mutex.Lock()
+	defer reg.mutex.Unlock()
+	if s := reg.find(name, labels); s != nil {
+		s.value++
+	}
+}
+
+func (reg *Metrics) set(name string, value float64, labels ...string) {
+	if reg == nil {
+		return
+	}
+	reg.mutex.Lock()
+	defer reg.mutex.Unlock()
+	if s := reg.find(name, labels); s != nil {
+		s.value = value
+	}
+}
+
+func (reg *Metrics) observe(name string, value float64, labels ...string) {
+	if reg == nil {
+		return
+	}
+	reg.mutex.Lock()
+	defer reg.mutex.Unlock()
+	s := reg.find(name, labels)
+	if s == nil {
+		return
+	}
+	for i, bound := range reg.families[name].buckets {
+		if value <= bound {
+			s.counts[i]++
+		}
+	}
+	s.count++
+	s.value += value
+}
+
+// gaugeFunc makes a gauge whose value is computed at scrape time.
+func (reg *Metrics) gaugeFunc(name string, fn func() float64) {
+	if reg == nil {
+		return
+	}
+	reg.mutex.Lock()
+	defer reg.mutex.Unlock()
+	if f, ok := reg.families[name]; ok {
+		f.collect = fn
+	}
+}
+
+func formatFloat(v float64) string {
+	switch {
+	case math.IsInf(v, 1):
+		return "+Inf"
+	case math.IsInf(v, -1):
+		return "-Inf"
+	}
+	return strconv.FormatFloat(v, 'g', -1, 64)
+}
+
+// withLabel adds one more label to an already rendered label set.
+func withLabel(labels, key, value string) string {
+	pair := fmt.Sprintf(`%s="%s"`, key, value)
+	if labels == "" {
+		return "{" + pair + "}"
+	}
+	return labels[:len(labels)-1] + "," + pair + "}"
+}
+
+func (reg *Metrics) render() []byte {
+	reg.mutex.Lock()
+	collectors := make(map[string]func() float64)
+	for name, f := range reg.families {
+		if f.collect != nil {
+			collectors[name] = f.collect
+		}
+	}
+	reg.mutex.Unlock()
+
+	// Gauge funcs may take other locks, so call them outside ours.
+	for name, fn := range collectors {
+		reg.set(name, fn())
+	}
+
+	reg.mutex.Lock()
+	defer reg.mutex.Unlock()
+
+	names := make([]string, 0, len(reg.families))
+	for name := range reg.families {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	buf := new(bytes.Buffer)
+	for _, name := range names {
+		f := reg.families[name]
+		fmt.Fprintf(buf, "# HELP %s %s\n", f.name, f.help)
+		fmt.Fprintf(buf, "# TYPE %s %s\n", f.name, f.kind)
+
+		keys := make([]string, 0, len(f.series))
+		for key := range f.series {
+			keys = append(keys, key)
+		}
+		sort.Strings(keys)
+
+		for _, key := range keys {
+			s := f.series[key]
+			if f.kind != "histogram" {
+				fmt.Fprintf(buf, "%s%s %s\n", f.name, s.labels, formatFloat(s.value))
+				continue
+			}
+			for i, bound := range f.buckets {
+				fmt.Fprintf(buf, "%s_bucket%s %d\n", f.name, withLabel(s.labels, "le", formatFloat(bound)), s.counts[i])
+			}
+			fmt.Fprintf(buf, "%s_bucket%s %d\n", f.name, withLabel(s.labels, "le", "+Inf"), s.count)
+			fmt.Fprintf(buf, "%s_sum%s %s\n", f.name, s.labels, formatFloat(s.value))
+			fmt.Fprintf(buf, "%s_count%s %d\n", f.name, s.labels, s.count)
+		}
+	}
+	return buf.Bytes()
+}
+
+//-----------------------------------------------------------------------------
+
+func (proxy ProxyServer) writeMetrics(w http.ResponseWriter) {
+	w.Header().Set("Content-Type", "text/plain; version=0.0.4; charset=utf-8")
+	if proxy.Metrics != nil {
+		w.Write(proxy.Metrics.render())
+	}
+}
+
+// handleMetrics serves metrics on the main listener to authenticated
+// users. When a separate metrics listener is configured, it's served
+// there instead (see Start).
+func (proxy ProxyServer) handleMetrics(w http.ResponseWriter, r *http.Request) {
+	if proxy.MetricsAddr != "" {
+		proxy.writeError(w, r, http.StatusNotFound, "Metrics are served on a separate listener.")
+		return
+	}
+
+	token, err := proxy.checkAuth(w, r)
+	if err != nil {
+		proxy.writeError(w, r, http.StatusUnauthorized, err.Error())
+		return
+	}
+
+	if !proxy.permit(w, r, token, policyRoute, "metrics") {
+		return
+	}
+
+	proxy.writeMetrics(w)
+}
+
+// metricRoute bounds the route label to known routes and endpoints so
+// that random paths can't blow up the number of series.
+func (proxy ProxyServer) metricRoute(context string) string {
+	switch {
+	case context == "" || context == "static":
+		return "home"
+	case proxy.Routes.has(context):
+		return context
+	}
+
+	if _, ok := endpointMethods[context]; ok {
+		return context
+	}
+	return "apps"
+}
+
+func (proxy ProxyServer) recordMetrics(rec *accessRecord) {
+	route := proxy.metricRoute(rec.Route)
+	class := fmt.Sprintf("%dxx", rec.Status/100)
+	proxy.Metrics.inc(metricRequests, "route", route, "code", class, "upstream", rec.upstreamName)
+	proxy.Metrics.observe(metricRequestDuration, rec.Latency/1000, "route", route, "code", class, "upstream", rec.upstreamName)
+	if rec.upstreamName != "" {
+		proxy.Metrics.observe(metricUpstreamLatency, rec.UpstreamLatency/1000, "route", route, "upstream", rec.upstreamName)
+	}
+}
@@ -0,0 +1,261 @@
+//
+// Copyright (C) 2017 Keith Irwin
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU General Public License as published
+// by the Free Software Foundation, either version 3 of the License,
+// or (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU General Public License for more details.
+//
+// You should have received a copy of the GNU General Public License
+// along with this program.  If not, see <http://www.gnu.org/licenses/>.
+
+package internal
+
+import (
+	"fmt"
+	"log"
+	"net"
+	"net/http"
+	"strings"
+	"sync"
+)
+
+//-----------------------------------------------------------------------------
+
+type netList struct {
+	nets  []*net.IPNet
+	rules []string
+}
+
+// parseNetList accepts CIDRs ("10.0.0.0/8") or bare addresses
+// ("127.0.0.1"), which are treated as single hosts.
+func parseNetList(cidrs []string) (*netList, error) {
+	list := &netList{nets: make([]*net.IPNet, 0, len(cidrs))}
+	for _, cidr := range cidrs {
+		cidr = strings.TrimSpace(cidr)
+		if cidr == "" {
+			continue
+		}
+
+		if !strings.Contains(cidr, "/") {
+			ip := net.ParseIP(cidr)
+			if ip == nil {
+				return nil, fmt.Errorf("invalid address '%v'", cidr)
+			}
+			bits := 128
+			if ip.To4() != nil {
+				ip = ip.To4()
+				bits = 32
+			}
+			list.nets = append(list.nets, &net.IPNet{IP: ip, Mask: net.CIDRMask(bits, bits)})
+			list.rules = append(list.rules, cidr)
+			continue
+		}
+
+		_, network, err := net.ParseCIDR(cidr)
+		if err != nil {
+			return nil, err
+		}
+		list.nets = append(list.nets, network)
+		list.rules = append(list.rules, cidr)
+	}
+	return list, nil
+}
+
+func (list *netList) contains(ip net.IP) bool {
+	return list.match(ip) != ""
+}
+
+// match returns the rule (as written) that contains ip, or "".
+func (list *netList) match(ip net.IP) string {
+	if list == nil || ip == nil {
+		return ""
+	}
+	for i, network := range list.nets {
+		if network.Contains(ip) {
+			if i < len(list.rules) {
+				return list.rules[i]
+			}
+			return network.String()
+		}
+	}
+	return ""
+}
+
+func (list *netList) empty() bool {
+	return list == nil || len(list.nets) == 0
+}
+
+// peerIP is the address of the host directly connected to us, which
+// may well be another proxy.
+func peerIP(r *http.Request) net.IP {
+	host, _, err := net.SplitHostPort(r.RemoteAddr)
+	if err != nil {
+		host = r.RemoteAddr
+	}
+	return net.ParseIP(host)
+}
+
+// isTrustedPeer returns true if the directly connected host is one of
+// our own proxies or load balancers.
+func (proxy ProxyServer) isTrustedPeer(r *http.Request) bool {
+	return proxy.trusted.contains(peerIP(r))
+}
+
+// clientIP finds the real client address. Starting with the connected
+// peer, as long as the current hop is a trusted proxy we believe the
+// address it appended to X-Forwarded-For, walking right to left. The
+// first untrusted hop is the client.
+func (proxy ProxyServer) clientIP(r *http.Request) net.IP {
+	ip := peerIP(r)
+
+	hops := make([]string, 0)
+	for _, header := range r.Header["X-Forwarded-For"] {
+		for _, hop := range strings.Split(header, ",") {
+			if hop = strings.TrimSpace(hop); hop != "" {
+				hops = append(hops, hop)
+			}
+		}
+	}
+
+	for i := len(hops) - 1; i >= 0 && proxy.trusted.contains(ip); i-- {
+		next := net.ParseIP(hops[i])
+		if next == nil {
+			break
+		}
+		ip = next
+	}
+
+	return ip
+}
+
+//-----------------------------------------------------------------------------
+// IP allow and deny lists, globally and per context (a route, an
+// installed app, or one of the proxy's own endpoints such as "admin").
+// Deny rules win over allow rules; a non-empty allow list rejects
+// anything not on it.
+//-----------------------------------------------------------------------------
+
+type ipPolicy struct {
+	Allow []string `json:"allow"`
+	Deny  []string `json:"deny"`
+	allow *netList
+	deny  *netList
+}
+
+func newIPPolicy(allow, deny []string) (*ipPolicy, error) {
+	allowList, err := parseNetList(allow)
+	if err != nil {
+		return nil, err
+	}
+	denyList, err := parseNetList(deny)
+	if err != nil {
+		return nil, err
+	}
+	return &ipPolicy{
+		Allow: allowList.rules,
+		Deny:  denyList.rules,
+		allow: allowList,
+		deny:  denyList,
+	}, nil
+}
+
+// check returns a description of the rule that rejects ip, or "".
+func (policy *ipPolicy) check(ip net.IP) string {
+	if policy == nil {
+		return ""
+	}
+	if rule := policy.deny.match(ip); rule != "" {
+		return "deny " + rule
+	}
+	if !policy.allow.empty() && !policy.allow.contains(ip) {
+		return "not in allow list"
+	}
+	return ""
+}
+
+type ipRules struct {
+	mutex    sync.RWMutex
+	global   *ipPolicy
+	contexts map[string]*ipPolicy
+}
+
+func newIPRules() *ipRules {
+	return &ipRules{contexts: make(map[string]*ipPolicy)}
+}
+
+type ipPolicies struct {
+	Global   *ipPolicy            `json:"global"`
+	Contexts map[string]*ipPolicy `json:"contexts"`
+}
+
+func (rules *ipRules) list() ipPolicies {
+	rules.mutex.RLock()
+	defer rules.mutex.RUnlock()
+	contexts := make(map[string]*ipPolicy, len(rules.contexts))
+	for k, v := range rules.contexts {
+		contexts[k] = v
+	}
+	return ipPolicies{rules.global, contexts}
+}
+
+// SetIPPolicy restricts a context (or, if context is "", everything)
+// to the allowed CIDRs, minus the denied ones. Empty lists remove the
+// policy.
+func (proxy ProxyServer) SetIPPolicy(context string, allow, deny []string) error {
+	policy, err := newIPPolicy(allow, deny)
+	if err != nil {
+		return err
+	}
+
+	if policy.allow.empty() && policy.deny.empty() {
+		policy = nil
+	}
+
+	rules := proxy.ipRules
+	rules.mutex.Lock()
+	defer rules.mutex.Unlock()
+
+	switch {
+	case context == "":
+		rules.global = policy
+	case policy == nil:
+		delete(rules.contexts, context)
+	default:
+		rules.contexts[context] = policy
+	}
+	return nil
+}
+
+// checkIP rejects requests from addresses not allowed by the global
+// or context rules, logging the rule that matched.
+func (proxy ProxyServer) checkIP(w http.ResponseWriter, r *http.Request) bool {
+	ip := proxy.clientIP(r)
+	context := getPathContext(r)
+
+	rules := proxy.ipRules
+	rules.mutex.RLock()
+	global := rules.global
+	local := rules.contexts[context]
+	rules.mutex.RUnlock()
+
+	scope := "global"
+	rule := global.check(ip)
+	if rule == "" {
+		scope = "/" + context
+		rule = local.check(ip)
+	}
+
+	if rule == "" {
+		return true
+	}
+
+	log.Printf("- ip.rejected: %v %v %v (%v: %v)", ip, r.Method, r.URL.Path, scope, rule)
+	proxy.writeError(w, r, http.StatusForbidden, "Access from your network is not allowed.")
+	return false
+}
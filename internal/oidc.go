@@ -0,0 +1,579 @@
+//
+// Copyright (C) 2017 Keith Irwin
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU General Public License as published
+// by the Free Software Foundation, either version 3 of the License,
+// or (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU General Public License for more details.
+//
+// You should have received a copy of the GNU General Public License
+// along with this program.  If not, see <http://www.gnu.org/licenses/>.
+
+package internal
+
+import (
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/subtle"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"log"
+	"net/http"
+	"net/url"
+	"os"
+	"strings"
+	"sync"
+	"time"
+
+	jwt "github.com/dgrijalva/jwt-go"
+)
+
+//-----------------------------------------------------------------------------
+// OpenID Connect sign in through an external identity provider, using
+// the authorization code flow with PKCE. The provider's ID token only
+// identifies the user: it's mapped to a local account (created on
+// first sign in), which then gets the proxy's own tokens like any
+// other login.
+//-----------------------------------------------------------------------------
+
+const oidcStateCookie = "oidcState"
+const oidcLoginTTL = 10 * time.Minute
+const oidcDiscoveryTTL = time.Hour
+const oidcKeysMinAge = time.Minute
+
+// OIDCSettings describe the identity provider and how its users map to
+// local ones.
+type OIDCSettings struct {
+	Issuer       string
+	ClientID     string
+	ClientSecret string            // or env:NAME; empty for public clients
+	RedirectURL  string            // this proxy's /auth/oidc/callback, as browsers see it
+	Scopes       []string          // in addition to openid
+	RolesClaim   string            // ID token claim with the user's groups or roles
+	RoleMap      map[string]string // claim value to local role; empty means use values as they are
+	DefaultRoles []string          // for new users whose token has no roles claim
+}
+
+type oidcDiscovery struct {
+	Issuer                string `json:"issuer"`
+	AuthorizationEndpoint string `json:"authorization_endpoint"`
+	TokenEndpoint         string `json:"token_endpoint"`
+	JWKSURI               string `json:"jwks_uri"`
+}
+
+type oidcKey struct {
+	method jwt.SigningMethod
+	public interface{}
+}
+
+// oidcLogin is a sign in in progress, between the redirect to the
+// provider and its redirect back.
+type oidcLogin struct {
+	verifier string
+	nonce    string
+	next     string
+	expires  time.Time
+}
+
+type oidcProvider struct {
+	mutex       sync.Mutex
+	settings    *OIDCSettings
+	client      *http.Client
+	discovery   *oidcDiscovery
+	discovered  time.Time
+	keys        map[string]*oidcKey
+	keysFetched time.Time
+	logins      map[string]*oidcLogin
+}
+
+func newOIDCProvider() *oidcProvider {
+	return &oidcProvider{
+		client: &http.Client{Timeout: 10 * time.Second},
+		logins: make(map[string]*oidcLogin),
+	}
+}
+
+// SetOIDC enables sign in through an OpenID Connect provider.
+func (proxy ProxyServer) SetOIDC(settings OIDCSettings) error {
+	settings.Issuer = strings.TrimRight(settings.Issuer, "/")
+	if settings.Issuer == "" || settings.ClientID == "" || settings.RedirectURL == "" {
+		return errors.New("OIDC needs an issuer, a client ID and a redirect URL")
+	}
+
+	if strings.HasPrefix(settings.ClientSecret, "env:") {
+		name := strings.TrimPrefix(settings.ClientSecret, "env:")
+		if settings.ClientSecret = os.Getenv(name); settings.ClientSecret == "" {
+			return fmt.Errorf("environment variable '%v' is empty", name)
+		}
+	}
+
+	p := proxy.oidc
+	p.mutex.Lock()
+	defer p.mutex.Unlock()
+	p.settings = &settings
+	p.discovery = nil
+	p.keys = nil
+
+	log.Printf("- sign in with OpenID Connect via '%v'", settings.Issuer)
+	return nil
+}
+
+func (p *oidcProvider) config() *OIDCSettings {
+	p.mutex.Lock()
+	defer p.mutex.Unlock()
+	return p.settings
+}
+
+func (p *oidcProvider) getJSON(url string, v interface{}) error {
+	resp, err := p.client.Get(url)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		return fmt.Errorf("%v: %v", url, resp.Status)
+	}
+	return json.NewDecoder(resp.Body).Decode(v)
+}
+
+// discover fetches (and caches) the provider's configuration.
+func (p *oidcProvider) discover() (*OIDCSettings, *oidcDiscovery, error) {
+	p.mutex.Lock()
+	defer p.mutex.Unlock()
+
+	if p.settings == nil {
+		return nil, nil, errors.New("OIDC is not configured")
+	}
+
+	if p.discovery != nil && time.Since(p.discovered) < oidcDiscoveryTTL {
+		return p.settings, p.discovery, nil
+	}
+
+	var doc oidcDiscovery
+	if err := p.getJSON(p.settings.Issuer+"/.well-known/openid-configuration", &doc); err != nil {
+		return nil, nil, err
+	}
+
+	if strings.TrimRight(doc.Issuer, "/") != p.settings.Issuer {
+		return nil, nil, fmt.Errorf("provider says its issuer is '%v'", doc.Issuer)
+	}
+
+	if doc.AuthorizationEndpoint == "" || doc.TokenEndpoint == "" || doc.JWKSURI == "" {
+		return nil, nil, errors.New("provider configuration is missing endpoints")
+	}
+
+	p.discovery = &doc
+	p.discovered = time.Now()
+	return p.settings, p.discovery, nil
+}
+
+// key finds one of the provider's signing keys, refetching them (not
+// too often) when the kid is new, which is how providers rotate.
+func (p *oidcProvider) key(doc *oidcDiscovery, kid string) (*oidcKey, error) {
+	p.mutex.Lock()
+	defer p.mutex.Unlock()
+
+	if key, ok := p.keys[kid]; ok {
+		return key, nil
+	}
+
+	if time.Since(p.keysFetched) < oidcKeysMinAge {
+		return nil, fmt.Errorf("unknown provider key '%v'", kid)
+	}
+
+	var set struct {
+		Keys []jwk `json:"keys"`
+	}
+	if err := p.getJSON(doc.JWKSURI, &set); err != nil {
+		return nil, err
+	}
+
+	p.keys = make(map[string]*oidcKey)
+	p.keysFetched = time.Now()
+	for _, k := range set.Keys {
+		if k.Use != "" && k.Use != "sig" {
+			continue
+		}
+		public, method, err := k.publicKey()
+		if err != nil {
+			log.Printf("- skipping provider key '%v': %v", k.Kid, err)
+			continue
+		}
+		p.keys[k.Kid] = &oidcKey{method: method, public: public}
+	}
+
+	if key, ok := p.keys[kid]; ok {
+		return key, nil
+	}
+	return nil, fmt.Errorf("unknown provider key '%v'", kid)
+}
+
+func randomToken() (string, error) {
+	raw := make([]byte, 32)
+	if _, err := rand.Read(raw); err != nil {
+		return "", err
+	}
+	return base64.RawURLEncoding.EncodeToString(raw), nil
+}
+
+// begin starts a sign in, returning the provider URL to send the
+// browser to and the state that will come back with it.
+func (p *oidcProvider) begin(next string) (string, string, error) {
+	settings, doc, err := p.discover()
+	if err != nil {
+		return "", "", err
+	}
+
+	login := &oidcLogin{next: next, expires: time.Now().Add(oidcLoginTTL)}
+	state, err := randomToken()
+	if err == nil {
+		login.verifier, err = randomToken()
+	}
+	if err == nil {
+		login.nonce, err = randomToken()
+	}
+	if err != nil {
+		return "", "", err
+	}
+
+	p.mutex.Lock()
+	now := time.Now()
+	for key, l := range p.logins {
+		if now.After(l.expires) {
+			delete(p.logins, key)
+		}
+	}
+	p.logins[state] = login
+	p.mutex.Unlock()
+
+	challenge := sha256.Sum256([]byte(login.verifier))
+
+	query := url.Values{}
+	query.Set("response_type", "code")
+	query.Set("client_id", settings.ClientID)
+	query.Set("redirect_uri", settings.RedirectURL)
+	query.Set("scope", strings.Join(append([]string{"openid"}, settings.Scopes...), " "))
+	query.Set("state", state)
+	query.Set("nonce", login.nonce)
+	query.Set("code_challenge", base64.RawURLEncoding.EncodeToString(challenge[:]))
+	query.Set("code_challenge_method", "S256")
+
+	sep := "?"
+	if strings.Contains(doc.AuthorizationEndpoint, "?") {
+		sep = "&"
+	}
+	return doc.AuthorizationEndpoint + sep + query.Encode(), state, nil
+}
+
+// finish redeems the code the provider sent back, returning the
+// verified ID token claims and where the user was headed.
+func (p *oidcProvider) finish(state, code string) (jwt.MapClaims, string, error) {
+	p.mutex.Lock()
+	login, ok := p.logins[state]
+	delete(p.logins, state)
+	p.mutex.Unlock()
+
+	if !ok || time.Now().After(login.expires) {
+		return nil, "", errors.New("sign in expired, or was never started")
+	}
+
+	settings, doc, err := p.discover()
+	if err != nil {
+		return nil, "", err
+	}
+
+	form := url.Values{}
+	form.Set("grant_type", "authorization_code")
+	form.Set("code", code)
+	form.Set("redirect_uri", settings.RedirectURL)
+	form.Set("client_id", settings.ClientID)
+	form.Set("code_verifier", login.verifier)
+
+	req, err := http.NewRequest("POST", doc.TokenEndpoint, strings.NewReader(form.Encode()))
+	if err != nil {
+		return nil, "", err
+	}
+	req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	req.Header.Set("Accept", "application/json")
+	if settings.ClientSecret != "" {
+		req.SetBasicAuth(url.QueryEscape(settings.ClientID), url.QueryEscape(settings.ClientSecret))
+	}
+
+	resp, err := p.client.Do(req)
+	if err != nil {
+		return nil, "", err
+	}
+	defer resp.Body.Close()
+
+	body, err := ioutil.ReadAll(resp.Body)
+	if err != nil {
+		return nil, "", err
+	}
+
+	var reply struct {
+		IDToken     string `json:"id_token"`
+		Error       string `json:"error"`
+		Description string `json:"error_description"`
+	}
+	if err := json.Unmarshal(body, &reply); err != nil {
+		return nil, "", fmt.Errorf("token endpoint: %v", resp.Status)
+	}
+	if reply.Error != "" {
+		return nil, "", fmt.Errorf("token endpoint: %v %v", reply.Error, reply.Description)
+	}
+	if resp.StatusCode != http.StatusOK || reply.IDToken == "" {
+		return nil, "", fmt.Errorf("token endpoint: %v, no ID token", resp.Status)
+	}
+
+	claims, err := p.verify(settings, doc, reply.IDToken, login.nonce)
+	if err != nil {
+		return nil, "", err
+	}
+	return claims, login.next, nil
+}
+
+// verify checks the ID token's signature, issuer, audience, lifetime
+// and nonce.
+func (p *oidcProvider) verify(settings *OIDCSettings, doc *oidcDiscovery, idToken, nonce string) (jwt.MapClaims, error) {
+	claims := jwt.MapClaims{}
+	_, err := jwt.ParseWithClaims(idToken, claims, func(token *jwt.Token) (interface{}, error) {
+		if token.Method == jwt.SigningMethodHS256 && settings.ClientSecret != "" {
+			return []byte(settings.ClientSecret), nil
+		}
+
+		kid, _ := token.Header["kid"].(string)
+		key, err := p.key(doc, kid)
+		if err != nil {
+			return nil, err
+		}
+		if key.method.Alg() != token.Method.Alg() {
+			return nil, fmt.Errorf(badSignMsg, token.Header["alg"])
+		}
+		return key.public, nil
+	})
+	if err != nil {
+		return nil, fmt.Errorf("ID token: %v", err)
+	}
+
+	if _, ok := claims["exp"]; !ok {
+		return nil, errors.New("ID token has no expiry")
+	}
+
+	if iss, _ := claims["iss"].(string); strings.TrimRight(iss, "/") != settings.Issuer {
+		return nil, fmt.Errorf("ID token issued by '%v'", iss)
+	}
+
+	if !claims.VerifyAudience(settings.ClientID, true) && !hasAudience(claims, settings.ClientID) {
+		return nil, errors.New("ID token is for another client")
+	}
+
+	if n, _ := claims["nonce"].(string); subtle.ConstantTimeCompare([]byte(n), []byte(nonce)) != 1 {
+		return nil, errors.New("ID token nonce doesn't match")
+	}
+
+	if sub, _ := claims["sub"].(string); sub == "" {
+		return nil, errors.New("ID token has no subject")
+	}
+
+	return claims, nil
+}
+
+// hasAudience checks an audience list, which this version of jwt-go
+// only understands as a single string.
+func hasAudience(claims jwt.MapClaims, audience string) bool {
+	list, _ := claims["aud"].([]interface{})
+	for _, aud := range list {
+		if aud == audience {
+			return true
+		}
+	}
+	return false
+}
+
+// roles maps the roles claim to local roles, returning nil if the
+// token doesn't have one or none of it maps, so new accounts get the
+// default roles and existing ones keep theirs.
+func (settings *OIDCSettings) roles(claims jwt.MapClaims) []string {
+	if settings.RolesClaim == "" {
+		return nil
+	}
+
+	var values []string
+	switch v := claims[settings.RolesClaim].(type) {
+	case string:
+		values = strings.Fields(strings.Replace(v, ",", " ", -1))
+	case []interface{}:
+		for _, value := range v {
+			if s, ok := value.(string); ok {
+				values = append(values, s)
+			}
+		}
+	default:
+		return nil
+	}
+
+	var roles []string
+	seen := make(map[string]bool)
+	for _, value := range values {
+		role := value
+		if len(settings.RoleMap) > 0 {
+			role = settings.RoleMap[value]
+		}
+		if role != "" && !seen[role] {
+			seen[role] = true
+			roles = append(roles, role)
+		}
+	}
+	return roles
+}
+
+//-----------------------------------------------------------------------------
+
+// localPath accepts only paths on this server as places to go after
+// signing in.
+func localPath(path string) bool {
+	return strings.HasPrefix(path, "/") && !strings.HasPrefix(path, "//") && !strings.HasPrefix(path, "/\\")
+}
+
+// handleOIDC serves single sign on:
+//
+//	GET /auth/oidc            -- {"enabled": true, "login": ".."}
+//	GET /auth/oidc/login      -- redirect to the provider (?next=/path)
+//	GET /auth/oidc/callback   -- the provider's redirect back
+func (proxy ProxyServer) handleOIDC(w http.ResponseWriter, r *http.Request, path string) {
+	if !proxy.allowMethod(w, r, staticMethods) {
+		return
+	}
+
+	settings := proxy.oidc.config()
+
+	switch path {
+	case "":
+		writeJSON(w, http.StatusOK, map[string]interface{}{
+			"enabled": settings != nil,
+			"login":   "/auth/oidc/login",
+		})
+		return
+	case "login", "callback":
+		if settings == nil {
+			proxy.writeError(w, r, http.StatusNotFound, "Single sign on is not configured.")
+			return
+		}
+	default:
+		proxy.writeError(w, r, http.StatusNotFound, "Unknown auth resource.")
+		return
+	}
+
+	if path == "login" {
+		next := r.URL.Query().Get("next")
+		if !localPath(next) {
+			next = "/"
+		}
+
+		target, state, err := proxy.oidc.begin(next)
+		if err != nil {
+			log.Printf("ERROR: OIDC: %v", err)
+			proxy.writeError(w, r, http.StatusBadGateway, "Unable to reach the identity provider.")
+			return
+		}
+
+		http.SetCookie(w, &http.Cookie{
+			Path:     "/auth/oidc",
+			Name:     oidcStateCookie,
+			Value:    state,
+			MaxAge:   int(oidcLoginTTL.Seconds()),
+			Secure:   proxy.auth.secure,
+			HttpOnly: true,
+			// Lax, so it comes back with the provider's redirect.
+			SameSite: http.SameSiteLaxMode,
+		})
+		http.Redirect(w, r, target, http.StatusFound)
+		return
+	}
+
+	// The callback: the state must match the browser that started the
+	// sign in, or anyone could log a victim into their own account.
+
+	query := r.URL.Query()
+	http.SetCookie(w, &http.Cookie{Path: "/auth/oidc", Name: oidcStateCookie, Value: "deleted", MaxAge: -1})
+
+	fail := func(status int, detail, reason string) {
+		proxy.Metrics.inc(metricAuth, "method", "oidc", "outcome", "failure")
+		proxy.audit(r, "auth.oidc", settings.Issuer, "failure", detail)
+		proxy.writeError(w, r, status, reason)
+	}
+
+	if e := query.Get("error"); e != "" {
+		fail(http.StatusUnauthorized, e+" "+query.Get("error_description"), "The identity provider refused the sign in.")
+		return
+	}
+
+	c, err := r.Cookie(oidcStateCookie)
+	state := query.Get("state")
+	if err != nil || state == "" || subtle.ConstantTimeCompare([]byte(c.Value), []byte(state)) != 1 {
+		fail(http.StatusBadRequest, "state mismatch", "Sign in expired, please try again.")
+		return
+	}
+
+	claims, next, err := proxy.oidc.finish(state, query.Get("code"))
+	if err != nil {
+		log.Printf("WARNING: OIDC sign in failed: %v", err)
+		fail(http.StatusUnauthorized, err.Error(), "Unable to verify the sign in.")
+		return
+	}
+
+	email, _ := claims["email"].(string)
+	if verified, _ := claims["email_verified"].(bool); email == "" || !verified {
+		fail(http.StatusForbidden, "no verified email", "Your account has no verified email address.")
+		return
+	}
+
+	external := fmt.Sprintf("oidc:%v|%v", settings.Issuer, claims["sub"])
+	user, err := proxy.Database.provisionUser(external, email, settings.roles(claims), settings.DefaultRoles)
+	if err != nil {
+		fail(http.StatusForbidden, err.Error(), "Your account can't sign in here.")
+		return
+	}
+
+	accessRecordFrom(r.Context()).User = user.Email
+
+	// As with passwords, two-factor (if on, or required) comes next:
+	// the login page picks up the challenge from the fragment.
+	if user.TOTPEnabled || proxy.mfaRequired(user) {
+		challenge, err := proxy.challenges.issue(user.ID)
+		if err != nil {
+			proxy.writeError(w, r, http.StatusInternalServerError, "Can't construct challenge.")
+			return
+		}
+		proxy.audit(r, "auth.oidc", settings.Issuer, "success", "second factor required")
+
+		target := "/"
+		if next != "/" {
+			target += "?" + url.Values{"next": {next}}.Encode()
+		}
+		step := url.Values{"challenge": {challenge}}
+		if !user.TOTPEnabled {
+			step.Set("enroll", "1")
+		}
+		http.Redirect(w, r, target+"#"+step.Encode(), http.StatusFound)
+		return
+	}
+
+	if _, _, err := proxy.startLogin(w, r, user, mkUUID()); err != nil {
+		proxy.writeError(w, r, http.StatusInternalServerError, "Can't construct token.")
+		return
+	}
+
+	proxy.Metrics.inc(metricAuth, "method", "oidc", "outcome", "success")
+	proxy.audit(r, "auth.oidc", settings.Issuer, "success", "")
+	http.Redirect(w, r, next, http.StatusFound)
+}
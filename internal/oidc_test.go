@@ -0,0 +1,308 @@
+//
+// Copyright (C) 2017 Keith Irwin
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU General Public License as published
+// by the Free Software Foundation, either version 3 of the License,
+// or (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU General Public License for more details.
+//
+// You should have received a copy of the GNU General Public License
+// along with this program.  If not, see <http://www.gnu.org/licenses/>.
+
+package internal
+
+import (
+	"crypto/ed25519"
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/pem"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"reflect"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	jwt "github.com/dgrijalva/jwt-go"
+)
+
+//-----------------------------------------------------------------------------
+// An identity provider just big enough to sign in with: it hands out
+// an ID token with whatever claims the test sets, for the nonce and
+// PKCE challenge of the last authorization request.
+//-----------------------------------------------------------------------------
+
+type testIdP struct {
+	server    *httptest.Server
+	keys      *KeyRing
+	mutex     sync.Mutex
+	claims    jwt.MapClaims
+	challenge string
+}
+
+func newTestIdP(t *testing.T) *testIdP {
+	t.Helper()
+	_, private, err := ed25519.GenerateKey(rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	der, err := x509.MarshalPKCS8PrivateKey(private)
+	if err != nil {
+		t.Fatal(err)
+	}
+	key, err := newSigningKey(pem.EncodeToMemory(&pem.Block{Type: "PRIVATE KEY", Bytes: der}))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	idp := &testIdP{keys: newKeyRing(key)}
+	mux := http.NewServeMux()
+	mux.HandleFunc("/.well-known/openid-configuration", func(w http.ResponseWriter, r *http.Request) {
+		writeJSON(w, http.StatusOK, &oidcDiscovery{
+			Issuer:                idp.server.URL,
+			AuthorizationEndpoint: idp.server.URL + "/authorize",
+			TokenEndpoint:         idp.server.URL + "/token",
+			JWKSURI:               idp.server.URL + "/jwks",
+		})
+	})
+	mux.HandleFunc("/jwks", func(w http.ResponseWriter, r *http.Request) {
+		writeJSON(w, http.StatusOK, map[string][]jwk{"keys": idp.keys.jwks()})
+	})
+	mux.HandleFunc("/token", idp.token)
+	idp.server = httptest.NewServer(mux)
+	t.Cleanup(idp.server.Close)
+	return idp
+}
+
+func (idp *testIdP) token(w http.ResponseWriter, r *http.Request) {
+	idp.mutex.Lock()
+	defer idp.mutex.Unlock()
+
+	verifier := sha256.Sum256([]byte(r.PostFormValue("code_verifier")))
+	if r.PostFormValue("code") != "code" || base64.RawURLEncoding.EncodeToString(verifier[:]) != idp.challenge {
+		writeJSON(w, http.StatusBadRequest, map[string]string{"error": "invalid_grant"})
+		return
+	}
+
+	token, err := idp.keys.sign(idp.claims)
+	if err != nil {
+		writeJSON(w, http.StatusInternalServerError, map[string]string{"error": err.Error()})
+		return
+	}
+	writeJSON(w, http.StatusOK, map[string]string{"id_token": token})
+}
+
+// authorize stands in for the browser's trip to the provider: it
+// takes the request the proxy redirected to and makes the token the
+// code will be redeemed for.
+func (idp *testIdP) authorize(t *testing.T, target string, claims jwt.MapClaims) {
+	t.Helper()
+	u, err := url.Parse(target)
+	if err != nil || !strings.HasPrefix(target, idp.server.URL+"/authorize?") {
+		t.Fatalf("redirected to %q, not the provider", target)
+	}
+	query := u.Query()
+
+	token := jwt.MapClaims{
+		"iss":   idp.server.URL,
+		"aud":   query.Get("client_id"),
+		"exp":   time.Now().Add(time.Minute).Unix(),
+		"nonce": query.Get("nonce"),
+	}
+	for k, v := range claims {
+		token[k] = v
+	}
+
+	idp.mutex.Lock()
+	defer idp.mutex.Unlock()
+	idp.claims = token
+	idp.challenge = query.Get("code_challenge")
+}
+
+func testOIDCProxy(t *testing.T, idp *testIdP) ProxyServer {
+	t.Helper()
+	proxy := newTestProxy(t)
+	err := proxy.SetOIDC(OIDCSettings{
+		Issuer:       idp.server.URL,
+		ClientID:     "launchpad",
+		RedirectURL:  "http://launchpad.test/auth/oidc/callback",
+		RolesClaim:   "groups",
+		RoleMap:      map[string]string{"ops": "admin", "staff": "user"},
+		DefaultRoles: []string{"user"},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	return proxy
+}
+
+// oidcSignIn runs a whole sign in, returning the callback's response.
+func oidcSignIn(t *testing.T, proxy ProxyServer, idp *testIdP, claims jwt.MapClaims) *http.Response {
+	t.Helper()
+
+	login := httptest.NewRecorder()
+	proxy.ServeHTTP(login, httptest.NewRequest("GET", "/auth/oidc/login?next=/apps", nil))
+	if login.Code != http.StatusFound {
+		t.Fatalf("login: %v %v", login.Code, login.Body)
+	}
+	idp.authorize(t, login.Header().Get("Location"), claims)
+
+	var state *http.Cookie
+	for _, c := range login.Result().Cookies() {
+		if c.Name == oidcStateCookie {
+			state = c
+		}
+	}
+	if state == nil {
+		t.Fatal("login set no state cookie")
+	}
+
+	callback := httptest.NewRequest("GET", "/auth/oidc/callback?"+url.Values{
+		"state": {state.Value}, "code": {"code"}}.Encode(), nil)
+	callback.AddCookie(state)
+	w := httptest.NewRecorder()
+	proxy.ServeHTTP(w, callback)
+	return w.Result()
+}
+
+func cookieNamed(resp *http.Response, name string) *http.Cookie {
+	for _, c := range resp.Cookies() {
+		if c.Name == name && c.MaxAge >= 0 {
+			return c
+		}
+	}
+	return nil
+}
+
+//-----------------------------------------------------------------------------
+
+func TestOIDCLogin(t *testing.T) {
+	idp := newTestIdP(t)
+	proxy := testOIDCProxy(t, idp)
+
+	resp := oidcSignIn(t, proxy, idp, jwt.MapClaims{
+		"sub": "1234", "email": "dana@example.com", "email_verified": true,
+		"groups": []string{"ops", "staff", "unmapped"},
+	})
+	if resp.StatusCode != http.StatusFound || resp.Header.Get("Location") != "/apps" {
+		t.Fatalf("callback: %v to %q, want a redirect to /apps", resp.Status, resp.Header.Get("Location"))
+	}
+	if cookieNamed(resp, "authToken") == nil {
+		t.Error("no auth token cookie after signing in")
+	}
+
+	user, err := proxy.Database.User("dana@example.com")
+	if err != nil {
+		t.Fatalf("dana wasn't provisioned: %v", err)
+	}
+	if user.External != "oidc:"+idp.server.URL+"|1234" || user.Password != "" {
+		t.Errorf("dana provisioned as %+v", user)
+	}
+	if !reflect.DeepEqual(user.Roles, []string{"admin", "user"}) {
+		t.Errorf("dana roles %v, want admin and user", user.Roles)
+	}
+
+	// Signing in again finds the same account, with no groups mapping
+	// leaving its roles alone.
+	resp = oidcSignIn(t, proxy, idp, jwt.MapClaims{
+		"sub": "1234", "email": "dana@example.com", "email_verified": true, "groups": []string{"unmapped"},
+	})
+	again, err := proxy.Database.User("dana@example.com")
+	if resp.StatusCode != http.StatusFound || err != nil || again.ID != user.ID {
+		t.Fatalf("second sign in: %v, %v, %+v", resp.Status, err, again)
+	}
+	if !reflect.DeepEqual(again.Roles, []string{"admin", "user"}) {
+		t.Errorf("dana roles %v after unmapped groups, want admin and user", again.Roles)
+	}
+}
+
+func TestOIDCRequiresVerifiedEmail(t *testing.T) {
+	idp := newTestIdP(t)
+	proxy := testOIDCProxy(t, idp)
+
+	for _, claims := range []jwt.MapClaims{
+		{"sub": "1", "email": "erin@example.com"},
+		{"sub": "2", "email": "erin@example.com", "email_verified": false},
+		{"sub": "3", "email": "erin@example.com", "email_verified": "true"},
+		{"sub": "4", "email_verified": true},
+	} {
+		resp := oidcSignIn(t, proxy, idp, claims)
+		if resp.StatusCode != http.StatusForbidden || cookieNamed(resp, "authToken") != nil {
+			t.Errorf("%v: got %v, want %v with no token", claims, resp.Status, http.StatusForbidden)
+		}
+	}
+	if _, err := proxy.Database.User("erin@example.com"); err != errUserNotFound {
+		t.Errorf("unverified sign in provisioned a user (%v)", err)
+	}
+}
+
+func TestOIDCDoesNotLinkLocalAccounts(t *testing.T) {
+	idp := newTestIdP(t)
+	proxy := testOIDCProxy(t, idp)
+
+	local, err := proxy.Database.CreateUser("frank@example.com", "frank-password-1", []string{"admin"})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	resp := oidcSignIn(t, proxy, idp, jwt.MapClaims{"sub": "9", "email": "frank@example.com", "email_verified": true})
+	if resp.StatusCode != http.StatusForbidden || cookieNamed(resp, "authToken") != nil {
+		t.Errorf("sign in as a local account: %v, want %v with no token", resp.Status, http.StatusForbidden)
+	}
+	if user, _ := proxy.Database.User("frank@example.com"); user.External != "" || user.ID != local.ID {
+		t.Errorf("local account changed to %+v", user)
+	}
+}
+
+func TestOIDCSecondFactor(t *testing.T) {
+	idp := newTestIdP(t)
+	proxy := testOIDCProxy(t, idp)
+	proxy.RequireMFA([]string{"admin"})
+
+	resp := oidcSignIn(t, proxy, idp, jwt.MapClaims{
+		"sub": "5", "email": "gail@example.com", "email_verified": true, "groups": []string{"ops"},
+	})
+	if resp.StatusCode != http.StatusFound || cookieNamed(resp, "authToken") != nil {
+		t.Fatalf("callback: %v, want a redirect with no token yet", resp.Status)
+	}
+
+	target, err := url.Parse(resp.Header.Get("Location"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	step, _ := url.ParseQuery(target.Fragment)
+	if target.Path != "/" || target.Query().Get("next") != "/apps" || step.Get("challenge") == "" || step.Get("enroll") != "1" {
+		t.Errorf("redirected to %q, want the login page with a challenge to enroll", target)
+	}
+}
+
+func TestOIDCRejectsBadTokens(t *testing.T) {
+	idp := newTestIdP(t)
+	proxy := testOIDCProxy(t, idp)
+
+	for name, claims := range map[string]jwt.MapClaims{
+		"other audience": {"aud": "someone-else"},
+		"other issuer":   {"iss": "https://evil.example.com"},
+		"wrong nonce":    {"nonce": "guessed"},
+		"expired":        {"exp": time.Now().Add(-time.Minute).Unix()},
+		"no subject":     {"sub": ""},
+	} {
+		claims["email"], claims["email_verified"] = "hank@example.com", true
+		if _, ok := claims["sub"]; !ok {
+			claims["sub"] = "7"
+		}
+		resp := oidcSignIn(t, proxy, idp, claims)
+		if resp.StatusCode != http.StatusUnauthorized || cookieNamed(resp, "authToken") != nil {
+			t.Errorf("%v: got %v, want %v with no token", name, resp.Status, http.StatusUnauthorized)
+		}
+	}
+}
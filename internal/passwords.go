@@ -0,0 +1,423 @@
+//
+// Copyright (C) 2017 Keith Irwin
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU General Public License as published
+// by the Free Software Foundation, either version 3 of the License,
+// or (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU General Public License for more details.
+//
+// You should have received a copy of the GNU General Public License
+// along with this program.  If not, see <http://www.gnu.org/licenses/>.
+
+package internal
+
+import (
+	"bufio"
+	"crypto/rand"
+	"crypto/sha1"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"net/http"
+	"net/url"
+	"os"
+	"regexp"
+	"strings"
+	"sync"
+	"time"
+	"unicode/utf8"
+)
+
+//-----------------------------------------------------------------------------
+// Password policy, and users changing (or, by email, resetting) their
+// own passwords.
+//
+//   POST /password         -- {"current": .., "password": ..}
+//   POST /password/forgot  -- {"email": ..} mail a reset link
+//   POST /password/reset   -- {"token": .., "password": ..}
+//
+// Either way the user's sessions all end. A change signs the caller
+// back in; a reset doesn't, so a second factor is still asked for.
+// Accounts from single sign on or a directory have no password here.
+//-----------------------------------------------------------------------------
+
+var sha1Line = regexp.MustCompile(`^[0-9A-Fa-f]{40}(:\d+)?$`)
+
+// SetPasswordPolicy sets the minimum password length and, if given, a
+// file of breached passwords to refuse: one per line, either the
+// password itself or its SHA-1 in hex (as in the "Have I Been Pwned"
+// lists, with or without ":count").
+func (db *Database) SetPasswordPolicy(minLength int, breachedList string) error {
+	if minLength < 1 {
+		return errors.New("minimum password length must be at least 1")
+	}
+	db.passwordMinLength = minLength
+
+	if breachedList == "" {
+		return nil
+	}
+
+	file, err := os.Open(breachedList)
+	if err != nil {
+		return err
+	}
+	defer file.Close()
+
+	hashes := make(map[string]bool)
+	scanner := bufio.NewScanner(file)
+	for scanner.Scan() {
+		line := strings.TrimRight(scanner.Text(), "\r")
+		switch {
+		case line == "":
+		case sha1Line.MatchString(line):
+			hashes[strings.ToUpper(line[:40])] = true
+		default:
+			hashes[passwordSHA1(line)] = true
+		}
+	}
+	if err := scanner.Err(); err != nil {
+		return fmt.Errorf("reading '%v': %v", breachedList, err)
+	}
+
+	db.breachedPasswords = hashes
+	log.Printf("- refusing %v breached passwords from '%v'", len(hashes), breachedList)
+	return nil
+}
+
+func passwordSHA1(password string) string {
+	sum := sha1.Sum([]byte(password))
+	return strings.ToUpper(hex.EncodeToString(sum[:]))
+}
+
+func (db *Database) checkPassword(password string) error {
+	if utf8.RuneCountInString(password) < db.passwordMinLength {
+		return fmt.Errorf("password must be at least %v characters", db.passwordMinLength)
+	}
+	if db.breachedPasswords[passwordSHA1(password)] {
+		return errors.New("password is on a list of breached passwords, choose another")
+	}
+	return nil
+}
+
+//-----------------------------------------------------------------------------
+
+// resetCooldown is how long before another reset email goes to the
+// same account.
+const resetCooldown = time.Minute
+
+type resetRecord struct {
+	userID  string
+	expires time.Time
+}
+
+// resetStore keeps the (hashed) outstanding reset tokens. Each is good
+// once, and a new one replaces any the user had.
+type resetStore struct {
+	mutex  sync.Mutex
+	ttl    time.Duration
+	tokens map[string]*resetRecord
+	sent   map[string]time.Time
+}
+
+func newResetStore() *resetStore {
+	return &resetStore{
+		ttl:    30 * time.Minute,
+		tokens: make(map[string]*resetRecord),
+		sent:   make(map[string]time.Time),
+	}
+}
+
+func (store *resetStore) lifetime() time.Duration {
+	store.mutex.Lock()
+	defer store.mutex.Unlock()
+	return store.ttl
+}
+
+func (store *resetStore) issue(userID string) (string, error) {
+	raw := make([]byte, 32)
+	if _, err := rand.Read(raw); err != nil {
+		return "", err
+	}
+	token := base64.RawURLEncoding.EncodeToString(raw)
+
+	store.mutex.Lock()
+	defer store.mutex.Unlock()
+
+	now := time.Now()
+	if sent, ok := store.sent[userID]; ok && now.Sub(sent) < resetCooldown {
+		return "", errors.New("reset link sent too recently")
+	}
+	for id, sent := range store.sent {
+		if now.Sub(sent) >= resetCooldown {
+			delete(store.sent, id)
+		}
+	}
+
+	store.revokeLocked(userID)
+	for key, rec := range store.tokens {
+		if now.After(rec.expires) {
+			delete(store.tokens, key)
+		}
+	}
+
+	store.tokens[hashRefresh(token)] = &resetRecord{userID: userID, expires: now.Add(store.ttl)}
+	store.sent[userID] = now
+	return token, nil
+}
+
+// redeem uses up a token, returning its user.
+func (store *resetStore) redeem(token string) (string, bool) {
+	store.mutex.Lock()
+	defer store.mutex.Unlock()
+
+	key := hashRefresh(token)
+	rec, ok := store.tokens[key]
+	if !ok {
+		return "", false
+	}
+	delete(store.tokens, key)
+	if time.Now().After(rec.expires) {
+		return "", false
+	}
+	return rec.userID, true
+}
+
+func (store *resetStore) revoke(userID string) {
+	store.mutex.Lock()
+	defer store.mutex.Unlock()
+	store.revokeLocked(userID)
+}
+
+func (store *resetStore) revokeLocked(userID string) {
+	for key, rec := range store.tokens {
+		if rec.userID == userID {
+			delete(store.tokens, key)
+		}
+	}
+}
+
+// SetPasswordReset lets users reset forgotten passwords with a link
+// mailed through the relay, good for ttl.
+func (proxy ProxyServer) SetPasswordReset(mail MailSettings, ttl time.Duration) error {
+	if proxy.forwardAuthSettings().PublicURL == "" {
+		return errors.New("reset links need the proxy's public URL")
+	}
+	if err := proxy.mailer.set(mail); err != nil {
+		return err
+	}
+	proxy.resets.mutex.Lock()
+	proxy.resets.ttl = ttl
+	proxy.resets.mutex.Unlock()
+	log.Printf("- password reset links mailed via '%v', good for %v", mail.Relay, ttl)
+	return nil
+}
+
+//-----------------------------------------------------------------------------
+
+type passwordRequest struct {
+	Current  string `json:"current"`
+	Password string `json:"password"`
+	Email    string `json:"email"`
+	Token    string `json:"token"`
+}
+
+const resetSubject = "Reset your Launchpad password"
+
+const resetBody = `Someone (hopefully you) asked to reset the password for %v.
+
+To choose a new password, follow this link within %v:
+
+%v
+
+If you didn't ask, ignore this message; your password stays the same.
+`
+
+func (proxy ProxyServer) handlePassword(w http.ResponseWriter, r *http.Request) {
+
+	var params passwordRequest
+	if err := json.NewDecoder(r.Body).Decode(&params); err != nil {
+		proxy.writeError(w, r, http.StatusBadRequest, "Can't deserialize password request.")
+		return
+	}
+
+	switch strings.Trim(removePathContext(r), "/") {
+	case "":
+		proxy.changePassword(w, r, params)
+	case "forgot":
+		proxy.forgotPassword(w, r, params)
+	case "reset":
+		proxy.resetPassword(w, r, params)
+	default:
+		proxy.writeError(w, r, http.StatusNotFound, "Unknown password resource.")
+	}
+}
+
+func (proxy ProxyServer) changePassword(w http.ResponseWriter, r *http.Request, params passwordRequest) {
+	token, err := proxy.checkAuth(w, r)
+	if err != nil {
+		proxy.writeError(w, r, http.StatusUnauthorized, err.Error())
+		return
+	}
+
+	viewer, err := proxy.decodeAuthToken(token)
+	if err != nil {
+		proxy.writeError(w, r, http.StatusUnauthorized, err.Error())
+		return
+	}
+
+	user, err := proxy.Database.findUserByID(viewer.ID)
+	if err != nil {
+		proxy.writeError(w, r, http.StatusUnauthorized, badAuthMsg)
+		return
+	}
+
+	if user.External != "" {
+		proxy.writeError(w, r, http.StatusBadRequest, "Your password is managed elsewhere.")
+		return
+	}
+
+	// Guessing the current password here counts as failed logins.
+	account, ip := accountKey(user.Email), ipKey(proxy.clientIP(r).String())
+	if proxy.throttled(w, r, account, ip) {
+		return
+	}
+
+	if !validPassword(params.Current, user.Password) {
+		proxy.loginFailed(r, account, ip)
+		proxy.audit(r, "password.change", user.Email, "failure", "wrong current password")
+		proxy.writeError(w, r, http.StatusForbidden, "Current password is wrong.")
+		return
+	}
+
+	if _, err := proxy.Database.SetPassword(user.ID, params.Password); err != nil {
+		proxy.audit(r, "password.change", user.Email, "failure", err.Error())
+		proxy.writeError(w, r, http.StatusBadRequest, err.Error())
+		return
+	}
+
+	proxy.throttle.succeed(account, ip)
+	proxy.resets.revoke(user.ID)
+	proxy.endUserSessions(r, user.ID, "password.change")
+	log.Printf("- password.change: '%v'", user.Email)
+	proxy.audit(r, "password.change", user.Email, "success", "")
+
+	token, refresh, err := proxy.startLogin(w, r, user, mkUUID())
+	if err != nil {
+		proxy.writeError(w, r, http.StatusInternalServerError, "Can't construct token.")
+		return
+	}
+
+	writeJSON(w, http.StatusOK, authRequest{
+		Token:        token,
+		Email:        user.Email,
+		RefreshToken: refresh,
+		ExpiresIn:    int(proxy.auth.accessTTL.Seconds()),
+	})
+}
+
+// forgotPassword answers the same whether or not the account exists,
+// and mails in the background so timing doesn't tell either.
+func (proxy ProxyServer) forgotPassword(w http.ResponseWriter, r *http.Request, params passwordRequest) {
+	if proxy.mailer.config() == nil {
+		proxy.writeError(w, r, http.StatusNotFound, "Password reset isn't available.")
+		return
+	}
+
+	email := strings.TrimSpace(params.Email)
+	if email == "" {
+		proxy.writeError(w, r, http.StatusBadRequest, "An email address is required.")
+		return
+	}
+
+	// Asking isn't a guess, so it only waits out lockouts; it doesn't
+	// add to them.
+	account, ip := accountKey(email), ipKey(proxy.clientIP(r).String())
+	if proxy.tooSoon(w, r, proxy.throttle.check(account, ip)) {
+		return
+	}
+
+	link := proxy.forwardAuthSettings().PublicURL + "/?reset="
+	entry := proxy.auditEntry(r, "password.reset.request", email)
+
+	go func() {
+		entry.Outcome = "failure"
+		defer func() { proxy.Audit.write(entry) }()
+
+		user, err := proxy.Database.User(email)
+		switch {
+		case err != nil:
+			entry.Detail = "no such user"
+			return
+		case user.Disabled || user.External != "":
+			entry.Detail = "account can't reset its password"
+			return
+		}
+
+		token, err := proxy.resets.issue(user.ID)
+		if err != nil {
+			entry.Detail = err.Error()
+			return
+		}
+
+		body := fmt.Sprintf(resetBody, user.Email, proxy.resets.lifetime(), link+url.QueryEscape(token))
+		if err := proxy.mailer.send(user.Email, resetSubject, body); err != nil {
+			log.Printf("WARNING: unable to mail reset link to '%v': %v", user.Email, err)
+			proxy.resets.revoke(user.ID)
+			entry.Detail = err.Error()
+			return
+		}
+
+		log.Printf("- password reset link mailed to '%v'", user.Email)
+		entry.Outcome = "success"
+	}()
+
+	writeJSON(w, http.StatusAccepted, map[string]string{
+		"message": "If the account can reset its password, a link is on its way.",
+	})
+}
+
+func (proxy ProxyServer) resetPassword(w http.ResponseWriter, r *http.Request, params passwordRequest) {
+	// Check the new password first, so a weak one doesn't use up the
+	// link.
+	if err := proxy.Database.checkPassword(params.Password); err != nil {
+		proxy.writeError(w, r, http.StatusBadRequest, err.Error())
+		return
+	}
+
+	// Bad links count against the address like failed logins, so
+	// tokens can't be guessed at speed.
+	ip := ipKey(proxy.clientIP(r).String())
+	if proxy.throttled(w, r, ip) {
+		return
+	}
+
+	userID, ok := proxy.resets.redeem(params.Token)
+	if !ok {
+		proxy.loginFailed(r, ip)
+		proxy.audit(r, "password.reset", "", "failure", "invalid or expired link")
+		proxy.writeError(w, r, http.StatusBadRequest, "The reset link is invalid or has expired.")
+		return
+	}
+
+	user, err := proxy.Database.SetPassword(userID, params.Password)
+	if err != nil {
+		proxy.audit(r, "password.reset", userID, "failure", err.Error())
+		proxy.writeError(w, r, http.StatusBadRequest, err.Error())
+		return
+	}
+
+	// Whoever holds the mailbox holds the account, so lift lockouts.
+	proxy.throttle.succeed(accountKey(user.Email), ip)
+	proxy.endUserSessions(r, user.ID, "password.reset")
+	log.Printf("- password.reset: '%v'", user.Email)
+	proxy.audit(r, "password.reset", user.Email, "success", "")
+	w.WriteHeader(http.StatusNoContent)
+}
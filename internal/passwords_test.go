@@ -0,0 +1,208 @@
+//
+// Copyright (C) 2017 Keith Irwin
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU General Public License as published
+// by the Free Software Foundation, either version 3 of the License,
+// or (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU General Public License for more details.
+//
+// You should have received a copy of the GNU General Public License
+// along with this program.  If not, see <http://www.gnu.org/licenses/>.
+
+package internal
+
+import (
+	"bytes"
+	"encoding/json"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"net/textproto"
+	"net/url"
+	"regexp"
+	"strings"
+	"testing"
+	"time"
+)
+
+//-----------------------------------------------------------------------------
+// A relay just big enough to take mail: each message's data goes on
+// the channel.
+//-----------------------------------------------------------------------------
+
+func serveSMTP(t *testing.T) (string, chan string) {
+	t.Helper()
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { listener.Close() })
+
+	messages := make(chan string, 10)
+	go func() {
+		for {
+			conn, err := listener.Accept()
+			if err != nil {
+				return
+			}
+			go func() {
+				defer conn.Close()
+				text := textproto.NewConn(conn)
+				text.PrintfLine("220 relay.test")
+				for {
+					line, err := text.ReadLine()
+					if err != nil {
+						return
+					}
+					switch verb := strings.ToUpper(strings.SplitN(line, " ", 2)[0]); verb {
+					case "EHLO", "HELO", "MAIL", "RCPT", "RSET", "NOOP":
+						text.PrintfLine("250 ok")
+					case "DATA":
+						text.PrintfLine("354 go ahead")
+						data, err := text.ReadDotLines()
+						if err != nil {
+							return
+						}
+						messages <- strings.Join(data, "\n")
+						text.PrintfLine("250 queued")
+					case "QUIT":
+						text.PrintfLine("221 bye")
+						return
+					default:
+						text.PrintfLine("502 %v not implemented", verb)
+					}
+				}
+			}()
+		}
+	}()
+	return listener.Addr().String(), messages
+}
+
+func testResetProxy(t *testing.T) (ProxyServer, chan string) {
+	t.Helper()
+	proxy := newTestProxy(t)
+	if _, err := proxy.Database.CreateUser("ivy@example.com", "ivy-password-1", []string{"user"}); err != nil {
+		t.Fatal(err)
+	}
+
+	relay, messages := serveSMTP(t)
+	proxy.SetForwardAuth(ForwardAuthSettings{PublicURL: "https://launchpad.test"})
+	if err := proxy.SetPasswordReset(MailSettings{Relay: relay, From: "launchpad@example.com"}, time.Minute); err != nil {
+		t.Fatal(err)
+	}
+	return proxy, messages
+}
+
+// post sends JSON to the proxy, with a bearer token if given.
+func post(proxy ProxyServer, path, token string, body interface{}) *httptest.ResponseRecorder {
+	data, _ := json.Marshal(body)
+	r := httptest.NewRequest("POST", path, bytes.NewReader(data))
+	if token != "" {
+		r.Header.Set("Authorization", "Bearer "+token)
+	}
+	w := httptest.NewRecorder()
+	proxy.ServeHTTP(w, r)
+	return w
+}
+
+func testLogin(t *testing.T, proxy ProxyServer, email, password string) (string, int) {
+	t.Helper()
+	w := post(proxy, "/auth", "", map[string]string{"email": email, "password": password})
+	var reply authRequest
+	json.NewDecoder(w.Body).Decode(&reply)
+	return reply.Token, w.Code
+}
+
+var resetLink = regexp.MustCompile(`https://launchpad\.test/\?reset=(\S+)`)
+
+//-----------------------------------------------------------------------------
+
+func TestPasswordResetByMail(t *testing.T) {
+	proxy, messages := testResetProxy(t)
+
+	session, code := testLogin(t, proxy, "ivy@example.com", "ivy-password-1")
+	if code != http.StatusOK {
+		t.Fatalf("login: %v", code)
+	}
+
+	// Unknown accounts get the same answer, and no mail.
+	for _, email := range []string{"nobody@example.com", "ivy@example.com"} {
+		if w := post(proxy, "/password/forgot", "", map[string]string{"email": email}); w.Code != http.StatusAccepted {
+			t.Fatalf("forgot %v: %v %v", email, w.Code, w.Body)
+		}
+	}
+
+	var message string
+	select {
+	case message = <-messages:
+	case <-time.After(5 * time.Second):
+		t.Fatal("no reset mail")
+	}
+	if !strings.Contains(message, "To: ivy@example.com") || !strings.Contains(message, "Subject: "+resetSubject) {
+		t.Errorf("reset mail headers:\n%v", message)
+	}
+	match := resetLink.FindStringSubmatch(message)
+	if match == nil {
+		t.Fatalf("no reset link in:\n%v", message)
+	}
+	token, err := url.QueryUnescape(match[1])
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	select {
+	case extra := <-messages:
+		t.Errorf("more than one mail sent:\n%v", extra)
+	case <-time.After(200 * time.Millisecond):
+	}
+
+	// A weak password doesn't use up the link.
+	if w := post(proxy, "/password/reset", "", map[string]string{"token": token, "password": "short"}); w.Code != http.StatusBadRequest {
+		t.Errorf("weak password: %v, want %v", w.Code, http.StatusBadRequest)
+	}
+	if w := post(proxy, "/password/reset", "", map[string]string{"token": token, "password": "ivy-password-2"}); w.Code != http.StatusNoContent {
+		t.Fatalf("reset: %v %v", w.Code, w.Body)
+	}
+	if w := post(proxy, "/password/reset", "", map[string]string{"token": token, "password": "ivy-password-3"}); w.Code != http.StatusBadRequest {
+		t.Errorf("reusing the link: %v, want %v", w.Code, http.StatusBadRequest)
+	}
+
+	r := httptest.NewRequest("GET", "/sessions", nil)
+	r.Header.Set("Authorization", "Bearer "+session)
+	w := httptest.NewRecorder()
+	proxy.ServeHTTP(w, r)
+	if w.Code != http.StatusUnauthorized {
+		t.Errorf("session from before the reset: %v, want %v", w.Code, http.StatusUnauthorized)
+	}
+
+	if _, code := testLogin(t, proxy, "ivy@example.com", "ivy-password-1"); code != http.StatusUnauthorized {
+		t.Errorf("old password: %v, want %v", code, http.StatusUnauthorized)
+	}
+	if _, code := testLogin(t, proxy, "ivy@example.com", "ivy-password-2"); code != http.StatusOK {
+		t.Errorf("new password: %v, want %v", code, http.StatusOK)
+	}
+}
+
+func TestPasswordResetThrottled(t *testing.T) {
+	proxy, _ := testResetProxy(t)
+
+	throttled := false
+	for i := 0; i < 20 && !throttled; i++ {
+		w := post(proxy, "/password/reset", "", map[string]string{"token": "guess", "password": "ivy-password-2"})
+		switch w.Code {
+		case http.StatusBadRequest:
+		case http.StatusTooManyRequests:
+			throttled = w.Header().Get("Retry-After") != ""
+		default:
+			t.Fatalf("guess %v: %v %v", i, w.Code, w.Body)
+		}
+	}
+	if !throttled {
+		t.Error("guessing reset links was never throttled")
+	}
+}
@@ -0,0 +1,185 @@
+//
+// Copyright (C) 2017 Keith Irwin
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU General Public License as published
+// by the Free Software Foundation, either version 3 of the License,
+// or (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU General Public License for more details.
+//
+// You should have received a copy of the GNU General Public License
+// along with this program.  If not, see <http://www.gnu.org/licenses/>.
+
+package internal
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"log"
+	"net/http"
+	"sync"
+)
+
+//-----------------------------------------------------------------------------
+// Role based access control. A policy maps route contexts, installed
+// app contexts and commands to the roles allowed to use them. A "*"
+// key covers anything not listed by name, and a "*" role means any
+// authenticated user. Anything not covered at all is open to any
+// authenticated user, except the proxy's own endpoints: the default
+// rules for those apply unless a policy names them.
+//-----------------------------------------------------------------------------
+
+// Policy says which roles may use which routes, apps and commands.
+type Policy struct {
+	Routes   map[string][]string `json:"routes"`
+	Apps     map[string][]string `json:"apps"`
+	Commands map[string][]string `json:"commands"`
+}
+
+const (
+	policyRoute   = "route"
+	policyApp     = "app"
+	policyCommand = "command"
+)
+
+// DefaultPolicy keeps the proxy's own admin surface to admins and
+// leaves everything else open to any authenticated user.
+func DefaultPolicy() Policy {
+	return Policy{
+		Routes: map[string][]string{
+			"admin":   {"admin"},
+			"metrics": {"admin"},
+		},
+	}
+}
+
+// LoadPolicy reads a policy from a JSON file.
+func LoadPolicy(path string) (Policy, error) {
+	var policy Policy
+	data, err := ioutil.ReadFile(path)
+	if err != nil {
+		return policy, err
+	}
+	err = json.Unmarshal(data, &policy)
+	return policy, err
+}
+
+// withDefaults adds the default rules for anything the policy doesn't
+// name, so leaving out "admin" can't open the admin endpoints.
+func (policy Policy) withDefaults() Policy {
+	routes := make(map[string][]string, len(policy.Routes))
+	for name, roles := range DefaultPolicy().Routes {
+		routes[name] = roles
+	}
+	for name, roles := range policy.Routes {
+		routes[name] = roles
+	}
+	policy.Routes = routes
+	return policy
+}
+
+func (policy Policy) rules(kind string) map[string][]string {
+	switch kind {
+	case policyRoute:
+		return policy.Routes
+	case policyApp:
+		return policy.Apps
+	case policyCommand:
+		return policy.Commands
+	}
+	return nil
+}
+
+func (policy Policy) allows(kind, name string, roles []string) bool {
+	rules := policy.rules(kind)
+
+	allowed, ok := rules[name]
+	if !ok {
+		allowed, ok = rules["*"]
+	}
+	if !ok {
+		return true
+	}
+
+	for _, a := range allowed {
+		if a == "*" {
+			return true
+		}
+		for _, role := range roles {
+			if a == role {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+//-----------------------------------------------------------------------------
+
+type policyHolder struct {
+	mutex  sync.RWMutex
+	policy Policy
+}
+
+func newPolicyHolder() *policyHolder {
+	return &policyHolder{policy: DefaultPolicy()}
+}
+
+func (holder *policyHolder) get() Policy {
+	holder.mutex.RLock()
+	defer holder.mutex.RUnlock()
+	return holder.policy
+}
+
+func (holder *policyHolder) set(policy Policy) {
+	holder.mutex.Lock()
+	defer holder.mutex.Unlock()
+	holder.policy = policy
+}
+
+// SetPolicy replaces the access control policy. The default rules
+// still apply to anything it doesn't name.
+func (proxy ProxyServer) SetPolicy(policy Policy) {
+	proxy.policy.set(policy.withDefaults())
+}
+
+func (proxy ProxyServer) viewerRoles(token string) []string {
+	viewer, err := proxy.decodeAuthToken(token)
+	if err != nil {
+		return nil
+	}
+	return viewer.Roles
+}
+
+// permit checks the authenticated user's roles against the policy,
+// writing a 403 (and an audit entry) if they're not allowed.
+func (proxy ProxyServer) permit(w http.ResponseWriter, r *http.Request, token, kind, name string) bool {
+	roles := proxy.viewerRoles(token)
+	if proxy.policy.get().allows(kind, name, roles) {
+		return true
+	}
+
+	log.Printf("- rbac.denied: [%v] %v '%v' (roles %v)",
+		accessRecordFrom(r.Context()).User, kind, name, roles)
+	proxy.audit(r, "access."+kind, name, "denied", "missing role")
+	proxy.writeError(w, r, http.StatusForbidden, "You don't have permission to do that.")
+	return false
+}
+
+// visibleApps filters installed apps to those the user may launch.
+func (proxy ProxyServer) visibleApps(token string, apps []*InstalledApp) []*InstalledApp {
+	policy := proxy.policy.get()
+	roles := proxy.viewerRoles(token)
+
+	result := make([]*InstalledApp, 0, len(apps))
+	for _, app := range apps {
+		if policy.allows(policyApp, app.Context, roles) {
+			result = append(result, app)
+		}
+	}
+	return result
+}
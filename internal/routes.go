@@ -0,0 +1,312 @@
+//
+// Copyright (C) 2017 Keith Irwin
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU General Public License as published
+// by the Free Software Foundation, either version 3 of the License,
+// or (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU General Public License for more details.
+//
+// You should have received a copy of the GNU General Public License
+// along with this program.  If not, see <http://www.gnu.org/licenses/>.
+
+package internal
+
+import (
+	"fmt"
+	"hash/fnv"
+	"net/http"
+	"sort"
+	"strings"
+	"sync"
+)
+
+//-----------------------------------------------------------------------------
+// Routes map a context (the first path segment) to one or more named
+// upstream groups. Traffic is split between groups by weight, or, on
+// routes that allow it, pinned to a group by header or cookie.
+//-----------------------------------------------------------------------------
+
+const defaultUpstream = "default"
+const defaultPinHeader = "X-Proxy-Upstream"
+const defaultPinCookie = "proxyUpstream"
+const stickyCookie = "proxySticky"
+
+type upstream struct {
+	Name   string `json:"name"`
+	Addr   string `json:"addr"`
+	Weight int    `json:"weight"`
+}
+
+type route struct {
+	Context     string      `json:"context"`
+	Upstreams   []*upstream `json:"upstreams"`
+	PinHeader   string      `json:"pin_header"`
+	PinCookie   string      `json:"pin_cookie"`
+	CORS        *CORSPolicy `json:"cors,omitempty"`
+	Public      bool        `json:"public"`
+	PublicPaths []string    `json:"public_paths,omitempty"`
+	CSRFExempt  bool        `json:"csrf_exempt"`
+}
+
+func newRoute(context string) *route {
+	return &route{
+		Context:   context,
+		Upstreams: make([]*upstream, 0),
+	}
+}
+
+func (rt *route) copy() *route {
+	result := *rt
+	result.PublicPaths = append([]string(nil), rt.PublicPaths...)
+	result.Upstreams = make([]*upstream, 0, len(rt.Upstreams))
+	for _, u := range rt.Upstreams {
+		c := *u
+		result.Upstreams = append(result.Upstreams, &c)
+	}
+	return &result
+}
+
+func (rt *route) upstream(name string) *upstream {
+	for _, u := range rt.Upstreams {
+		if u.Name == name {
+			return u
+		}
+	}
+	return nil
+}
+
+// isPublic returns true if path (with the context removed) may be
+// served without authentication: the whole route is public, or path is
+// one of the public paths or underneath one.
+func (rt *route) isPublic(path string) bool {
+	if rt.Public {
+		return true
+	}
+	for _, p := range rt.PublicPaths {
+		p = strings.TrimSuffix(p, "/")
+		if path == p || strings.HasPrefix(path, p+"/") {
+			return true
+		}
+	}
+	return false
+}
+
+// choose picks the upstream for a request. An explicit pin (header,
+// then cookie), if the route allows pinning, wins. Otherwise the key
+// (a user ID or sticky cookie) is hashed onto the weights so the same
+// key lands on the same group for as long as the weights stay put.
+// Because groups keep their insertion order, ramping up the last group
+// (the canary) only ever moves keys into it.
+func (rt *route) choose(r *http.Request, key string) *upstream {
+	if rt.PinHeader != "" {
+		if u := rt.upstream(r.Header.Get(rt.PinHeader)); u != nil {
+			return u
+		}
+	}
+
+	if rt.PinCookie != "" {
+		if c, err := r.Cookie(rt.PinCookie); err == nil {
+			if u := rt.upstream(c.Value); u != nil {
+				return u
+			}
+		}
+	}
+
+	total := 0
+	for _, u := range rt.Upstreams {
+		total += u.Weight
+	}
+
+	if total <= 0 {
+		if len(rt.Upstreams) == 0 {
+			return nil
+		}
+		return rt.Upstreams[0]
+	}
+
+	h := fnv.New32a()
+	h.Write([]byte(rt.Context + "/" + key))
+	point := int(uint64(h.Sum32()%10000) * uint64(total) / 10000)
+
+	for _, u := range rt.Upstreams {
+		if point < u.Weight {
+			return u
+		}
+		point -= u.Weight
+	}
+
+	return rt.Upstreams[len(rt.Upstreams)-1]
+}
+
+//-----------------------------------------------------------------------------
+
+type routeTable struct {
+	mutex  sync.RWMutex
+	routes map[string]*route
+}
+
+func newProxyRoutes() *routeTable {
+	return &routeTable{
+		routes: make(map[string]*route),
+	}
+}
+
+// Set routes a context to a single default upstream.
+func (routes *routeTable) Set(context, addr string) {
+	routes.SetUpstream(context, defaultUpstream, addr, 100)
+}
+
+// SetUpstream adds (or replaces) a named upstream group for a context.
+func (routes *routeTable) SetUpstream(context, name, addr string, weight int) {
+	routes.mutex.Lock()
+	defer routes.mutex.Unlock()
+
+	rt, ok := routes.routes[context]
+	if !ok {
+		rt = newRoute(context)
+		routes.routes[context] = rt
+	}
+
+	if u := rt.upstream(name); u != nil {
+		u.Addr = addr
+		u.Weight = weight
+		return
+	}
+
+	rt.Upstreams = append(rt.Upstreams, &upstream{name, addr, weight})
+}
+
+// SetPinning sets the header and cookie clients may use to pin
+// requests to an upstream group ("" for neither). Routes don't allow
+// pinning until this is called.
+func (routes *routeTable) SetPinning(context, header, cookie string) error {
+	routes.mutex.Lock()
+	defer routes.mutex.Unlock()
+
+	rt, ok := routes.routes[context]
+	if !ok {
+		return fmt.Errorf("route '%v' not found", context)
+	}
+
+	rt.PinHeader = header
+	rt.PinCookie = cookie
+	return nil
+}
+
+// SetCORS sets (or with nil, removes) the CORS policy for a context.
+func (routes *routeTable) SetCORS(context string, policy *CORSPolicy) error {
+	routes.mutex.Lock()
+	defer routes.mutex.Unlock()
+
+	rt, ok := routes.routes[context]
+	if !ok {
+		return fmt.Errorf("route '%v' not found", context)
+	}
+
+	if policy != nil {
+		if err := policy.validate(); err != nil {
+			return err
+		}
+	}
+
+	rt.CORS = policy
+	return nil
+}
+
+// SetPublic opens a whole context (or with paths, just those paths and
+// anything under them) to unauthenticated requests.
+func (routes *routeTable) SetPublic(context string, public bool, paths []string) error {
+	routes.mutex.Lock()
+	defer routes.mutex.Unlock()
+
+	rt, ok := routes.routes[context]
+	if !ok {
+		return fmt.Errorf("route '%v' not found", context)
+	}
+
+	for _, p := range paths {
+		if !strings.HasPrefix(p, "/") {
+			return fmt.Errorf("public path '%v' must start with '/'", p)
+		}
+	}
+
+	rt.Public = public
+	rt.PublicPaths = paths
+	return nil
+}
+
+// SetCSRFExempt turns CSRF checks off (or back on) for a context.
+func (routes *routeTable) SetCSRFExempt(context string, exempt bool) error {
+	routes.mutex.Lock()
+	defer routes.mutex.Unlock()
+
+	rt, ok := routes.routes[context]
+	if !ok {
+		return fmt.Errorf("route '%v' not found", context)
+	}
+
+	rt.CSRFExempt = exempt
+	return nil
+}
+
+// SetWeights adjusts the traffic split for a context. Groups not
+// mentioned keep their current weight.
+func (routes *routeTable) SetWeights(context string, weights map[string]int) error {
+	routes.mutex.Lock()
+	defer routes.mutex.Unlock()
+
+	rt, ok := routes.routes[context]
+	if !ok {
+		return fmt.Errorf("route '%v' not found", context)
+	}
+
+	for name, weight := range weights {
+		if rt.upstream(name) == nil {
+			return fmt.Errorf("upstream '%v' not found for route '%v'", name, context)
+		}
+		if weight < 0 {
+			return fmt.Errorf("weight for '%v' must not be negative", name)
+		}
+	}
+
+	for name, weight := range weights {
+		rt.upstream(name).Weight = weight
+	}
+	return nil
+}
+
+func (routes *routeTable) has(context string) bool {
+	routes.mutex.RLock()
+	defer routes.mutex.RUnlock()
+	_, ok := routes.routes[context]
+	return ok
+}
+
+func (routes *routeTable) find(context string) *route {
+	routes.mutex.RLock()
+	defer routes.mutex.RUnlock()
+	if rt, ok := routes.routes[context]; ok {
+		return rt.copy()
+	}
+	return nil
+}
+
+func (routes *routeTable) list() []*route {
+	routes.mutex.RLock()
+	defer routes.mutex.RUnlock()
+
+	result := make([]*route, 0, len(routes.routes))
+	for _, rt := range routes.routes {
+		result = append(result, rt.copy())
+	}
+
+	sort.Slice(result, func(i, j int) bool {
+		return result[i].Context < result[j].Context
+	})
+	return result
+}
@@ -0,0 +1,308 @@
+//
+// Copyright (C) 2017 Keith Irwin
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU General Public License as published
+// by the Free Software Foundation, either version 3 of the License,
+// or (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU General Public License for more details.
+//
+// You should have received a copy of the GNU General Public License
+// along with this program.  If not, see <http://www.gnu.org/licenses/>.
+
+package internal
+
+import (
+	"errors"
+	"log"
+	"net/http"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+//-----------------------------------------------------------------------------
+// The session registry records every token issued (by jti) against its
+// login session, along with when and where it was last used. A token
+// not in the registry is not accepted, so ending a session takes
+// effect immediately. A session stays registered while its refresh
+// tokens could still be used, even if it has no live access token, so
+// an idle device can still be logged out.
+//-----------------------------------------------------------------------------
+
+var errSessionRevoked = errors.New("session ended")
+
+type session struct {
+	ID        string    `json:"id"`
+	UserID    string    `json:"user_id"`
+	Email     string    `json:"email"`
+	Issued    time.Time `json:"issued"`
+	LastSeen  time.Time `json:"last_seen"`
+	Expires   time.Time `json:"expires"`
+	IP        string    `json:"ip"`
+	UserAgent string    `json:"user_agent"`
+	Current   bool      `json:"current,omitempty"`
+	tokens    map[string]time.Time
+}
+
+type sessionRegistry struct {
+	mutex    sync.Mutex
+	sessions map[string]*session
+	tokens   map[string]string
+}
+
+func newSessionRegistry() *sessionRegistry {
+	return &sessionRegistry{
+		sessions: make(map[string]*session),
+		tokens:   make(map[string]string),
+	}
+}
+
+// register records a newly signed token.
+func (reg *sessionRegistry) register(viewer *Viewer) {
+	reg.mutex.Lock()
+	defer reg.mutex.Unlock()
+
+	reg.pruneLocked()
+
+	s, ok := reg.sessions[viewer.Session]
+	if !ok {
+		now := time.Now()
+		s = &session{
+			ID:       viewer.Session,
+			UserID:   viewer.ID,
+			Email:    viewer.Email,
+			Issued:   now,
+			LastSeen: now,
+			tokens:   make(map[string]time.Time),
+		}
+		reg.sessions[s.ID] = s
+	}
+
+	s.tokens[viewer.Id] = time.Unix(viewer.ExpiresAt, 0)
+	reg.tokens[viewer.Id] = s.ID
+}
+
+// renew adds a renewed token to the session of the token it replaces,
+// returning false if that session has ended (so it stays ended).
+func (reg *sessionRegistry) renew(old string, viewer *Viewer) bool {
+	reg.mutex.Lock()
+	defer reg.mutex.Unlock()
+
+	s, ok := reg.sessions[reg.tokens[old]]
+	if !ok || s.ID != viewer.Session {
+		return false
+	}
+
+	s.tokens[viewer.Id] = time.Unix(viewer.ExpiresAt, 0)
+	reg.tokens[viewer.Id] = s.ID
+	return true
+}
+
+// extend keeps a session registered until at least the given time.
+func (reg *sessionRegistry) extend(id string, until time.Time) {
+	reg.mutex.Lock()
+	defer reg.mutex.Unlock()
+	if s, ok := reg.sessions[id]; ok && until.After(s.Expires) {
+		s.Expires = until
+	}
+}
+
+// pruneLocked forgets expired tokens, and sessions with none left
+// that can no longer be refreshed.
+func (reg *sessionRegistry) pruneLocked() {
+	now := time.Now()
+	for id, s := range reg.sessions {
+		for jti, expires := range s.tokens {
+			if now.After(expires) {
+				delete(s.tokens, jti)
+				delete(reg.tokens, jti)
+			}
+		}
+		if len(s.tokens) == 0 && now.After(s.Expires) {
+			delete(reg.sessions, id)
+		}
+	}
+}
+
+// touch checks that the token is still live, noting where it was used.
+func (reg *sessionRegistry) touch(jti, ip, userAgent string) error {
+	reg.mutex.Lock()
+	defer reg.mutex.Unlock()
+
+	s, ok := reg.sessions[reg.tokens[jti]]
+	if !ok {
+		return errSessionRevoked
+	}
+
+	s.LastSeen = time.Now()
+	s.IP = ip
+	s.UserAgent = userAgent
+	return nil
+}
+
+// revoke ends a session, returning false if there was no such session.
+func (reg *sessionRegistry) revoke(id string) bool {
+	reg.mutex.Lock()
+	defer reg.mutex.Unlock()
+
+	s, ok := reg.sessions[id]
+	if !ok {
+		return false
+	}
+	for jti := range s.tokens {
+		delete(reg.tokens, jti)
+	}
+	delete(reg.sessions, id)
+	return true
+}
+
+// list returns copies of the sessions for a user (all users, if "").
+func (reg *sessionRegistry) list(userID string) []*session {
+	reg.mutex.Lock()
+	defer reg.mutex.Unlock()
+
+	reg.pruneLocked()
+
+	result := make([]*session, 0)
+	for _, s := range reg.sessions {
+		if userID == "" || s.UserID == userID {
+			c := *s
+			c.tokens = nil
+			result = append(result, &c)
+		}
+	}
+
+	sort.Slice(result, func(i, j int) bool {
+		return result[i].LastSeen.After(result[j].LastSeen)
+	})
+	return result
+}
+
+func (reg *sessionRegistry) find(id string) *session {
+	reg.mutex.Lock()
+	defer reg.mutex.Unlock()
+	if s, ok := reg.sessions[id]; ok {
+		c := *s
+		c.tokens = nil
+		return &c
+	}
+	return nil
+}
+
+//-----------------------------------------------------------------------------
+
+// endSession revokes a login session everywhere: its tokens, its
+// refresh tokens, and its websocket connections.
+func (proxy ProxyServer) endSession(r *http.Request, id, reason string) bool {
+	found := proxy.sessions.revoke(id)
+	proxy.refresh.revoke(id)
+	proxy.clienthub.closeSession(id)
+	if found {
+		log.Printf("- session.ended: %v (%v)", id, reason)
+		proxy.audit(r, "session.revoke", id, "success", reason)
+	}
+	return found
+}
+
+// endUserSessions ends all of a user's sessions, returning how many.
+func (proxy ProxyServer) endUserSessions(r *http.Request, userID, reason string) int {
+	count := 0
+	for _, s := range proxy.sessions.list(userID) {
+		if proxy.endSession(r, s.ID, reason) {
+			count++
+		}
+	}
+	proxy.refresh.revokeUser(userID)
+	return count
+}
+
+//-----------------------------------------------------------------------------
+// A user's own sessions.
+//
+//   GET    /sessions      -- list my sessions
+//   DELETE /sessions      -- log out everywhere
+//   DELETE /sessions/:id  -- end one of my sessions
+//-----------------------------------------------------------------------------
+
+func (proxy ProxyServer) handleSessions(w http.ResponseWriter, r *http.Request) {
+
+	token, err := proxy.checkAuth(w, r)
+	if err != nil {
+		proxy.writeError(w, r, http.StatusUnauthorized, err.Error())
+		return
+	}
+
+	viewer, err := proxy.decodeAuthToken(token)
+	if err != nil {
+		proxy.writeError(w, r, http.StatusUnauthorized, err.Error())
+		return
+	}
+
+	path := strings.Split(strings.Trim(removePathContext(r), "/"), "/")
+
+	switch {
+
+	case path[0] == "" && (r.Method == "GET" || r.Method == "HEAD"):
+		list := proxy.sessions.list(viewer.ID)
+		for _, s := range list {
+			s.Current = s.ID == viewer.Session
+		}
+		proxy.setAuth(w, token)
+		writeJSON(w, http.StatusOK, list)
+
+	case path[0] == "" && r.Method == "DELETE":
+		count := proxy.endUserSessions(r, viewer.ID, "logout everywhere")
+		unsetRefresh(w)
+		proxy.unsetCookie(w)
+		writeJSON(w, http.StatusOK, map[string]int{"ended": count})
+
+	case len(path) == 1 && r.Method == "DELETE":
+		s := proxy.sessions.find(path[0])
+		if s == nil || s.UserID != viewer.ID {
+			proxy.writeError(w, r, http.StatusNotFound, "No such session.")
+			return
+		}
+		proxy.endSession(r, s.ID, "ended by user")
+		if s.ID == viewer.Session {
+			unsetRefresh(w)
+			proxy.unsetCookie(w)
+		}
+		w.WriteHeader(http.StatusNoContent)
+
+	default:
+		proxy.writeError(w, r, http.StatusNotFound, "Unknown session resource.")
+	}
+}
+
+//-----------------------------------------------------------------------------
+
+func (proxy ProxyServer) handleAdminSessions(w http.ResponseWriter, r *http.Request, path []string) {
+
+	user := r.URL.Query().Get("user")
+
+	switch {
+
+	case len(path) == 0 && (r.Method == "GET" || r.Method == "HEAD"):
+		writeJSON(w, http.StatusOK, proxy.sessions.list(user))
+
+	case len(path) == 0 && r.Method == "DELETE" && user != "":
+		count := proxy.endUserSessions(r, user, "revoked by admin")
+		writeJSON(w, http.StatusOK, map[string]int{"ended": count})
+
+	case len(path) == 1 && r.Method == "DELETE":
+		if !proxy.endSession(r, path[0], "revoked by admin") {
+			proxy.writeError(w, r, http.StatusNotFound, "No such session.")
+			return
+		}
+		w.WriteHeader(http.StatusNoContent)
+
+	default:
+		proxy.writeError(w, r, http.StatusNotFound, "Unknown session resource.")
+	}
+}
@@ -0,0 +1,302 @@
+//
+// Copyright (C) 2017 Keith Irwin
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU General Public License as published
+// by the Free Software Foundation, either version 3 of the License,
+// or (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU General Public License for more details.
+//
+// You should have received a copy of the GNU General Public License
+// along with this program.  If not, see <http://www.gnu.org/licenses/>.
+
+package internal
+
+import (
+	"fmt"
+	"log"
+	"math"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+//-----------------------------------------------------------------------------
+// Brute force protection for logins. Failures are counted per account
+// (the email as typed, whether or not it exists) and per client IP.
+// After a few free tries, each further attempt must wait twice as long
+// as the last (up to a limit), and past a threshold the key is locked
+// out for a while. Failures are forgotten after a quiet spell.
+//
+// An attempt counts as a failure from the moment it's let through
+// (until it succeeds), so guesses sent in parallel wait their turn
+// like ones sent one after another.
+//-----------------------------------------------------------------------------
+
+const badLoginMsg = "Invalid email or password."
+const badCodeMsg = "Invalid code."
+
+// ThrottleSettings configures login throttling.
+type ThrottleSettings struct {
+	FreeAttempts     int
+	BaseDelay        time.Duration
+	MaxDelay         time.Duration
+	AccountLockAfter int
+	IPLockAfter      int
+	LockFor          time.Duration
+	ForgetAfter      time.Duration
+}
+
+// DefaultThrottleSettings are what the proxy uses unless told otherwise.
+func DefaultThrottleSettings() ThrottleSettings {
+	return ThrottleSettings{
+		FreeAttempts:     3,
+		BaseDelay:        time.Second,
+		MaxDelay:         30 * time.Second,
+		AccountLockAfter: 10,
+		IPLockAfter:      50,
+		LockFor:          15 * time.Minute,
+		ForgetAfter:      time.Hour,
+	}
+}
+
+type attempts struct {
+	Key      string     `json:"key"`
+	Failures int        `json:"failures"`
+	Last     time.Time  `json:"last"`
+	Locked   *time.Time `json:"locked_until,omitempty"`
+}
+
+type loginThrottle struct {
+	mutex    sync.Mutex
+	settings ThrottleSettings
+	keys     map[string]*attempts
+}
+
+func newLoginThrottle() *loginThrottle {
+	return &loginThrottle{
+		settings: DefaultThrottleSettings(),
+		keys:     make(map[string]*attempts),
+	}
+}
+
+func accountKey(email string) string {
+	return "account:" + strings.ToLower(strings.TrimSpace(email))
+}
+
+func ipKey(ip string) string {
+	return "ip:" + ip
+}
+
+// waitLocked returns how long the key must wait before another try.
+func (t *loginThrottle) waitLocked(key string, now time.Time) time.Duration {
+	a, ok := t.keys[key]
+	if !ok {
+		return 0
+	}
+
+	if a.Locked != nil {
+		if now.Before(*a.Locked) {
+			return a.Locked.Sub(now)
+		}
+		delete(t.keys, key)
+		return 0
+	}
+
+	extra := a.Failures - t.settings.FreeAttempts
+	if extra <= 0 {
+		return 0
+	}
+
+	delay := time.Duration(float64(t.settings.BaseDelay) * math.Pow(2, float64(extra-1)))
+	if delay > t.settings.MaxDelay || delay <= 0 {
+		delay = t.settings.MaxDelay
+	}
+	if wait := a.Last.Add(delay).Sub(now); wait > 0 {
+		return wait
+	}
+	return 0
+}
+
+func (t *loginThrottle) checkLocked(keys []string, now time.Time) time.Duration {
+	longest := time.Duration(0)
+	for _, key := range keys {
+		if wait := t.waitLocked(key, now); wait > longest {
+			longest = wait
+		}
+	}
+	return longest
+}
+
+// check returns how long the caller must wait before trying again, or
+// zero if they may try now.
+func (t *loginThrottle) check(keys ...string) time.Duration {
+	t.mutex.Lock()
+	defer t.mutex.Unlock()
+	return t.checkLocked(keys, time.Now())
+}
+
+// attempt is check, but if the caller may try now, the try is counted
+// as a failure against each key until succeed says otherwise.
+func (t *loginThrottle) attempt(keys ...string) time.Duration {
+	t.mutex.Lock()
+	defer t.mutex.Unlock()
+
+	now := time.Now()
+	if wait := t.checkLocked(keys, now); wait > 0 {
+		return wait
+	}
+
+	for key, a := range t.keys {
+		if a.Locked == nil && now.Sub(a.Last) > t.settings.ForgetAfter {
+			delete(t.keys, key)
+		}
+	}
+
+	for _, key := range keys {
+		a, ok := t.keys[key]
+		if !ok {
+			a = &attempts{Key: key}
+			t.keys[key] = a
+		}
+		a.Failures++
+		a.Last = now
+	}
+	return 0
+}
+
+// fail confirms an attempt failed, returning the keys that became
+// locked.
+func (t *loginThrottle) fail(keys ...string) []string {
+	t.mutex.Lock()
+	defer t.mutex.Unlock()
+
+	now := time.Now()
+	locked := make([]string, 0)
+	for _, key := range keys {
+		a, ok := t.keys[key]
+		if !ok {
+			continue
+		}
+
+		limit := t.settings.AccountLockAfter
+		if strings.HasPrefix(key, "ip:") {
+			limit = t.settings.IPLockAfter
+		}
+		if limit > 0 && a.Failures >= limit && a.Locked == nil {
+			until := now.Add(t.settings.LockFor)
+			a.Locked = &until
+			locked = append(locked, key)
+		}
+	}
+	return locked
+}
+
+// succeed forgets failures for an account, and takes back the attempt
+// counted against other keys. Other IP failures stand, since many
+// people may share an address.
+func (t *loginThrottle) succeed(keys ...string) {
+	t.mutex.Lock()
+	defer t.mutex.Unlock()
+	for _, key := range keys {
+		a, ok := t.keys[key]
+		switch {
+		case !ok:
+		case strings.HasPrefix(key, "account:"):
+			delete(t.keys, key)
+		case a.Failures > 1:
+			a.Failures--
+		case a.Locked == nil:
+			delete(t.keys, key)
+		}
+	}
+}
+
+func (t *loginThrottle) unlock(key string) bool {
+	t.mutex.Lock()
+	defer t.mutex.Unlock()
+	_, ok := t.keys[key]
+	delete(t.keys, key)
+	return ok
+}
+
+func (t *loginThrottle) list() []*attempts {
+	t.mutex.Lock()
+	defer t.mutex.Unlock()
+	result := make([]*attempts, 0, len(t.keys))
+	for _, a := range t.keys {
+		c := *a
+		result = append(result, &c)
+	}
+	sort.Slice(result, func(i, j int) bool { return result[i].Key < result[j].Key })
+	return result
+}
+
+// SetThrottle changes the login throttling settings.
+func (proxy ProxyServer) SetThrottle(settings ThrottleSettings) {
+	proxy.throttle.mutex.Lock()
+	defer proxy.throttle.mutex.Unlock()
+	proxy.throttle.settings = settings
+}
+
+//-----------------------------------------------------------------------------
+
+// throttled rejects a login attempt that comes too soon, returning
+// true if it did. Otherwise the attempt counts as a failure until the
+// caller calls loginFailed or throttle.succeed.
+func (proxy ProxyServer) throttled(w http.ResponseWriter, r *http.Request, keys ...string) bool {
+	return proxy.tooSoon(w, r, proxy.throttle.attempt(keys...))
+}
+
+// tooSoon answers 429 if there's a wait, returning true if it did.
+func (proxy ProxyServer) tooSoon(w http.ResponseWriter, r *http.Request, wait time.Duration) bool {
+	if wait <= 0 {
+		return false
+	}
+
+	seconds := int(math.Ceil(wait.Seconds()))
+	w.Header().Set("Retry-After", strconv.Itoa(seconds))
+	proxy.writeError(w, r, http.StatusTooManyRequests,
+		fmt.Sprintf("Too many failed attempts. Try again in %v seconds.", seconds))
+	return true
+}
+
+// loginFailed counts a failure, auditing any lockouts it causes.
+func (proxy ProxyServer) loginFailed(r *http.Request, keys ...string) {
+	for _, key := range proxy.throttle.fail(keys...) {
+		log.Printf("WARNING: login locked out for %v", key)
+		proxy.audit(r, "auth.lockout", key, "locked", "")
+	}
+}
+
+// handleAdminLockouts lets admins see and clear login failures:
+//
+//	GET    /admin/lockouts       -- keys with failures, and any lockouts
+//	DELETE /admin/lockouts/:key  -- unlock ("account:<email>" or "ip:<addr>")
+func (proxy ProxyServer) handleAdminLockouts(w http.ResponseWriter, r *http.Request, path []string) {
+
+	switch {
+
+	case len(path) == 0 && (r.Method == "GET" || r.Method == "HEAD"):
+		writeJSON(w, http.StatusOK, proxy.throttle.list())
+
+	case len(path) == 1 && r.Method == "DELETE":
+		if !proxy.throttle.unlock(path[0]) {
+			proxy.writeError(w, r, http.StatusNotFound, "No failures recorded for that key.")
+			return
+		}
+		log.Printf("- login unlocked for %v", path[0])
+		proxy.audit(r, "auth.unlock", path[0], "success", "")
+		w.WriteHeader(http.StatusNoContent)
+
+	default:
+		proxy.writeError(w, r, http.StatusNotFound, "Unknown lockout resource.")
+	}
+}
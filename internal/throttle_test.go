@@ -0,0 +1,68 @@
+//
+// Copyright (C) 2017 Keith Irwin
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU General Public License as published
+// by the Free Software Foundation, either version 3 of the License,
+// or (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU General Public License for more details.
+//
+// You should have received a copy of the GNU General Public License
+// along with this program.  If not, see <http://www.gnu.org/licenses/>.
+
+package internal
+
+import (
+	"sync"
+	"testing"
+)
+
+func TestThrottleParallelAttempts(t *testing.T) {
+	throttle := newLoginThrottle()
+	free := throttle.settings.FreeAttempts
+
+	var wg sync.WaitGroup
+	var mutex sync.Mutex
+	through := 0
+	for i := 0; i < 20; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			if throttle.attempt("account:lee@example.com", "ip:10.0.0.1") == 0 {
+				mutex.Lock()
+				through++
+				mutex.Unlock()
+			}
+		}()
+	}
+	wg.Wait()
+
+	// The free tries, and one more before the delays start.
+	if through != free+1 {
+		t.Errorf("%v parallel attempts got through, want %v", through, free+1)
+	}
+}
+
+func TestThrottleSucceedTakesBackAttempt(t *testing.T) {
+	throttle := newLoginThrottle()
+
+	throttle.attempt("account:lee@example.com", "ip:10.0.0.1")
+	throttle.fail("account:lee@example.com", "ip:10.0.0.1")
+	throttle.attempt("account:lee@example.com", "ip:10.0.0.1")
+	throttle.succeed("account:lee@example.com", "ip:10.0.0.1")
+
+	failures := make(map[string]int)
+	for _, a := range throttle.list() {
+		failures[a.Key] = a.Failures
+	}
+	if _, ok := failures["account:lee@example.com"]; ok {
+		t.Errorf("account failures kept after a success: %v", failures)
+	}
+	if failures["ip:10.0.0.1"] != 1 {
+		t.Errorf("ip failures %v, want just the one that failed", failures["ip:10.0.0.1"])
+	}
+}
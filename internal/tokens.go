@@ -0,0 +1,148 @@
+//
+// Copyright (C) 2017 Keith Irwin
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU General Public License as published
+// by the Free Software Foundation, either version 3 of the License,
+// or (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU General Public License for more details.
+//
+// You should have received a copy of the GNU General Public License
+// along with this program.  If not, see <http://www.gnu.org/licenses/>.
+
+package internal
+
+import (
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"errors"
+	"log"
+	"sync"
+	"time"
+)
+
+//-----------------------------------------------------------------------------
+// Refresh tokens. Each is good for one use: redeeming it issues a new
+// access token and a new refresh token in the same family (one family
+// per login). Presenting an already redeemed token means it was
+// copied, so the whole family is revoked.
+//-----------------------------------------------------------------------------
+
+const refreshCookie = "refreshToken"
+
+var errRefreshReused = errors.New("refresh token reused")
+var errRefreshInvalid = errors.New("refresh token invalid or expired")
+
+type refreshRecord struct {
+	family  string
+	userID  string
+	expires time.Time
+	used    bool
+}
+
+type refreshStore struct {
+	mutex  sync.Mutex
+	tokens map[string]*refreshRecord
+}
+
+func newRefreshStore() *refreshStore {
+	return &refreshStore{tokens: make(map[string]*refreshRecord)}
+}
+
+// Only a hash is kept, so the store itself can't be used to log in.
+func hashRefresh(token string) string {
+	sum := sha256.Sum256([]byte(token))
+	return base64.RawURLEncoding.EncodeToString(sum[:])
+}
+
+func (store *refreshStore) issue(userID, family string, ttl time.Duration) (string, error) {
+	raw := make([]byte, 32)
+	if _, err := rand.Read(raw); err != nil {
+		return "", err
+	}
+	token := base64.RawURLEncoding.EncodeToString(raw)
+
+	store.mutex.Lock()
+	defer store.mutex.Unlock()
+
+	now := time.Now()
+	for key, rec := range store.tokens {
+		if now.After(rec.expires) {
+			delete(store.tokens, key)
+		}
+	}
+
+	store.tokens[hashRefresh(token)] = &refreshRecord{
+		family:  family,
+		userID:  userID,
+		expires: now.Add(ttl),
+	}
+	return token, nil
+}
+
+// redeem uses up a refresh token, returning its record.
+func (store *refreshStore) redeem(token string) (*refreshRecord, error) {
+	store.mutex.Lock()
+	defer store.mutex.Unlock()
+
+	rec, ok := store.tokens[hashRefresh(token)]
+	if !ok || time.Now().After(rec.expires) {
+		return nil, errRefreshInvalid
+	}
+
+	if rec.used {
+		store.revokeLocked(rec.family)
+		return rec, errRefreshReused
+	}
+
+	rec.used = true
+	return rec, nil
+}
+
+func (store *refreshStore) revoke(family string) {
+	store.mutex.Lock()
+	defer store.mutex.Unlock()
+	store.revokeLocked(family)
+}
+
+func (store *refreshStore) revokeLocked(family string) {
+	for key, rec := range store.tokens {
+		if rec.family == family {
+			delete(store.tokens, key)
+		}
+	}
+}
+
+// revokeUser drops every refresh token belonging to the user.
+func (store *refreshStore) revokeUser(userID string) {
+	store.mutex.Lock()
+	defer store.mutex.Unlock()
+	for key, rec := range store.tokens {
+		if rec.userID == userID {
+			delete(store.tokens, key)
+		}
+	}
+}
+
+// familyOf returns the family of a refresh token, if it's known.
+func (store *refreshStore) familyOf(token string) string {
+	store.mutex.Lock()
+	defer store.mutex.Unlock()
+	if rec, ok := store.tokens[hashRefresh(token)]; ok {
+		return rec.family
+	}
+	return ""
+}
+
+// SetTokenLifetimes sets how long access tokens last without renewal,
+// and how long a refresh token lasts unused.
+func (proxy ProxyServer) SetTokenLifetimes(access, refresh time.Duration) {
+	proxy.auth.accessTTL = access
+	proxy.auth.refreshTTL = refresh
+	log.Printf("- access tokens last %v, refresh tokens %v", access, refresh)
+}
@@ -0,0 +1,397 @@
+//
+// Copyright (C) 2017 Keith Irwin
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU General Public License as published
+// by the Free Software Foundation, either version 3 of the License,
+// or (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU General Public License for more details.
+//
+// You should have received a copy of the GNU General Public License
+// along with this program.  If not, see <http://www.gnu.org/licenses/>.
+
+package internal
+
+import (
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha1"
+	"crypto/sha256"
+	"crypto/subtle"
+	"encoding/base32"
+	"encoding/base64"
+	"encoding/binary"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"log"
+	"net/http"
+	"net/url"
+	"strings"
+	"sync"
+	"time"
+)
+
+//-----------------------------------------------------------------------------
+// TOTP (RFC 6238) second factor: 6 digits, 30 second steps, HMAC-SHA1,
+// which is what authenticator apps expect.
+//-----------------------------------------------------------------------------
+
+const totpIssuer = "Launchpad"
+const totpStep = 30
+const totpDigits = 6
+const recoveryCodeCount = 10
+
+var errBadCode = errors.New("invalid verification code")
+
+var base32NoPad = base32.StdEncoding.WithPadding(base32.NoPadding)
+
+func newTOTPSecret() (string, error) {
+	raw := make([]byte, 20)
+	if _, err := rand.Read(raw); err != nil {
+		return "", err
+	}
+	return base32NoPad.EncodeToString(raw), nil
+}
+
+func totpCode(secret string, step int64) (string, error) {
+	key, err := base32NoPad.DecodeString(strings.ToUpper(secret))
+	if err != nil {
+		return "", err
+	}
+
+	msg := make([]byte, 8)
+	binary.BigEndian.PutUint64(msg, uint64(step))
+
+	mac := hmac.New(sha1.New, key)
+	mac.Write(msg)
+	sum := mac.Sum(nil)
+
+	offset := sum[len(sum)-1] & 0x0f
+	value := binary.BigEndian.Uint32(sum[offset:offset+4]) & 0x7fffffff
+	return fmt.Sprintf("%06d", value%1000000), nil
+}
+
+// checkTOTP accepts a code for the current step or one either side (for
+// clock drift), but never a step at or before lastStep, so a code can't
+// be replayed. It returns the step matched.
+func checkTOTP(secret, code string, lastStep int64) (int64, bool) {
+	code = strings.Replace(strings.TrimSpace(code), " ", "", -1)
+	if len(code) != totpDigits {
+		return 0, false
+	}
+
+	now := time.Now().Unix() / totpStep
+	for step := now - 1; step <= now+1; step++ {
+		if step <= lastStep {
+			continue
+		}
+		expected, err := totpCode(secret, step)
+		if err == nil && subtle.ConstantTimeCompare([]byte(expected), []byte(code)) == 1 {
+			return step, true
+		}
+	}
+	return 0, false
+}
+
+func totpURI(secret, email string) string {
+	label := url.PathEscape(totpIssuer + ":" + email)
+	query := url.Values{}
+	query.Set("secret", secret)
+	query.Set("issuer", totpIssuer)
+	query.Set("algorithm", "SHA1")
+	query.Set("digits", fmt.Sprint(totpDigits))
+	query.Set("period", fmt.Sprint(totpStep))
+	return "otpauth://totp/" + label + "?" + query.Encode()
+}
+
+// newRecoveryCodes returns codes to show the user once, and the
+// hashes to keep.
+func newRecoveryCodes() ([]string, []string, error) {
+	codes := make([]string, 0, recoveryCodeCount)
+	hashes := make([]string, 0, recoveryCodeCount)
+	for i := 0; i < recoveryCodeCount; i++ {
+		raw := make([]byte, 5)
+		if _, err := rand.Read(raw); err != nil {
+			return nil, nil, err
+		}
+		code := strings.ToLower(base32NoPad.EncodeToString(raw))
+		code = code[:4] + "-" + code[4:]
+		codes = append(codes, code)
+		hashes = append(hashes, hashRecoveryCode(code))
+	}
+	return codes, hashes, nil
+}
+
+func hashRecoveryCode(code string) string {
+	code = strings.ToLower(strings.Replace(strings.TrimSpace(code), "-", "", -1))
+	sum := sha256.Sum256([]byte(code))
+	return hex.EncodeToString(sum[:])
+}
+
+// verifySecondFactor checks a TOTP or recovery code for an enrolled
+// user, using it up.
+func (db *Database) verifySecondFactor(userID, code string) error {
+	_, err := db.UpdateUser(userID, func(u *User) error {
+		if u.TOTPEnabled && u.TOTPSecret != "" {
+			if step, ok := checkTOTP(u.TOTPSecret, code, u.TOTPLastStep); ok {
+				u.TOTPLastStep = step
+				return nil
+			}
+		}
+
+		hash := hashRecoveryCode(code)
+		for i, h := range u.RecoveryCodes {
+			if subtle.ConstantTimeCompare([]byte(h), []byte(hash)) == 1 {
+				u.RecoveryCodes = append(u.RecoveryCodes[:i], u.RecoveryCodes[i+1:]...)
+				log.Printf("- recovery code used by '%v' (%v left)", u.Email, len(u.RecoveryCodes))
+				return nil
+			}
+		}
+		return errBadCode
+	})
+	return err
+}
+
+//-----------------------------------------------------------------------------
+// Login challenges: after a good password, a user with (or required to
+// have) TOTP gets a short lived challenge to present with their code.
+//-----------------------------------------------------------------------------
+
+const challengeTTL = 5 * time.Minute
+const challengeAttempts = 5
+
+type challenge struct {
+	userID   string
+	expires  time.Time
+	attempts int
+}
+
+type challengeStore struct {
+	mutex      sync.Mutex
+	challenges map[string]*challenge
+}
+
+func newChallengeStore() *challengeStore {
+	return &challengeStore{challenges: make(map[string]*challenge)}
+}
+
+func (store *challengeStore) issue(userID string) (string, error) {
+	raw := make([]byte, 24)
+	if _, err := rand.Read(raw); err != nil {
+		return "", err
+	}
+	token := base64.RawURLEncoding.EncodeToString(raw)
+
+	store.mutex.Lock()
+	defer store.mutex.Unlock()
+
+	now := time.Now()
+	for key, c := range store.challenges {
+		if now.After(c.expires) {
+			delete(store.challenges, key)
+		}
+	}
+
+	store.challenges[token] = &challenge{userID: userID, expires: now.Add(challengeTTL)}
+	return token, nil
+}
+
+// attempt counts a try against the challenge, returning its user.
+func (store *challengeStore) attempt(token string) (string, bool) {
+	store.mutex.Lock()
+	defer store.mutex.Unlock()
+
+	c, ok := store.challenges[token]
+	if !ok || time.Now().After(c.expires) {
+		return "", false
+	}
+
+	c.attempts++
+	if c.attempts > challengeAttempts {
+		delete(store.challenges, token)
+		return "", false
+	}
+	return c.userID, true
+}
+
+func (store *challengeStore) done(token string) {
+	store.mutex.Lock()
+	defer store.mutex.Unlock()
+	delete(store.challenges, token)
+}
+
+//-----------------------------------------------------------------------------
+
+// RequireMFA makes TOTP mandatory for users with any of the roles.
+func (proxy ProxyServer) RequireMFA(roles []string) {
+	proxy.mfa.mutex.Lock()
+	defer proxy.mfa.mutex.Unlock()
+	proxy.mfa.roles = roles
+}
+
+type mfaSettings struct {
+	mutex sync.RWMutex
+	roles []string
+}
+
+func (proxy ProxyServer) mfaRequired(user *User) bool {
+	proxy.mfa.mutex.RLock()
+	defer proxy.mfa.mutex.RUnlock()
+	for _, required := range proxy.mfa.roles {
+		for _, role := range user.Roles {
+			if role == required {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+type totpRequest struct {
+	Challenge string `json:"challenge"`
+	Code      string `json:"code"`
+}
+
+type totpEnrollment struct {
+	Secret string `json:"secret"`
+	URI    string `json:"uri"`
+}
+
+// totpUser finds who's enrolling: the signed in user, or a user mid
+// login who must enroll before they can finish.
+func (proxy ProxyServer) totpUser(w http.ResponseWriter, r *http.Request, challenge string) (*User, error) {
+	if challenge != "" {
+		userID, ok := proxy.challenges.attempt(challenge)
+		if !ok {
+			return nil, errors.New("login challenge expired")
+		}
+		return proxy.Database.findUserByID(userID)
+	}
+
+	token, err := proxy.checkAuth(w, r)
+	if err != nil {
+		return nil, err
+	}
+	viewer, err := proxy.decodeAuthToken(token)
+	if err != nil {
+		return nil, err
+	}
+	return proxy.Database.findUserByID(viewer.ID)
+}
+
+// handleTOTP manages enrollment:
+//
+//	POST /auth/totp/enroll   -- start: returns a secret and otpauth:// URI
+//	POST /auth/totp/confirm  -- {"code": ..} turns TOTP on, returns recovery codes
+//	POST /auth/totp/disable  -- {"code": ..} turns TOTP off
+//
+// Each takes a "challenge" instead of a token when enrollment is
+// required to finish logging in; confirming then completes the login.
+func (proxy ProxyServer) handleTOTP(w http.ResponseWriter, r *http.Request, action string, params authRequest, login func(*User, string, []string)) {
+
+	user, err := proxy.totpUser(w, r, params.Challenge)
+	if err != nil {
+		proxy.writeError(w, r, http.StatusUnauthorized, err.Error())
+		return
+	}
+
+	switch action {
+
+	case "enroll":
+		if user.TOTPEnabled {
+			proxy.writeError(w, r, http.StatusConflict, "Two-factor authentication is already on.")
+			return
+		}
+
+		secret, err := newTOTPSecret()
+		if err == nil {
+			_, err = proxy.Database.UpdateUser(user.ID, func(u *User) error {
+				u.TOTPSecret = secret
+				return nil
+			})
+		}
+		if err != nil {
+			proxy.writeError(w, r, http.StatusInternalServerError, err.Error())
+			return
+		}
+
+		writeJSON(w, http.StatusOK, totpEnrollment{secret, totpURI(secret, user.Email)})
+
+	case "confirm":
+		if user.TOTPEnabled || user.TOTPSecret == "" {
+			proxy.writeError(w, r, http.StatusConflict, "No two-factor enrollment in progress.")
+			return
+		}
+
+		step, ok := checkTOTP(user.TOTPSecret, params.Code, 0)
+		if !ok {
+			proxy.audit(r, "mfa.enroll", user.Email, "failure", errBadCode.Error())
+			proxy.writeError(w, r, http.StatusUnauthorized, badCodeMsg)
+			return
+		}
+
+		codes, hashes, err := newRecoveryCodes()
+		if err == nil {
+			user, err = proxy.Database.UpdateUser(user.ID, func(u *User) error {
+				u.TOTPEnabled = true
+				u.TOTPLastStep = step
+				u.RecoveryCodes = hashes
+				return nil
+			})
+		}
+		if err != nil {
+			proxy.writeError(w, r, http.StatusInternalServerError, err.Error())
+			return
+		}
+
+		log.Printf("- mfa.enrolled: '%v'", user.Email)
+		proxy.audit(r, "mfa.enroll", user.Email, "success", "")
+
+		if params.Challenge != "" {
+			proxy.challenges.done(params.Challenge)
+			login(user, mkUUID(), codes)
+			return
+		}
+		writeJSON(w, http.StatusOK, map[string][]string{"recovery_codes": codes})
+
+	case "disable":
+		if params.Challenge != "" || !user.TOTPEnabled {
+			proxy.writeError(w, r, http.StatusConflict, "Two-factor authentication is not on.")
+			return
+		}
+		if proxy.mfaRequired(user) {
+			proxy.writeError(w, r, http.StatusForbidden, "Two-factor authentication is required for your role.")
+			return
+		}
+		if err := proxy.Database.verifySecondFactor(user.ID, params.Code); err != nil {
+			proxy.audit(r, "mfa.disable", user.Email, "failure", err.Error())
+			proxy.writeError(w, r, http.StatusUnauthorized, badCodeMsg)
+			return
+		}
+
+		if _, err := proxy.Database.UpdateUser(user.ID, clearTOTP); err != nil {
+			proxy.audit(r, "mfa.disable", user.Email, "failure", err.Error())
+			proxy.writeError(w, r, http.StatusInternalServerError, err.Error())
+			return
+		}
+		log.Printf("- mfa.disabled: '%v'", user.Email)
+		proxy.audit(r, "mfa.disable", user.Email, "success", "")
+		w.WriteHeader(http.StatusNoContent)
+
+	default:
+		proxy.writeError(w, r, http.StatusNotFound, "Unknown two-factor resource.")
+	}
+}
+
+func clearTOTP(u *User) error {
+	u.TOTPEnabled = false
+	u.TOTPSecret = ""
+	u.TOTPLastStep = 0
+	u.RecoveryCodes = nil
+	return nil
+}
@@ -0,0 +1,70 @@
+//
+// Copyright (C) 2017 Keith Irwin
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU General Public License as published
+// by the Free Software Foundation, either version 3 of the License,
+// or (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU General Public License for more details.
+//
+// You should have received a copy of the GNU General Public License
+// along with this program.  If not, see <http://www.gnu.org/licenses/>.
+
+package internal
+
+import (
+	"sync"
+	"testing"
+	"time"
+)
+
+func TestSecondFactorReplayedInParallel(t *testing.T) {
+	users, err := NewUserStore("")
+	if err != nil {
+		t.Fatal(err)
+	}
+	db := NewDatabase(users)
+	secret, err := newTOTPSecret()
+	if err != nil {
+		t.Fatal(err)
+	}
+	user, err := db.CreateUser("max@example.com", "max-password-1", []string{"user"})
+	if err == nil {
+		_, err = db.UpdateUser(user.ID, func(u *User) error {
+			u.TOTPEnabled, u.TOTPSecret = true, secret
+			return nil
+		})
+	}
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	code, err := totpCode(secret, time.Now().Unix()/totpStep)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var wg sync.WaitGroup
+	var mutex sync.Mutex
+	accepted := 0
+	for i := 0; i < 10; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			if db.verifySecondFactor(user.ID, code) == nil {
+				mutex.Lock()
+				accepted++
+				mutex.Unlock()
+			}
+		}()
+	}
+	wg.Wait()
+
+	if accepted != 1 {
+		t.Errorf("code accepted %v times, want once", accepted)
+	}
+}
@@ -0,0 +1,444 @@
+//
+// Copyright (C) 2017 Keith Irwin
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU General Public License as published
+// by the Free Software Foundation, either version 3 of the License,
+// or (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU General Public License for more details.
+//
+// You should have received a copy of the GNU General Public License
+// along with this program.  If not, see <http://www.gnu.org/licenses/>.
+
+package internal
+
+import (
+	"bytes"
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"log"
+	"net/http"
+	"os"
+	"regexp"
+	"strconv"
+	"strings"
+	"time"
+)
+
+//-----------------------------------------------------------------------------
+// Tracing: a span per request with children for the auth check, route
+// selection and upstream round trip. Context is read from and passed
+// on via W3C `traceparent` and `tracestate` headers, and finished spans
+// are exported over OTLP/HTTP (JSON) or written to stdout or a file.
+//-----------------------------------------------------------------------------
+
+const (
+	// TraceExporterOTLP posts spans to an OTLP/HTTP collector.
+	TraceExporterOTLP = "otlp"
+	// TraceExporterStdout writes spans to stdout as JSON lines.
+	TraceExporterStdout = "stdout"
+	// TraceExporterFile writes spans to a file as JSON lines.
+	TraceExporterFile = "file"
+)
+
+const (
+	spanKindInternal = 1
+	spanKindServer   = 2
+	spanKindClient   = 3
+)
+
+var traceparentPattern = regexp.MustCompile(`^00-([0-9a-f]{32})-([0-9a-f]{16})-([0-9a-f]{2})$`)
+
+type span struct {
+	tracer   *Tracer
+	name     string
+	kind     int
+	traceID  string
+	spanID   string
+	parentID string
+	state    string
+	sampled  bool
+	start    time.Time
+	end      time.Time
+	attrs    map[string]string
+	failure  string
+}
+
+type spanKey struct{}
+
+func randomHex(n int) string {
+	b := make([]byte, n)
+	if _, err := rand.Read(b); err != nil {
+		log.Printf("ERROR: random: %v", err)
+	}
+	return hex.EncodeToString(b)
+}
+
+func spanFrom(ctx context.Context) *span {
+	if s, ok := ctx.Value(spanKey{}).(*span); ok {
+		return s
+	}
+	return nil
+}
+
+func withSpan(ctx context.Context, s *span) context.Context {
+	if s == nil {
+		return ctx
+	}
+	return context.WithValue(ctx, spanKey{}, s)
+}
+
+// detachSpan carries the current span over to a fresh context, for
+// work that outlives the request (such as queued commands).
+func detachSpan(ctx context.Context) context.Context {
+	return withSpan(context.Background(), spanFrom(ctx))
+}
+
+// startSpan begins a child of the span in ctx. If there isn't one (the
+// tracer is disabled) it returns a nil span, which is safe to use.
+func startSpan(ctx context.Context, name string, kind int) (context.Context, *span) {
+	parent := spanFrom(ctx)
+	if parent == nil {
+		return ctx, nil
+	}
+	s := &span{
+		tracer:   parent.tracer,
+		name:     name,
+		kind:     kind,
+		traceID:  parent.traceID,
+		spanID:   randomHex(8),
+		parentID: parent.spanID,
+		state:    parent.state,
+		sampled:  parent.sampled,
+		start:    time.Now(),
+		attrs:    make(map[string]string),
+	}
+	return withSpan(ctx, s), s
+}
+
+func (s *span) set(key string, value interface{}) {
+	if s == nil {
+		return
+	}
+	s.attrs[key] = fmt.Sprintf("%v", value)
+}
+
+func (s *span) fail(reason string) {
+	if s == nil {
+		return
+	}
+	s.failure = reason
+}
+
+func (s *span) finish() {
+	if s == nil {
+		return
+	}
+	s.end = time.Now()
+	if s.sampled {
+		s.tracer.enqueue(s)
+	}
+}
+
+func (s *span) traceparent() string {
+	flags := "00"
+	if s.sampled {
+		flags = "01"
+	}
+	return "00-" + s.traceID + "-" + s.spanID + "-" + flags
+}
+
+// inject passes this span's context on to the next hop.
+func (s *span) inject(h http.Header) {
+	if s == nil {
+		return
+	}
+	h.Set("traceparent", s.traceparent())
+	if s.state != "" {
+		h.Set("tracestate", s.state)
+	} else {
+		h.Del("tracestate")
+	}
+}
+
+//-----------------------------------------------------------------------------
+
+// Tracer creates spans and exports them in batches.
+type Tracer struct {
+	service  string
+	exporter spanExporter
+	queue    chan *span
+	stop     chan struct{}
+	done     chan struct{}
+}
+
+// NewTracer returns a tracer using the named exporter. Target is the
+// collector URL for "otlp" or the path for "file". Returns nil (no
+// tracing) if exporter is empty.
+func NewTracer(exporter, target string) (*Tracer, error) {
+	var exp spanExporter
+
+	switch exporter {
+	case "":
+		return nil, nil
+	case TraceExporterOTLP:
+		if target == "" {
+			target = "http://localhost:4318"
+		}
+		exp = &otlpExporter{endpoint: strings.TrimSuffix(target, "/") + "/v1/traces", client: &http.Client{Timeout: 10 * time.Second}}
+	case TraceExporterStdout:
+		exp = &writerExporter{out: os.Stdout}
+	case TraceExporterFile:
+		file, err := os.OpenFile(target, os.O_WRONLY|os.O_CREATE|os.O_APPEND, 0640)
+		if err != nil {
+			return nil, err
+		}
+		exp = &writerExporter{out: file, closer: file}
+	default:
+		return nil, fmt.Errorf("unknown trace exporter '%v'", exporter)
+	}
+
+	return &Tracer{
+		service:  "proxy",
+		exporter: exp,
+		queue:    make(chan *span, 2048),
+		stop:     make(chan struct{}),
+		done:     make(chan struct{}),
+	}, nil
+}
+
+// Start the tracer's exporter.
+func (t *Tracer) Start() {
+	if t == nil {
+		return
+	}
+	log.Println("Starting tracer.")
+	go t.exportContinuously()
+}
+
+// Stop the tracer, flushing any pending spans.
+func (t *Tracer) Stop() {
+	if t == nil {
+		return
+	}
+	log.Println("Stopping tracer.")
+	close(t.stop)
+	<-t.done
+	t.exporter.close()
+}
+
+func (t *Tracer) enqueue(s *span) {
+	select {
+	case t.queue <- s:
+	default:
+		// Never hold up a request for the sake of a trace.
+	}
+}
+
+func (t *Tracer) exportContinuously() {
+	clock := time.NewTicker(5 * time.Second)
+	defer clock.Stop()
+	defer close(t.done)
+
+	batch := make([]*span, 0, 256)
+	flush := func() {
+		if len(batch) == 0 {
+			return
+		}
+		if err := t.exporter.export(t.service, batch); err != nil {
+			log.Printf("WARNING (tracer): %v", err)
+		}
+		batch = make([]*span, 0, 256)
+	}
+
+	for {
+		select {
+		case s := <-t.queue:
+			batch = append(batch, s)
+			if len(batch) >= 256 {
+				flush()
+			}
+		case <-clock.C:
+			flush()
+		case <-t.stop:
+			for len(t.queue) > 0 {
+				batch = append(batch, <-t.queue)
+			}
+			flush()
+			return
+		}
+	}
+}
+
+// startRequest begins the server span for an incoming request,
+// continuing the caller's trace if there's a valid traceparent.
+func (t *Tracer) startRequest(r *http.Request) (context.Context, *span) {
+	if t == nil {
+		return r.Context(), nil
+	}
+
+	s := &span{
+		tracer:  t,
+		name:    r.Method + " /" + getPathContext(r),
+		kind:    spanKindServer,
+		traceID: randomHex(16),
+		spanID:  randomHex(8),
+		sampled: true,
+		start:   time.Now(),
+		attrs:   make(map[string]string),
+	}
+
+	if m := traceparentPattern.FindStringSubmatch(r.Header.Get("traceparent")); m != nil {
+		if m[1] != strings.Repeat("0", 32) && m[2] != strings.Repeat("0", 16) {
+			flags, _ := strconv.ParseUint(m[3], 16, 8)
+			s.traceID = m[1]
+			s.parentID = m[2]
+			s.sampled = flags&1 == 1
+			s.state = r.Header.Get("tracestate")
+		}
+	}
+
+	s.set("http.method", r.Method)
+	s.set("http.target", r.URL.Path)
+	s.set("http.request_id", requestID(r))
+	return withSpan(r.Context(), s), s
+}
+
+//-----------------------------------------------------------------------------
+
+type spanExporter interface {
+	export(service string, spans []*span) error
+	close() error
+}
+
+type otlpKeyValue struct {
+	Key   string            `json:"key"`
+	Value map[string]string `json:"value"`
+}
+
+type otlpStatus struct {
+	Code    int    `json:"code"`
+	Message string `json:"message,omitempty"`
+}
+
+type otlpSpan struct {
+	TraceID           string         `json:"traceId"`
+	SpanID            string         `json:"spanId"`
+	ParentSpanID      string         `json:"parentSpanId,omitempty"`
+	TraceState        string         `json:"traceState,omitempty"`
+	Name              string         `json:"name"`
+	Kind              int            `json:"kind"`
+	StartTimeUnixNano string         `json:"startTimeUnixNano"`
+	EndTimeUnixNano   string         `json:"endTimeUnixNano"`
+	Attributes        []otlpKeyValue `json:"attributes,omitempty"`
+	Status            otlpStatus     `json:"status"`
+}
+
+func toOTLP(s *span) otlpSpan {
+	attrs := make([]otlpKeyValue, 0, len(s.attrs))
+	for k, v := range s.attrs {
+		attrs = append(attrs, otlpKeyValue{k, map[string]string{"stringValue": v}})
+	}
+
+	status := otlpStatus{Code: 1}
+	if s.failure != "" {
+		status = otlpStatus{Code: 2, Message: s.failure}
+	}
+
+	return otlpSpan{
+		TraceID:           s.traceID,
+		SpanID:            s.spanID,
+		ParentSpanID:      s.parentID,
+		TraceState:        s.state,
+		Name:              s.name,
+		Kind:              s.kind,
+		StartTimeUnixNano: strconv.FormatInt(s.start.UnixNano(), 10),
+		EndTimeUnixNano:   strconv.FormatInt(s.end.UnixNano(), 10),
+		Attributes:        attrs,
+		Status:            status,
+	}
+}
+
+// otlpExporter posts batches to an OTLP/HTTP collector using the JSON
+// encoding of ExportTraceServiceRequest.
+type otlpExporter struct {
+	endpoint string
+	client   *http.Client
+}
+
+func (e *otlpExporter) export(service string, spans []*span) error {
+	converted := make([]otlpSpan, 0, len(spans))
+	for _, s := range spans {
+		converted = append(converted, toOTLP(s))
+	}
+
+	request := map[string]interface{}{
+		"resourceSpans": []interface{}{
+			map[string]interface{}{
+				"resource": map[string]interface{}{
+					"attributes": []otlpKeyValue{{"service.name", map[string]string{"stringValue": service}}},
+				},
+				"scopeSpans": []interface{}{
+					map[string]interface{}{
+						"scope": map[string]string{"name": "github.com/zentrope/proxy"},
+						"spans": converted,
+					},
+				},
+			},
+		},
+	}
+
+	body, err := json.Marshal(request)
+	if err != nil {
+		return err
+	}
+
+	resp, err := e.client.Post(e.endpoint, "application/json", bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	io.Copy(ioutil.Discard, resp.Body)
+
+	if resp.StatusCode/100 != 2 {
+		return fmt.Errorf("collector returned %v", resp.Status)
+	}
+	return nil
+}
+
+func (e *otlpExporter) close() error {
+	return nil
+}
+
+// writerExporter writes one OTLP-shaped JSON span per line, for local
+// debugging.
+type writerExporter struct {
+	out    io.Writer
+	closer io.Closer
+}
+
+func (e *writerExporter) export(service string, spans []*span) error {
+	enc := json.NewEncoder(e.out)
+	for _, s := range spans {
+		if err := enc.Encode(toOTLP(s)); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (e *writerExporter) close() error {
+	if e.closer != nil {
+		return e.closer.Close()
+	}
+	return nil
+}
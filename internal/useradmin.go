@@ -0,0 +1,204 @@
+//
+// Copyright (C) 2017 Keith Irwin
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU General Public License as published
+// by the Free Software Foundation, either version 3 of the License,
+// or (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU General Public License for more details.
+//
+// You should have received a copy of the GNU General Public License
+// along with this program.  If not, see <http://www.gnu.org/licenses/>.
+
+package internal
+
+import (
+	"encoding/json"
+	"fmt"
+	"log"
+	"net/http"
+	"strings"
+	"time"
+)
+
+//-----------------------------------------------------------------------------
+// User administration endpoints (under /admin).
+//
+//   GET    /admin/users               -- list users
+//   POST   /admin/users               -- {"email": .., "password": .., "roles": [..]}
+//   GET    /admin/users/:id           -- one user (by ID or email)
+//   PUT    /admin/users/:id           -- {"email": .., "roles": [..], "disabled": ..}
+//   DELETE /admin/users/:id           -- delete a user
+//   PUT    /admin/users/:id/password  -- {"password": ..}
+//   PUT    /admin/users/:id/roles     -- ["admin", ..]
+//   DELETE /admin/users/:id/totp      -- turn off two-factor (lost device)
+//   GET    /admin/users/:id/tokens    -- the user's personal access tokens
+//   DELETE /admin/users/:id/tokens/:t -- revoke one
+//
+// Changes that affect what a user may do (password, roles, disabling,
+// deleting) end the user's sessions.
+//-----------------------------------------------------------------------------
+
+type userView struct {
+	ID        string     `json:"id"`
+	Email     string     `json:"email"`
+	Roles     []string   `json:"roles"`
+	Disabled  bool       `json:"disabled"`
+	TOTP      bool       `json:"totp"`
+	Created   time.Time  `json:"created"`
+	LastLogin *time.Time `json:"last_login,omitempty"`
+	External  string     `json:"external,omitempty"`
+}
+
+func viewOf(u *User) *userView {
+	roles := u.Roles
+	if roles == nil {
+		roles = []string{}
+	}
+	return &userView{u.ID, u.Email, roles, u.Disabled, u.TOTPEnabled, u.Created, u.LastLogin, u.External}
+}
+
+type userChange struct {
+	Email    *string   `json:"email"`
+	Password string    `json:"password"`
+	Roles    *[]string `json:"roles"`
+	Disabled *bool     `json:"disabled"`
+}
+
+func (proxy ProxyServer) handleAdminUsers(w http.ResponseWriter, r *http.Request, path []string) {
+
+	db := proxy.Database
+
+	// Reports the result of a change to a user.
+	changed := func(action string, user *User, err error, endSessions bool) {
+		if err != nil {
+			status := http.StatusBadRequest
+			if err == errUserNotFound {
+				status = http.StatusNotFound
+			}
+			proxy.audit(r, action, path[0], "failure", err.Error())
+			proxy.writeError(w, r, status, err.Error())
+			return
+		}
+
+		log.Printf("- %v: '%v'", action, user.Email)
+		proxy.audit(r, action, user.Email, "success", "")
+		if endSessions {
+			proxy.endUserSessions(r, user.ID, action)
+		}
+		writeJSON(w, http.StatusOK, viewOf(user))
+	}
+
+	switch {
+
+	case len(path) == 0 && (r.Method == "GET" || r.Method == "HEAD"):
+		users, err := db.Users()
+		if err != nil {
+			proxy.writeError(w, r, http.StatusInternalServerError, err.Error())
+			return
+		}
+		views := make([]*userView, 0, len(users))
+		for _, u := range users {
+			views = append(views, viewOf(u))
+		}
+		writeJSON(w, http.StatusOK, views)
+
+	case len(path) == 0 && r.Method == "POST":
+		var change userChange
+		if err := json.NewDecoder(r.Body).Decode(&change); err != nil || change.Email == nil {
+			proxy.writeError(w, r, http.StatusBadRequest, "Can't deserialize user.")
+			return
+		}
+
+		var roles []string
+		if change.Roles != nil {
+			roles = *change.Roles
+		}
+
+		user, err := db.CreateUser(*change.Email, change.Password, roles)
+		if err == nil && change.Disabled != nil && *change.Disabled {
+			user, err = db.SetDisabled(user.ID, true)
+		}
+		if err != nil {
+			proxy.audit(r, "user.create", *change.Email, "failure", err.Error())
+			proxy.writeError(w, r, http.StatusBadRequest, err.Error())
+			return
+		}
+
+		log.Printf("- user.create: '%v'", user.Email)
+		proxy.audit(r, "user.create", user.Email, "success", "")
+		writeJSON(w, http.StatusCreated, viewOf(user))
+
+	case len(path) == 1 && (r.Method == "GET" || r.Method == "HEAD"):
+		user, err := db.User(path[0])
+		if err != nil {
+			proxy.writeError(w, r, http.StatusNotFound, err.Error())
+			return
+		}
+		writeJSON(w, http.StatusOK, viewOf(user))
+
+	case len(path) == 1 && r.Method == "PUT":
+		var change userChange
+		if err := json.NewDecoder(r.Body).Decode(&change); err != nil {
+			proxy.writeError(w, r, http.StatusBadRequest, "Can't deserialize user.")
+			return
+		}
+
+		endSessions := change.Roles != nil || (change.Disabled != nil && *change.Disabled)
+		user, err := db.UpdateUser(path[0], func(u *User) error {
+			if change.Email != nil {
+				if !strings.Contains(*change.Email, "@") {
+					return fmt.Errorf("invalid email address '%v'", *change.Email)
+				}
+				u.Email = strings.TrimSpace(*change.Email)
+			}
+			if change.Roles != nil {
+				u.Roles = *change.Roles
+			}
+			if change.Disabled != nil {
+				u.Disabled = *change.Disabled
+			}
+			return nil
+		})
+		changed("user.update", user, err, endSessions)
+
+	case len(path) == 1 && r.Method == "DELETE":
+		user, err := db.DeleteUser(path[0])
+		changed("user.delete", user, err, true)
+
+	case len(path) == 2 && path[1] == "password" && r.Method == "PUT":
+		var change userChange
+		if err := json.NewDecoder(r.Body).Decode(&change); err != nil {
+			proxy.writeError(w, r, http.StatusBadRequest, "Can't deserialize password.")
+			return
+		}
+		user, err := db.SetPassword(path[0], change.Password)
+		if err == nil {
+			proxy.resets.revoke(user.ID)
+		}
+		changed("user.password", user, err, true)
+
+	case len(path) == 2 && path[1] == "roles" && r.Method == "PUT":
+		var roles []string
+		if err := json.NewDecoder(r.Body).Decode(&roles); err != nil {
+			proxy.writeError(w, r, http.StatusBadRequest, "Can't deserialize roles.")
+			return
+		}
+		user, err := db.SetRoles(path[0], roles)
+		changed("user.roles", user, err, true)
+
+	case len(path) >= 2 && path[1] == "tokens" && r.Method != "POST":
+		proxy.serveAPITokens(w, r, path[0], path[2:])
+
+	case len(path) == 2 && path[1] == "totp" && r.Method == "DELETE":
+		user, err := db.UpdateUser(path[0], clearTOTP)
+		changed("user.totp.reset", user, err, true)
+
+	default:
+		proxy.writeError(w, r, http.StatusNotFound, "Unknown user resource.")
+	}
+}
@@ -0,0 +1,412 @@
+//
+// Copyright (C) 2017 Keith Irwin
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU General Public License as published
+// by the Free Software Foundation, either version 3 of the License,
+// or (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU General Public License for more details.
+//
+// You should have received a copy of the GNU General Public License
+// along with this program.  If not, see <http://www.gnu.org/licenses/>.
+
+package internal
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"log"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+//-----------------------------------------------------------------------------
+// User storage. The store is an interface so that something sturdier
+// can stand in; the one here keeps users in memory and, given a path,
+// in a JSON file rewritten atomically on every change.
+//-----------------------------------------------------------------------------
+
+var errUserNotFound = errors.New("user not found")
+var errEmailTaken = errors.New("email address already in use")
+
+// UserStore keeps user accounts. Emails are unique, ignoring case.
+type UserStore interface {
+	Create(user *User) error
+	Get(id string) (*User, error)
+	FindByEmail(email string) (*User, error)
+	List() ([]*User, error)
+	Update(user *User) error
+	Change(id string, change func(*User) error) (*User, error)
+	Delete(id string) error
+}
+
+type jsonUserStore struct {
+	path  string
+	mutex sync.RWMutex
+	users map[string]*User
+}
+
+// NewUserStore returns a store backed by a JSON file at path (created
+// when first written), or if path is empty, kept only in memory.
+func NewUserStore(path string) (UserStore, error) {
+	store := &jsonUserStore{path: path, users: make(map[string]*User)}
+	if path == "" {
+		return store, nil
+	}
+
+	data, err := ioutil.ReadFile(path)
+	if os.IsNotExist(err) {
+		return store, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	var users []*User
+	if err := json.Unmarshal(data, &users); err != nil {
+		return nil, fmt.Errorf("user file '%v': %v", path, err)
+	}
+	for _, u := range users {
+		store.users[u.ID] = u
+	}
+	return store, nil
+}
+
+func copyUser(u *User) *User {
+	c := *u
+	c.Roles = append([]string(nil), u.Roles...)
+	c.RecoveryCodes = append([]string(nil), u.RecoveryCodes...)
+	c.APITokens = make([]*APIToken, 0, len(u.APITokens))
+	for _, t := range u.APITokens {
+		token := *t
+		c.APITokens = append(c.APITokens, &token)
+	}
+	if u.LastLogin != nil {
+		t := *u.LastLogin
+		c.LastLogin = &t
+	}
+	return &c
+}
+
+func (store *jsonUserStore) emailTakenLocked(email, exceptID string) bool {
+	for _, u := range store.users {
+		if u.ID != exceptID && strings.EqualFold(u.Email, email) {
+			return true
+		}
+	}
+	return false
+}
+
+func (store *jsonUserStore) Create(user *User) error {
+	store.mutex.Lock()
+	defer store.mutex.Unlock()
+
+	if user.ID == "" {
+		user.ID = mkUUID()
+	}
+	if _, ok := store.users[user.ID]; ok {
+		return fmt.Errorf("user '%v' already exists", user.ID)
+	}
+	if store.emailTakenLocked(user.Email, "") {
+		return errEmailTaken
+	}
+	if user.Created.IsZero() {
+		user.Created = time.Now().UTC()
+	}
+
+	store.users[user.ID] = copyUser(user)
+	return store.saveLocked()
+}
+
+func (store *jsonUserStore) Get(id string) (*User, error) {
+	store.mutex.RLock()
+	defer store.mutex.RUnlock()
+	if u, ok := store.users[id]; ok {
+		return copyUser(u), nil
+	}
+	return nil, errUserNotFound
+}
+
+func (store *jsonUserStore) FindByEmail(email string) (*User, error) {
+	store.mutex.RLock()
+	defer store.mutex.RUnlock()
+	for _, u := range store.users {
+		if strings.EqualFold(u.Email, email) {
+			return copyUser(u), nil
+		}
+	}
+	return nil, errUserNotFound
+}
+
+func (store *jsonUserStore) List() ([]*User, error) {
+	store.mutex.RLock()
+	defer store.mutex.RUnlock()
+
+	users := make([]*User, 0, len(store.users))
+	for _, u := range store.users {
+		users = append(users, copyUser(u))
+	}
+	sort.Slice(users, func(i, j int) bool {
+		return strings.ToLower(users[i].Email) < strings.ToLower(users[j].Email)
+	})
+	return users, nil
+}
+
+func (store *jsonUserStore) Update(user *User) error {
+	store.mutex.Lock()
+	defer store.mutex.Unlock()
+
+	if _, ok := store.users[user.ID]; !ok {
+		return errUserNotFound
+	}
+	if store.emailTakenLocked(user.Email, user.ID) {
+		return errEmailTaken
+	}
+
+	store.users[user.ID] = copyUser(user)
+	return store.saveLocked()
+}
+
+// Change reads, changes and writes a user as one step, so concurrent
+// changes can't undo each other. change mustn't use the store.
+func (store *jsonUserStore) Change(id string, change func(*User) error) (*User, error) {
+	store.mutex.Lock()
+	defer store.mutex.Unlock()
+
+	u, ok := store.users[id]
+	if !ok {
+		return nil, errUserNotFound
+	}
+	c := copyUser(u)
+	if err := change(c); err != nil {
+		return nil, err
+	}
+	if store.emailTakenLocked(c.Email, c.ID) {
+		return nil, errEmailTaken
+	}
+
+	store.users[id] = c
+	if err := store.saveLocked(); err != nil {
+		return nil, err
+	}
+	return copyUser(c), nil
+}
+
+func (store *jsonUserStore) Delete(id string) error {
+	store.mutex.Lock()
+	defer store.mutex.Unlock()
+
+	if _, ok := store.users[id]; !ok {
+		return errUserNotFound
+	}
+	delete(store.users, id)
+	return store.saveLocked()
+}
+
+// saveLocked writes to a temp file in the same directory and renames
+// it over the old one, so a crash never leaves a half written file.
+func (store *jsonUserStore) saveLocked() error {
+	if store.path == "" {
+		return nil
+	}
+
+	users := make([]*User, 0, len(store.users))
+	for _, u := range store.users {
+		users = append(users, u)
+	}
+	sort.Slice(users, func(i, j int) bool { return users[i].Created.Before(users[j].Created) })
+
+	data, err := json.MarshalIndent(users, "", "  ")
+	if err != nil {
+		return err
+	}
+
+	tmp, err := ioutil.TempFile(filepath.Dir(store.path), filepath.Base(store.path)+".tmp")
+	if err != nil {
+		return err
+	}
+
+	_, err = tmp.Write(data)
+	if err == nil {
+		err = tmp.Sync()
+	}
+	if closeErr := tmp.Close(); err == nil {
+		err = closeErr
+	}
+	if err == nil {
+		err = os.Chmod(tmp.Name(), 0600)
+	}
+	if err == nil {
+		err = os.Rename(tmp.Name(), store.path)
+	}
+	if err != nil {
+		os.Remove(tmp.Name())
+		log.Printf("ERROR: unable to save users to '%v': %v", store.path, err)
+	}
+	return err
+}
+
+//-----------------------------------------------------------------------------
+// User administration, shared by the admin API and the command line.
+//-----------------------------------------------------------------------------
+
+// Users returns every user account.
+func (db *Database) Users() ([]*User, error) {
+	return db.users.List()
+}
+
+// User finds an account by ID or email.
+func (db *Database) User(idOrEmail string) (*User, error) {
+	if u, err := db.users.Get(idOrEmail); err == nil {
+		return u, nil
+	}
+	return db.users.FindByEmail(idOrEmail)
+}
+
+// CreateUser adds an account.
+func (db *Database) CreateUser(email, password string, roles []string) (*User, error) {
+	email = strings.TrimSpace(email)
+	if !strings.Contains(email, "@") {
+		return nil, fmt.Errorf("invalid email address '%v'", email)
+	}
+	if err := db.checkPassword(password); err != nil {
+		return nil, err
+	}
+
+	hash, err := db.encryptPassword(password)
+	if err != nil {
+		return nil, err
+	}
+
+	user := &User{
+		Email:    email,
+		Password: hash,
+		Roles:    roles,
+		Created:  time.Now().UTC(),
+	}
+	if err := db.users.Create(user); err != nil {
+		return nil, err
+	}
+	return user, nil
+}
+
+// UpdateUser applies a change to an account, atomically (see
+// UserStore.Change).
+func (db *Database) UpdateUser(idOrEmail string, change func(*User) error) (*User, error) {
+	user, err := db.User(idOrEmail)
+	if err != nil {
+		return nil, err
+	}
+	return db.users.Change(user.ID, change)
+}
+
+// SetPassword replaces an account's password.
+func (db *Database) SetPassword(idOrEmail, password string) (*User, error) {
+	// Hashing is slow, so it's done before taking the store's lock.
+	if err := db.checkPassword(password); err != nil {
+		return nil, err
+	}
+	hash, err := db.encryptPassword(password)
+	if err != nil {
+		return nil, err
+	}
+	return db.UpdateUser(idOrEmail, func(u *User) error {
+		u.Password = hash
+		return nil
+	})
+}
+
+// SetDisabled disables (or re-enables) an account.
+func (db *Database) SetDisabled(idOrEmail string, disabled bool) (*User, error) {
+	return db.UpdateUser(idOrEmail, func(u *User) error {
+		u.Disabled = disabled
+		return nil
+	})
+}
+
+// SetRoles replaces an account's roles.
+func (db *Database) SetRoles(idOrEmail string, roles []string) (*User, error) {
+	return db.UpdateUser(idOrEmail, func(u *User) error {
+		u.Roles = roles
+		return nil
+	})
+}
+
+// provisionUser finds the local account for a user signed in by
+// another system (external identifies them there, as "oidc:..."),
+// linking an account with the same email, or creating one on first
+// sign in. Only an account with no password of its own and no other
+// external identity is linked: otherwise whoever controls the email at
+// the other system could take over a local account. Roles from the
+// other system, if it has any, replace the account's; new accounts
+// without any get defaults.
+func (db *Database) provisionUser(external, email string, roles, defaults []string) (*User, error) {
+	users, err := db.users.List()
+	if err != nil {
+		return nil, err
+	}
+
+	var user *User
+	for _, u := range users {
+		if u.External == external {
+			user = u
+			break
+		}
+	}
+	if user == nil {
+		if u, err := db.users.FindByEmail(email); err == nil {
+			if u.Password != "" || u.External != "" {
+				log.Printf("WARNING: not linking '%v' to existing account '%v'", external, email)
+				return nil, errEmailTaken
+			}
+			user = u
+		}
+	}
+
+	now := time.Now().UTC()
+
+	if user == nil {
+		if roles == nil {
+			roles = defaults
+		}
+		user = &User{Email: email, Roles: roles, External: external, Created: now, LastLogin: &now}
+		if err := db.users.Create(user); err != nil {
+			return nil, err
+		}
+		log.Printf("- provisioned user '%v' for '%v'", email, external)
+		return user, nil
+	}
+
+	if user.Disabled {
+		return nil, errors.New("user disabled")
+	}
+
+	return db.users.Change(user.ID, func(u *User) error {
+		u.External = external
+		u.Email = email
+		if roles != nil {
+			u.Roles = roles
+		}
+		u.LastLogin = &now
+		return nil
+	})
+}
+
+// DeleteUser removes an account.
+func (db *Database) DeleteUser(idOrEmail string) (*User, error) {
+	user, err := db.User(idOrEmail)
+	if err != nil {
+		return nil, err
+	}
+	return user, db.users.Delete(user.ID)
+}
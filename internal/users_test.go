@@ -0,0 +1,59 @@
+//
+// Copyright (C) 2017 Keith Irwin
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU General Public License as published
+// by the Free Software Foundation, either version 3 of the License,
+// or (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU General Public License for more details.
+//
+// You should have received a copy of the GNU General Public License
+// along with this program.  If not, see <http://www.gnu.org/licenses/>.
+
+package internal
+
+import (
+	"fmt"
+	"sync"
+	"testing"
+)
+
+func TestConcurrentUserChangesAllLand(t *testing.T) {
+	users, err := NewUserStore("")
+	if err != nil {
+		t.Fatal(err)
+	}
+	db := NewDatabase(users)
+	user, err := db.CreateUser("ned@example.com", "ned-password-1", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var wg sync.WaitGroup
+	for i := 0; i < 20; i++ {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			_, err := db.UpdateUser(user.ID, func(u *User) error {
+				u.Roles = append(u.Roles, fmt.Sprintf("role%v", i))
+				return nil
+			})
+			if err != nil {
+				t.Error(err)
+			}
+		}(i)
+	}
+	wg.Wait()
+
+	got, err := db.User(user.ID)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(got.Roles) != 20 {
+		t.Errorf("%v of 20 changes kept: %v", len(got.Roles), got.Roles)
+	}
+}
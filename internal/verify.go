@@ -0,0 +1,221 @@
+//
+// Copyright (C) 2017 Keith Irwin
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU General Public License as published
+// by the Free Software Foundation, either version 3 of the License,
+// or (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU General Public License for more details.
+//
+// You should have received a copy of the GNU General Public License
+// along with this program.  If not, see <http://www.gnu.org/licenses/>.
+
+package internal
+
+import (
+	"log"
+	"net/http"
+	"net/url"
+	"strings"
+	"sync"
+)
+
+//-----------------------------------------------------------------------------
+// Forward authentication, so other gateways (nginx auth_request,
+// Traefik forwardAuth) can reuse the proxy's logins. They ask
+//
+//   GET /auth/verify[?role=admin,ops][&redirect=1]
+//
+// with the original request's cookies or Authorization header, and get
+// 200 with identity headers, 401 (or with redirect=1, a redirect to
+// sign in), or 403 when the user lacks every listed role. The login
+// cookie has to reach the gateway's hosts, so set a cookie domain
+// covering them.
+//-----------------------------------------------------------------------------
+
+// ForwardAuthSettings describe where the proxy is and which hosts it
+// will send users back to after signing in.
+type ForwardAuthSettings struct {
+	PublicURL     string   // this proxy, as browsers see it, e.g. https://launchpad.example.com
+	CookieDomain  string   // e.g. example.com, so the login cookie goes to sibling hosts
+	ReturnDomains []string // hosts (and their subdomains) users may be sent back to
+}
+
+type forwardAuth struct {
+	mutex    sync.RWMutex
+	settings ForwardAuthSettings
+}
+
+// SetForwardAuth configures forward authentication.
+func (proxy ProxyServer) SetForwardAuth(settings ForwardAuthSettings) {
+	settings.PublicURL = strings.TrimRight(settings.PublicURL, "/")
+
+	proxy.forwardAuth.mutex.Lock()
+	defer proxy.forwardAuth.mutex.Unlock()
+	proxy.forwardAuth.settings = settings
+	proxy.auth.domain = settings.CookieDomain
+
+	if settings.CookieDomain != "" {
+		log.Printf("- login cookie domain '%v'", settings.CookieDomain)
+	}
+}
+
+func (proxy ProxyServer) forwardAuthSettings() ForwardAuthSettings {
+	proxy.forwardAuth.mutex.RLock()
+	defer proxy.forwardAuth.mutex.RUnlock()
+	return proxy.forwardAuth.settings
+}
+
+// forwarded rebuilds the method and URL of the request the gateway is
+// asking about, from Traefik's X-Forwarded-* or nginx's X-Original-URI.
+// Only -trusted-proxies are believed; anyone else is asking about the
+// request they made.
+func (proxy ProxyServer) forwarded(r *http.Request) (string, *url.URL) {
+	if !proxy.isTrustedPeer(r) {
+		u := &url.URL{Scheme: "http", Host: r.Host, Path: r.URL.Path, RawQuery: r.URL.RawQuery}
+		if r.TLS != nil {
+			u.Scheme = "https"
+		}
+		return r.Method, u
+	}
+
+	method := r.Header.Get("X-Forwarded-Method")
+	if method == "" {
+		method = r.Method
+	}
+
+	uri := r.Header.Get("X-Forwarded-Uri")
+	if uri == "" {
+		uri = r.Header.Get("X-Original-URI")
+	}
+	if uri == "" {
+		uri = "/"
+	}
+
+	u, err := url.ParseRequestURI(uri)
+	if err != nil {
+		u = &url.URL{Path: "/"}
+	}
+
+	u.Scheme = r.Header.Get("X-Forwarded-Proto")
+	if u.Scheme == "" {
+		u.Scheme = "http"
+	}
+	u.Host = r.Header.Get("X-Forwarded-Host")
+	if u.Host == "" {
+		u.Host = r.Host
+	}
+	return method, u
+}
+
+// returnAllowed accepts http(s) URLs on the return domains only, so
+// sign in can't be used as an open redirect.
+func (settings ForwardAuthSettings) returnAllowed(target string) bool {
+	u, err := url.Parse(target)
+	if err != nil || (u.Scheme != "http" && u.Scheme != "https") {
+		return false
+	}
+
+	host := strings.ToLower(u.Hostname())
+	for _, domain := range settings.ReturnDomains {
+		domain = strings.ToLower(strings.TrimPrefix(domain, "."))
+		if domain != "" && (host == domain || strings.HasSuffix(host, "."+domain)) {
+			return true
+		}
+	}
+	return false
+}
+
+func (proxy ProxyServer) handleVerify(w http.ResponseWriter, r *http.Request, path string) {
+	if !proxy.allowMethod(w, r, staticMethods) {
+		return
+	}
+
+	switch path {
+	case "":
+		proxy.verifyForward(w, r)
+	case "return":
+		proxy.verifyReturn(w, r)
+	default:
+		proxy.writeError(w, r, http.StatusNotFound, "Unknown auth resource.")
+	}
+}
+
+func (proxy ProxyServer) verifyForward(w http.ResponseWriter, r *http.Request) {
+	method, original := proxy.forwarded(r)
+
+	// Check the credentials as if for the original request, so that
+	// personal access token scopes apply to it.
+	check := r.WithContext(r.Context())
+	check.URL = &url.URL{Path: original.Path, RawQuery: original.RawQuery}
+	check.Method = method
+
+	token, err := proxy.checkAuth(w, check)
+	var viewer *Viewer
+	if err == nil {
+		viewer, err = proxy.decodeAuthToken(token)
+	}
+
+	if err != nil {
+		proxy.Metrics.inc(metricAuth, "method", "forward", "outcome", "failure")
+		settings := proxy.forwardAuthSettings()
+		if r.URL.Query().Get("redirect") != "" && settings.PublicURL != "" {
+			back := url.Values{"rd": {original.String()}}
+			http.Redirect(w, r, settings.PublicURL+"/auth/verify/return?"+back.Encode(), http.StatusFound)
+			return
+		}
+		w.Header().Set("WWW-Authenticate", `Bearer realm="launchpad"`)
+		proxy.writeError(w, r, http.StatusUnauthorized, badAuthMsg)
+		return
+	}
+
+	if wanted := SplitList(r.URL.Query().Get("role")); len(wanted) > 0 && !hasAnyRole(viewer.Roles, wanted) {
+		proxy.Metrics.inc(metricAuth, "method", "forward", "outcome", "denied")
+		proxy.audit(r, "auth.forward", original.String(), "denied", "needs one of: "+strings.Join(wanted, ", "))
+		proxy.writeError(w, r, http.StatusForbidden, "You don't have access to this resource.")
+		return
+	}
+
+	proxy.Metrics.inc(metricAuth, "method", "forward", "outcome", "success")
+
+	proxy.setAuth(w, token)
+	w.Header().Set("X-Auth-User", viewer.Email)
+	w.Header().Set("X-Auth-User-Id", viewer.ID)
+	w.Header().Set("X-Auth-Roles", strings.Join(viewer.Roles, ","))
+	w.WriteHeader(http.StatusOK)
+}
+
+// verifyReturn is where users who weren't signed in land: it sends
+// them to sign in here, then back where they were going.
+func (proxy ProxyServer) verifyReturn(w http.ResponseWriter, r *http.Request) {
+	settings := proxy.forwardAuthSettings()
+
+	target := r.URL.Query().Get("rd")
+	if !settings.returnAllowed(target) {
+		log.Printf("WARNING: refusing to return to '%v'", target)
+		target = "/"
+	}
+
+	if _, err := proxy.checkAuth(w, r); err != nil {
+		here := url.URL{Path: "/auth/verify/return", RawQuery: r.URL.RawQuery}
+		http.Redirect(w, r, "/?"+url.Values{"next": {here.String()}}.Encode(), http.StatusFound)
+		return
+	}
+
+	http.Redirect(w, r, target, http.StatusFound)
+}
+
+func hasAnyRole(roles, wanted []string) bool {
+	for _, w := range wanted {
+		for _, r := range roles {
+			if r == w {
+				return true
+			}
+		}
+	}
+	return false
+}
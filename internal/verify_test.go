@@ -0,0 +1,57 @@
+//
+// Copyright (C) 2017 Keith Irwin
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU General Public License as published
+// by the Free Software Foundation, either version 3 of the License,
+// or (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU General Public License for more details.
+//
+// You should have received a copy of the GNU General Public License
+// along with this program.  If not, see <http://www.gnu.org/licenses/>.
+
+package internal
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+)
+
+func TestForwardedHeadersNeedTrustedProxy(t *testing.T) {
+	proxy := newTestProxy(t)
+	if err := proxy.TrustProxies([]string{"10.0.0.2"}); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := proxy.Database.CreateUser("max@example.com", "max-password-1", []string{"user"}); err != nil {
+		t.Fatal(err)
+	}
+	_, raw, err := proxy.Database.CreateAPIToken("max@example.com", "ci", []string{"route:api"}, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// The token is only good for /api, so it can only pass when the
+	// forwarded URI is believed.
+	verify := func(peer string) int {
+		r := httptest.NewRequest("GET", "/auth/verify", nil)
+		r.RemoteAddr = peer + ":4321"
+		r.Header.Set("Authorization", "Bearer "+raw)
+		r.Header.Set("X-Forwarded-Uri", "/api/things")
+		r.Header.Set("X-Forwarded-Host", "api.example.com")
+		w := httptest.NewRecorder()
+		proxy.ServeHTTP(w, r)
+		return w.Code
+	}
+
+	if code := verify("10.0.0.2"); code != http.StatusOK {
+		t.Errorf("trusted gateway: got %v, want %v", code, http.StatusOK)
+	}
+	if code := verify("10.0.0.9"); code != http.StatusUnauthorized {
+		t.Errorf("untrusted peer: got %v, want %v", code, http.StatusUnauthorized)
+	}
+}
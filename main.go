@@ -17,41 +17,307 @@
 package main
 
 import (
+	"flag"
 	"log"
 	"os"
 	"os/signal"
+	"strings"
 	"syscall"
+	"time"
 
 	"github.com/zentrope/proxy/internal"
 )
 
 func blockUntilShutdownThenDo(fn func()) {
 	sigChan := make(chan os.Signal)
-	signal.Notify(sigChan, os.Kill, os.Interrupt, syscall.SIGTERM, syscall.SIGKILL, syscall.SIGHUP)
+	signal.Notify(sigChan, os.Kill, os.Interrupt, syscall.SIGTERM, syscall.SIGKILL)
 	v := <-sigChan
 	log.Printf("Signal: %v\n", v)
 	fn()
 }
 
+// onHangup calls fn for each SIGHUP.
+func onHangup(fn func()) {
+	hup := make(chan os.Signal, 1)
+	signal.Notify(hup, syscall.SIGHUP)
+	go func() {
+		for range hup {
+			fn()
+		}
+	}()
+}
+
 func main() {
 
+	if len(os.Args) > 1 && os.Args[1] == "user" {
+		userCommand(os.Args[2:])
+		return
+	}
+
+	accessPath := flag.String("access-log", "", "Access log file (default stdout).")
+	accessFormat := flag.String("access-format", internal.AccessLogJSON, "Access log format: json or combined.")
+	accessMaxSize := flag.Int64("access-max-size", 100, "Rotate the access log file after this many MB (0 to disable).")
+	accessMaxAge := flag.Duration("access-max-age", 24*time.Hour, "Rotate the access log file after this long (0 to disable).")
+	metricsAddr := flag.String("metrics-addr", "", "Serve unauthenticated /metrics on this address (e.g. 127.0.0.1:9100) instead of the main listener.")
+	traceExporter := flag.String("trace-exporter", "", "Export traces with: otlp, stdout or file (default off).")
+	traceEndpoint := flag.String("trace-endpoint", "", "OTLP collector URL, or file path for the file exporter.")
+	ipAllow := flag.String("ip-allow", "", "Comma separated CIDRs allowed to use the proxy (default any).")
+	ipDeny := flag.String("ip-deny", "", "Comma separated CIDRs denied use of the proxy.")
+	adminAllow := flag.String("admin-allow", "", "Comma separated CIDRs allowed to use the admin endpoints (default any).")
+	policyFile := flag.String("policy", "", "Access control policy file (JSON, default admin endpoints for admins only).")
+	auditPath := flag.String("audit-log", "", "Audit log file (default stdout).")
+	auditSyslog := flag.String("audit-syslog", "", "Also send audit entries to syslog: local, udp://host:port or tcp://host:port.")
+	auditKey := flag.String("audit-key", "", "Secret (file or env:NAME) keying the audit log's hash chain.")
+	signingKey := flag.String("signing-key", "", "Token signing key: a PEM (RSA, P-256, Ed25519) or HMAC secret file, or env:NAME.")
+	verifyKeys := flag.String("verify-keys", "", "Comma separated keys (as for -signing-key) still accepted for tokens, e.g. the previous signing key.")
+	accessTTL := flag.Duration("access-ttl", 15*time.Minute, "Lifetime of access tokens (renewed while in use).")
+	refreshTTL := flag.Duration("refresh-ttl", 72*time.Hour, "Lifetime of unused refresh tokens.")
+	usersPath := flag.String("users", "./users.json", "User accounts file (empty to keep users in memory only).")
+	dev := flag.Bool("dev", false, "Development mode: keep users in memory and add test users with a well known password.")
+	bcryptCost := flag.Int("bcrypt-cost", 10, "bcrypt cost for password hashes (older hashes are upgraded at login).")
+	mfaRoles := flag.String("mfa-roles", "", "Comma separated roles required to use two-factor authentication (e.g. admin).")
+	lockAfter := flag.Int("login-lock-after", 10, "Lock an account out after this many failed logins (0 to disable).")
+	ipLockAfter := flag.Int("login-ip-lock-after", 50, "Lock an IP address out after this many failed logins (0 to disable).")
+	lockFor := flag.Duration("login-lock-for", 15*time.Minute, "How long login lockouts last.")
+	oidcIssuer := flag.String("oidc-issuer", "", "OpenID Connect provider (issuer URL) for single sign on (default off).")
+	oidcClientID := flag.String("oidc-client-id", "", "Client ID registered with the OpenID Connect provider.")
+	oidcClientSecret := flag.String("oidc-client-secret", "", "Client secret, or env:NAME (empty for a public client).")
+	oidcRedirect := flag.String("oidc-redirect-url", "http://localhost:8080/auth/oidc/callback", "This proxy's OpenID Connect callback URL, as registered.")
+	oidcScopes := flag.String("oidc-scopes", "email,profile", "Comma separated scopes to request besides openid.")
+	oidcRolesClaim := flag.String("oidc-roles-claim", "", "ID token claim listing the user's groups or roles (e.g. groups).")
+	oidcRoleMap := flag.String("oidc-role-map", "", "Comma separated claim=role pairs (default use claim values as roles).")
+	oidcDefaultRoles := flag.String("oidc-default-roles", "user", "Comma separated roles for new single sign on users with no roles claim that maps.")
+	ldapURL := flag.String("ldap-url", "", "LDAP directory for password logins, ldap://host or ldaps://host (default off).")
+	ldapStartTLS := flag.Bool("ldap-starttls", false, "Upgrade ldap:// connections with StartTLS.")
+	ldapInsecure := flag.Bool("ldap-insecure", false, "Don't verify the directory's TLS certificate (test directories only).")
+	ldapBindDN := flag.String("ldap-bind-dn", "", "Service account DN for user lookups (default anonymous).")
+	ldapBindPassword := flag.String("ldap-bind-password", "", "Service account password, or env:NAME.")
+	ldapBaseDN := flag.String("ldap-base-dn", "", "Where to look for users, e.g. ou=people,dc=example,dc=com.")
+	ldapUserFilter := flag.String("ldap-user-filter", "(&(objectClass=person)(|(uid={login})(mail={login})))", "Filter finding the user's entry.")
+	ldapEmailAttr := flag.String("ldap-email-attr", "mail", "Attribute holding the user's email address.")
+	ldapGroupBaseDN := flag.String("ldap-group-base-dn", "", "Where to look for groups (default -ldap-base-dn).")
+	ldapGroupFilter := flag.String("ldap-group-filter", "(member={dn})", "Filter finding the user's groups (empty to skip groups).")
+	ldapGroupAttr := flag.String("ldap-group-attr", "cn", "Attribute holding group names.")
+	ldapRoleMap := flag.String("ldap-role-map", "", "Comma separated group=role pairs (default use group names as roles).")
+	ldapDefaultRoles := flag.String("ldap-default-roles", "user", "Comma separated roles for new directory users without groups.")
+	publicURL := flag.String("public-url", "", "This proxy's URL as browsers see it (for forward auth sign in redirects and reset links).")
+	cookieDomain := flag.String("cookie-domain", "", "Domain for the login cookie, to share it with forward auth hosts (default this host).")
+	returnDomains := flag.String("forward-auth-domains", "", "Comma separated domains forward auth may send users back to after sign in.")
+	cookieSameSite := flag.String("cookie-samesite", "lax", "SameSite mode of the login cookie: lax, strict or none.")
+	cookieSecure := flag.Bool("cookie-secure", false, "Only send cookies over HTTPS.")
+	csrfExempt := flag.String("csrf-exempt", "", "Comma separated contexts whose back-ends do their own CSRF checks.")
+	passwordMinLength := flag.Int("password-min-length", 8, "Minimum password length.")
+	breachedPasswords := flag.String("breached-passwords", "", "File of breached passwords (or their SHA-1 hashes) to refuse.")
+	smtpRelay := flag.String("smtp-relay", "", "SMTP relay (host:port) for password reset mail (default no reset by email).")
+	smtpFrom := flag.String("smtp-from", "", "From address for password reset mail.")
+	smtpUser := flag.String("smtp-user", "", "Username for the SMTP relay (default none).")
+	smtpPassword := flag.String("smtp-password", "", "Password for the SMTP relay, or env:NAME.")
+	resetTTL := flag.Duration("reset-ttl", 30*time.Minute, "How long a password reset link works.")
+	trustedProxies := flag.String("trusted-proxies", "", "Comma separated CIDRs of proxies whose forwarded headers are trusted.")
+
+	flag.Parse()
+
 	log.Println("Dynamic Proxy Experiment")
 
 	appDir := "./public"
 	hostDir := "./client"
+	errorDir := "./errors"
 	appStoreUrl := "http://localhost:60001"
 
-	clients := internal.NewClientHub()
-	database := internal.NewDatabase()
-	appstore := internal.NewAppStore(appStoreUrl, database)
-	commander := internal.NewCommandProcessor(appDir, database, clients)
+	if *dev {
+		usersSet := false
+		flag.Visit(func(f *flag.Flag) { usersSet = usersSet || f.Name == "users" })
+		if usersSet && *usersPath != "" {
+			log.Fatalf("-dev keeps users in memory, it can't be used with -users %v", *usersPath)
+		}
+		*usersPath = ""
+	}
+
+	metrics := internal.NewMetrics()
+	clients := internal.NewClientHub(metrics)
+	users, err := internal.NewUserStore(*usersPath)
+	if err != nil {
+		log.Fatalf("Unable to open user store: %v", err)
+	}
+
+	database := internal.NewDatabase(users)
+	if err := database.SetPasswordCost(*bcryptCost); err != nil {
+		log.Fatalf("Invalid bcrypt cost: %v", err)
+	}
+	if err := database.SetPasswordPolicy(*passwordMinLength, *breachedPasswords); err != nil {
+		log.Fatalf("Invalid password policy: %v", err)
+	}
+	if *dev {
+		if err := database.SeedTestUsers(); err != nil {
+			log.Fatalf("Unable to add test users: %v", err)
+		}
+	}
+	database.WarnIfEmpty()
+
+	if *ldapURL != "" {
+		ldap, err := internal.NewLDAPAuthenticator(internal.LDAPSettings{
+			URL:          *ldapURL,
+			StartTLS:     *ldapStartTLS,
+			Insecure:     *ldapInsecure,
+			BindDN:       *ldapBindDN,
+			BindPassword: *ldapBindPassword,
+			BaseDN:       *ldapBaseDN,
+			UserFilter:   *ldapUserFilter,
+			EmailAttr:    *ldapEmailAttr,
+			GroupBaseDN:  *ldapGroupBaseDN,
+			GroupFilter:  *ldapGroupFilter,
+			GroupAttr:    *ldapGroupAttr,
+			RoleMap:      parseRoleMap(*ldapRoleMap),
+			DefaultRoles: internal.SplitList(*ldapDefaultRoles),
+		})
+		if err != nil {
+			log.Fatalf("Invalid LDAP settings: %v", err)
+		}
+		database.SetAuthenticators(internal.LocalAuthenticator, ldap)
+	}
 
-	proxy := internal.NewProxyServer(appDir, hostDir, database, commander, clients)
+	appstore := internal.NewAppStore(appStoreUrl, database, metrics)
+	commander := internal.NewCommandProcessor(appDir, database, clients, metrics)
+	maintenance := internal.NewMaintenance(clients)
+
+	accessLog, err := internal.NewAccessLog(*accessFormat, *accessPath, *accessMaxSize*1024*1024, *accessMaxAge)
+	if err != nil {
+		log.Fatalf("Unable to open access log: %v", err)
+	}
+
+	tracer, err := internal.NewTracer(*traceExporter, *traceEndpoint)
+	if err != nil {
+		log.Fatalf("Unable to start tracer: %v", err)
+	}
+
+	audit, err := internal.NewAuditLog(*auditPath)
+	if err != nil {
+		log.Fatalf("Unable to open audit log: %v", err)
+	}
+
+	if *auditKey != "" {
+		if err := audit.SetKey(*auditKey); err != nil {
+			log.Fatalf("Unable to key audit log: %v", err)
+		}
+	} else if *auditPath != "" {
+		log.Println("WARNING: no -audit-key, anyone who can write the audit log can rewrite its hash chain.")
+	}
+
+	if *auditSyslog != "" {
+		if err := audit.SetSyslog(*auditSyslog); err != nil {
+			log.Fatalf("Unable to reach syslog: %v", err)
+		}
+	}
+
+	proxy := internal.NewProxyServer(appDir, hostDir, errorDir, database, commander, clients, maintenance)
+	proxy.AccessLog = accessLog
+	proxy.Metrics = metrics
+	proxy.MetricsAddr = *metricsAddr
+	proxy.Tracer = tracer
+	proxy.Audit = audit
 	proxy.AddRoute("api", "127.0.0.1:10001")
 
+	if err := proxy.TrustProxies(internal.SplitList(*trustedProxies)); err != nil {
+		log.Fatalf("Invalid trusted proxies: %v", err)
+	}
+
+	if err := proxy.SetIPPolicy("", internal.SplitList(*ipAllow), internal.SplitList(*ipDeny)); err != nil {
+		log.Fatalf("Invalid IP allow/deny list: %v", err)
+	}
+
+	if err := proxy.SetIPPolicy("admin", internal.SplitList(*adminAllow), nil); err != nil {
+		log.Fatalf("Invalid admin allow list: %v", err)
+	}
+
+	if *signingKey != "" {
+		ring, err := internal.LoadKeyRing(*signingKey, internal.SplitList(*verifyKeys))
+		if err != nil {
+			log.Fatalf("Unable to load signing keys: %v", err)
+		}
+		proxy.SetKeyRing(ring)
+
+		// Rotating keys with a restart would end every session (they're
+		// in memory), so re-read them on SIGHUP instead.
+		onHangup(func() {
+			ring, err := internal.LoadKeyRing(*signingKey, internal.SplitList(*verifyKeys))
+			if err != nil {
+				log.Printf("WARNING: keeping the current signing keys: %v", err)
+				return
+			}
+			proxy.SetKeyRing(ring)
+		})
+	} else {
+		log.Println("WARNING: no -signing-key, using the built-in development secret.")
+	}
+
+	proxy.SetTokenLifetimes(*accessTTL, *refreshTTL)
+	proxy.RequireMFA(internal.SplitList(*mfaRoles))
+
+	throttle := internal.DefaultThrottleSettings()
+	throttle.AccountLockAfter = *lockAfter
+	throttle.IPLockAfter = *ipLockAfter
+	throttle.LockFor = *lockFor
+	proxy.SetThrottle(throttle)
+
+	proxy.SetForwardAuth(internal.ForwardAuthSettings{
+		PublicURL:     *publicURL,
+		CookieDomain:  *cookieDomain,
+		ReturnDomains: internal.SplitList(*returnDomains),
+	})
+
+	if err := proxy.SetCookiePolicy(*cookieSameSite, *cookieSecure); err != nil {
+		log.Fatalf("Invalid cookie settings: %v", err)
+	}
+
+	for _, context := range internal.SplitList(*csrfExempt) {
+		if err := proxy.SetCSRFExempt(context, true); err != nil {
+			log.Fatalf("Invalid CSRF exemption: %v", err)
+		}
+	}
+
+	if *smtpRelay != "" {
+		err := proxy.SetPasswordReset(internal.MailSettings{
+			Relay:    *smtpRelay,
+			From:     *smtpFrom,
+			Username: *smtpUser,
+			Password: *smtpPassword,
+		}, *resetTTL)
+		if err != nil {
+			log.Fatalf("Invalid password reset settings: %v", err)
+		}
+	}
+
+	if *oidcIssuer != "" {
+		err := proxy.SetOIDC(internal.OIDCSettings{
+			Issuer:       *oidcIssuer,
+			ClientID:     *oidcClientID,
+			ClientSecret: *oidcClientSecret,
+			RedirectURL:  *oidcRedirect,
+			Scopes:       internal.SplitList(*oidcScopes),
+			RolesClaim:   *oidcRolesClaim,
+			RoleMap:      parseRoleMap(*oidcRoleMap),
+			DefaultRoles: internal.SplitList(*oidcDefaultRoles),
+		})
+		if err != nil {
+			log.Fatalf("Invalid OIDC settings: %v", err)
+		}
+	}
+
+	if *policyFile != "" {
+		policy, err := internal.LoadPolicy(*policyFile)
+		if err != nil {
+			log.Fatalf("Unable to load policy: %v", err)
+		}
+		proxy.SetPolicy(policy)
+	}
+
+	accessLog.Start()
+	audit.Start()
+	tracer.Start()
 	clients.Start()
 	database.Start()
 	commander.Start()
+	maintenance.Start()
 	appstore.Start()
 	proxy.Start()
 
@@ -59,10 +325,27 @@ func main() {
 		log.Println("Shutdown")
 		proxy.Stop()
 		appstore.Stop()
+		maintenance.Stop()
 		commander.Stop()
 		database.Stop()
 		clients.Stop()
+		tracer.Stop()
+		audit.Stop()
+		accessLog.Stop()
 	})
 
 	log.Println("System halt.")
 }
+
+// parseRoleMap reads "from=role,from=role" pairs.
+func parseRoleMap(s string) map[string]string {
+	roles := make(map[string]string)
+	for _, pair := range internal.SplitList(s) {
+		parts := strings.SplitN(pair, "=", 2)
+		if len(parts) != 2 {
+			log.Fatalf("Invalid role mapping '%v', want name=role.", pair)
+		}
+		roles[parts[0]] = parts[1]
+	}
+	return roles
+}
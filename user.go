@@ -0,0 +1,187 @@
+//
+// Copyright (C) 2017 Keith Irwin
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU General Public License as published
+// by the Free Software Foundation, either version 3 of the License,
+// or (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU General Public License for more details.
+//
+// You should have received a copy of the GNU General Public License
+// along with this program.  If not, see <http://www.gnu.org/licenses/>.
+
+package main
+
+import (
+	"bufio"
+	"flag"
+	"fmt"
+	"os"
+	"os/exec"
+	osuser "os/user"
+	"strings"
+	"text/tabwriter"
+
+	"github.com/zentrope/proxy/internal"
+)
+
+//-----------------------------------------------------------------------------
+// `proxy user ...` manages accounts in the user store directly, so that
+// the first admin can be set up before the proxy runs. Stop the proxy
+// first: it keeps its own copy of the users and would write over the
+// changes. Changes go to the audit log, as the proxy's would.
+//-----------------------------------------------------------------------------
+
+const userUsage = `usage: proxy user <command> [-users file] [-audit-log file] [-audit-key key] [options]
+
+  add [-role r1,r2] <email>   add a user (prompts for a password)
+  list                        list users
+  passwd <email>              set a user's password
+  disable <email>             disable a user
+  enable <email>              re-enable a user
+`
+
+func userCommand(args []string) {
+	if len(args) == 0 {
+		fmt.Fprint(os.Stderr, userUsage)
+		os.Exit(2)
+	}
+
+	command := args[0]
+	flags := flag.NewFlagSet("user "+command, flag.ExitOnError)
+	usersPath := flags.String("users", "./users.json", "User accounts file.")
+	roles := flags.String("role", "", "Comma separated roles for the new user.")
+	auditPath := flags.String("audit-log", "", "Audit log file (default stdout).")
+	auditKey := flags.String("audit-key", "", "Secret (file or env:NAME) keying the audit log's hash chain.")
+	flags.Parse(args[1:])
+
+	users, err := internal.NewUserStore(*usersPath)
+	if err != nil {
+		fail("Unable to open user store: %v", err)
+	}
+	db := internal.NewDatabase(users)
+
+	audit, err := internal.NewAuditLog(*auditPath)
+	if err != nil {
+		fail("Unable to open audit log: %v", err)
+	}
+	if *auditKey != "" {
+		if err := audit.SetKey(*auditKey); err != nil {
+			fail("Unable to key audit log: %v", err)
+		}
+	}
+
+	// Records a change, exiting if it failed.
+	changed := func(action, resource, detail string, err error) {
+		if err != nil {
+			audit.Record(operator(), action, resource, "failure", err.Error())
+			fail("Unable to %v: %v", detail, err)
+		}
+		audit.Record(operator(), action, resource, "success", "")
+	}
+
+	email := flags.Arg(0)
+	needEmail := func() {
+		if email == "" {
+			fmt.Fprint(os.Stderr, userUsage)
+			os.Exit(2)
+		}
+	}
+
+	switch command {
+
+	case "add":
+		needEmail()
+		user, err := db.CreateUser(email, readPassword(), internal.SplitList(*roles))
+		changed("user.create", email, "add user", err)
+		fmt.Printf("Added %v (%v).\n", user.Email, user.ID)
+
+	case "list":
+		list, err := db.Users()
+		if err != nil {
+			fail("Unable to list users: %v", err)
+		}
+		out := tabwriter.NewWriter(os.Stdout, 0, 4, 2, ' ', 0)
+		fmt.Fprintln(out, "EMAIL\tROLES\tSTATUS\tLAST LOGIN\tID")
+		for _, u := range list {
+			status, last := "active", "never"
+			if u.Disabled {
+				status = "disabled"
+			}
+			if u.LastLogin != nil {
+				last = u.LastLogin.Format("2006-01-02 15:04")
+			}
+			fmt.Fprintf(out, "%v\t%v\t%v\t%v\t%v\n", u.Email, strings.Join(u.Roles, ","), status, last, u.ID)
+		}
+		out.Flush()
+
+	case "passwd":
+		needEmail()
+		_, err := db.SetPassword(email, readPassword())
+		changed("user.password", email, "set password", err)
+		fmt.Printf("Password changed for %v.\n", email)
+
+	case "disable", "enable":
+		needEmail()
+		_, err := db.SetDisabled(email, command == "disable")
+		changed("user.update", email, command+" user", err)
+		fmt.Printf("User %v %vd.\n", email, command)
+
+	default:
+		fmt.Fprint(os.Stderr, userUsage)
+		os.Exit(2)
+	}
+}
+
+// readPassword prompts (twice, without echo) on a terminal, or reads a
+// line from stdin for scripts.
+func readPassword() string {
+	in := bufio.NewReader(os.Stdin)
+	readLine := func() string {
+		line, _ := in.ReadString('\n')
+		return strings.TrimRight(line, "\r\n")
+	}
+
+	info, err := os.Stdin.Stat()
+	if err != nil || info.Mode()&os.ModeCharDevice == 0 {
+		return readLine()
+	}
+
+	stty := func(arg string) {
+		cmd := exec.Command("stty", arg)
+		cmd.Stdin = os.Stdin
+		cmd.Run()
+	}
+
+	stty("-echo")
+	defer stty("echo")
+
+	fmt.Fprint(os.Stderr, "Password: ")
+	first := readLine()
+	fmt.Fprint(os.Stderr, "\nAgain: ")
+	second := readLine()
+	fmt.Fprintln(os.Stderr)
+
+	if first != second {
+		stty("echo")
+		fail("Passwords don't match.")
+	}
+	return first
+}
+
+// operator is who ran the command, for the audit log.
+func operator() string {
+	if u, err := osuser.Current(); err == nil {
+		return "cli:" + u.Username
+	}
+	return "cli"
+}
+
+func fail(format string, args ...interface{}) {
+	fmt.Fprintf(os.Stderr, format+"\n", args...)
+	os.Exit(1)
+}